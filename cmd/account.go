@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+)
+
+// accountShow prints the ACME accounts of the certificate groups
+func accountShow(ctx context.Context, cmd *cli.Command) error {
+
+	services, _, err := certServices(cmd, false)
+	if err != nil {
+		return err
+	}
+
+	for i, svc := range services {
+		if i > 0 {
+			fmt.Println()
+		}
+		if svc.group != "" {
+			fmt.Printf("Group:      %s\n", svc.group)
+		}
+
+		acc, err := svc.acme.Account(ctx)
+		if err != nil {
+			fmt.Printf("Account:    %v\n", err)
+			continue
+		}
+
+		fmt.Printf("Email:      %s\n", acc.Email)
+		fmt.Printf("Account:    %s\n", acc.URI)
+		fmt.Printf("Directory:  %s\n", acc.Directory)
+		fmt.Printf("Key type:   %s\n", acc.KeyType)
+		if acc.QueryError != nil {
+			fmt.Printf("Status:     unavailable: %v\n", acc.QueryError)
+			continue
+		}
+		fmt.Printf("Status:     %s\n", acc.Status)
+		fmt.Printf("Contact:    %s\n", strings.Join(acc.Contact, ", "))
+	}
+
+	return nil
+}
+
+// accountUpdateEmail changes the account contact to the --email flag
+func accountUpdateEmail(ctx context.Context, cmd *cli.Command) error {
+
+	services, unlock, err := certServices(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, svc := range services {
+		if err := svc.acme.UpdateEmail(ctx); err != nil {
+			return fmt.Errorf("%s: %w", svc.name(), err)
+		}
+		fmt.Printf("%s: updated account email\n", svc.name())
+	}
+
+	return nil
+}
+
+// accountKeyRollover replaces the account keys
+func accountKeyRollover(ctx context.Context, cmd *cli.Command) error {
+
+	services, unlock, err := certServices(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, svc := range services {
+		if err := svc.acme.RolloverKey(ctx); err != nil {
+			return fmt.Errorf("%s: %w", svc.name(), err)
+		}
+		fmt.Printf("%s: rolled over account key\n", svc.name())
+	}
+	fmt.Println("restart running instances to use the new account key")
+
+	return nil
+}
+
+// accountDeactivate deactivates the account of a single group
+func accountDeactivate(ctx context.Context, cmd *cli.Command) error {
+
+	svc, unlock, err := accountService(cmd)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := svc.acme.Deactivate(ctx); err != nil {
+		return fmt.Errorf("%s: %w", svc.name(), err)
+	}
+	fmt.Printf("%s: deactivated account, a new account is registered on the next start\n", svc.name())
+
+	return nil
+}
+
+// accountImport stores an account created by the lego cli
+func accountImport(ctx context.Context, cmd *cli.Command) error {
+
+	if cmd.String("path") == "" {
+		return errors.New("required flag \"path\" not set")
+	}
+
+	svc, unlock, err := accountService(cmd)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := svc.acme.Import(ctx, cmd.String("path"), cmd.Bool("force")); err != nil {
+		return fmt.Errorf("%s: %w", svc.name(), err)
+	}
+	fmt.Printf("%s: imported account\n", svc.name())
+
+	return nil
+}
+
+// accountService returns the single selected certificate group, commands
+// that can not be undone never act on several accounts at once. The
+// workdir stays locked until unlock is called.
+func accountService(cmd *cli.Command) (certService, func(), error) {
+
+	services, unlock, err := certServices(cmd, true)
+	if err != nil {
+		return certService{}, nil, err
+	}
+	if len(services) > 1 {
+		unlock()
+		return certService{}, nil, errors.New("several certificate groups configured, select one with --group")
+	}
+
+	return services[0], unlock, nil
+}
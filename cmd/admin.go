@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/urfave/cli/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.openresearch.com/talos-kms-proxy/internal/admin"
+)
+
+// adminStatus prints the state of a running proxy
+func adminStatus(ctx context.Context, cmd *cli.Command) error {
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		s, err := c.Status(ctx, &admin.StatusRequest{})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Version:    %s\n", s.Version)
+		fmt.Printf("Log level:  %s\n", s.LogLevel)
+		fmt.Printf("Lockdown:   %t\n", s.Lockdown)
+		for _, crt := range s.Certificates {
+			name := crt.Group
+			if name == "" {
+				name = "default"
+			}
+			if crt.Error != "" {
+				fmt.Printf("Cert:       %s: %s\n", name, crt.Error)
+				continue
+			}
+			fmt.Printf("Cert:       %s: %s from %s, valid until %s (%s)\n", name, strings.Join(crt.Domains, ", "),
+				crt.Source, crt.NotAfter.AsTime().Local().Format(time.RFC3339), crt.Issuer)
+		}
+		for _, b := range s.Backends {
+			key := b.KeyId
+			if b.Tenant != "" {
+				key = fmt.Sprintf("%s (%s)", b.KeyId, b.Tenant)
+			}
+			if b.Error != "" {
+				fmt.Printf("KMS key:    %s: %s\n", key, b.Error)
+				continue
+			}
+			fmt.Printf("KMS key:    %s: ok\n", key)
+		}
+
+		return nil
+	})
+}
+
+// adminRenew triggers the renewal of the certificates of a running proxy
+func adminRenew(ctx context.Context, cmd *cli.Command) error {
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		resp, err := c.Renew(ctx, &admin.RenewRequest{Group: cmd.String("group")})
+		if err != nil {
+			return err
+		}
+		if len(resp.Triggered) == 0 && len(resp.Failed) == 0 {
+			fmt.Println("a renewal is already pending")
+			return nil
+		}
+		for _, name := range resp.Triggered {
+			if name == "" {
+				name = "default"
+			}
+			fmt.Printf("%s: renewal triggered\n", name)
+		}
+		for _, f := range resp.Failed {
+			name := f.Group
+			if name == "" {
+				name = "default"
+			}
+			fmt.Printf("%s: %s\n", name, f.Error)
+		}
+		if len(resp.Failed) > 0 {
+			return fmt.Errorf("the renewal of %d certificate groups failed", len(resp.Failed))
+		}
+
+		return nil
+	})
+}
+
+// adminRollback serves the previous certificate of a group again
+func adminRollback(ctx context.Context, cmd *cli.Command) error {
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		resp, err := c.Rollback(ctx, &admin.RollbackRequest{Group: cmd.String("group")})
+		if err != nil {
+			return err
+		}
+		crt := resp.Certificate
+		fmt.Printf("now serving %s, valid until %s (%s)\n", strings.Join(crt.Domains, ", "),
+			crt.NotAfter.AsTime().Local().Format(time.RFC3339), crt.Issuer)
+
+		return nil
+	})
+}
+
+// adminLogLevel changes the log level of a running proxy
+func adminLogLevel(ctx context.Context, cmd *cli.Command) error {
+
+	level := cmd.Args().First()
+	if level == "" {
+		return errors.New("missing log level")
+	}
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+		_, err := c.SetLogLevel(ctx, &admin.SetLogLevelRequest{Level: level})
+		return err
+	})
+}
+
+// adminLockdown toggles lockdown mode of a running proxy
+func adminLockdown(ctx context.Context, cmd *cli.Command) error {
+
+	var enabled bool
+	switch cmd.Args().First() {
+	case "on":
+		enabled = true
+	case "off":
+	default:
+		return errors.New("lockdown expects on or off")
+	}
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+		_, err := c.SetLockdown(ctx, &admin.SetLockdownRequest{Enabled: enabled})
+		return err
+	})
+}
+
+// adminNodes lists the nodes known to a running proxy
+func adminNodes(ctx context.Context, cmd *cli.Command) error {
+
+	req := &admin.ListNodesRequest{}
+	if cmd.IsSet("tenant") {
+		tenant := cmd.String("tenant")
+		req.Tenant = &tenant
+	}
+	if cmd.String("status") != "" {
+		status, err := nodeStatus(cmd.String("status"))
+		if err != nil {
+			return err
+		}
+		req.Status = status
+	}
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		resp, err := c.ListNodes(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tTENANT\tSTATUS\tLAST SEEN\tADDRESS")
+		for _, n := range resp.Nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.Uuid, orDash(n.Tenant), statusName(n.Status),
+				formatTime(n.LastSeen), orDash(n.Address))
+		}
+
+		return w.Flush()
+	})
+}
+
+// adminApprove approves a node
+func adminApprove(ctx context.Context, cmd *cli.Command) error {
+	return changeNode(ctx, cmd, (*admin.Client).ApproveNode)
+}
+
+// adminRevoke revokes a node
+func adminRevoke(ctx context.Context, cmd *cli.Command) error {
+	return changeNode(ctx, cmd, (*admin.Client).RevokeNode)
+}
+
+// adminUnrevoke unrevokes a node
+func adminUnrevoke(ctx context.Context, cmd *cli.Command) error {
+	return changeNode(ctx, cmd, (*admin.Client).UnrevokeNode)
+}
+
+// changeNode sends a status change of the node given as argument
+func changeNode(ctx context.Context, cmd *cli.Command,
+	change func(*admin.Client, context.Context, *admin.NodeRequest, ...grpc.CallOption) (*admin.NodeResponse, error)) error {
+
+	uuid := cmd.Args().First()
+	if uuid == "" {
+		return errors.New("missing node uuid")
+	}
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		resp, err := change(c, ctx, &admin.NodeRequest{Uuid: uuid, Tenant: cmd.String("tenant")})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("node %s is %s\n", resp.Node.Uuid, statusName(resp.Node.Status))
+
+		return nil
+	})
+}
+
+// adminAudit prints the recent audit events of a running proxy
+func adminAudit(ctx context.Context, cmd *cli.Command) error {
+
+	req := &admin.ListAuditEventsRequest{
+		Limit:    int32(cmd.Int("limit")),
+		NodeUuid: cmd.String("node"),
+		Type:     cmd.String("type"),
+	}
+	if cmd.IsSet("tenant") {
+		tenant := cmd.String("tenant")
+		req.Tenant = &tenant
+	}
+	if since := cmd.Duration("since"); since > 0 {
+		req.Since = timestamppb.New(time.Now().Add(-since))
+	}
+
+	return callAdmin(ctx, cmd, func(ctx context.Context, c *admin.Client) error {
+
+		resp, err := c.ListAuditEvents(ctx, req)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "TIME\tTYPE\tTENANT\tNODE/METHOD\tPEER\tRESULT")
+		for _, e := range resp.Events {
+			subject := e.NodeUuid
+			if e.Type == "admin" {
+				subject = e.Method
+			}
+			result := "ok"
+			if e.Error != "" {
+				result = e.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", formatTime(e.Time), e.Type, orDash(e.Tenant),
+				orDash(subject), orDash(e.Peer), result)
+		}
+
+		return w.Flush()
+	})
+}
+
+// nodeStatus parses a node status name
+func nodeStatus(name string) (admin.NodeStatus, error) {
+
+	status, ok := admin.NodeStatus_value["NODE_STATUS_"+strings.ToUpper(name)]
+	if !ok || status == 0 {
+		return 0, fmt.Errorf("unknown node status %q, use pending, approved or revoked", name)
+	}
+
+	return admin.NodeStatus(status), nil
+}
+
+// statusName returns the short name of a node status
+func statusName(status admin.NodeStatus) string {
+	return strings.ToLower(strings.TrimPrefix(status.String(), "NODE_STATUS_"))
+}
+
+func formatTime(t *timestamppb.Timestamp) string {
+
+	if t == nil {
+		return "-"
+	}
+
+	return t.AsTime().Local().Format(time.RFC3339)
+}
+
+func orDash(s string) string {
+
+	if s == "" {
+		return "-"
+	}
+
+	return s
+}
+
+// callAdmin connects to the admin listener and runs the call
+func callAdmin(ctx context.Context, cmd *cli.Command, call func(context.Context, *admin.Client) error) error {
+
+	address := cmd.String("admin-listen")
+	if address == "" {
+		return errors.New("required flag \"admin-listen\" not set")
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: cmd.String("server-name"),
+	}
+	if cmd.String("cert") != "" {
+		cert, err := tls.LoadX509KeyPair(cmd.String("cert"), cmd.String("key"))
+		if err != nil {
+			return err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if caFile := cmd.String("ca-file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	client, err := admin.NewClient(address, tlsConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, cmd.Duration("timeout"))
+	defer cancel()
+
+	return call(ctx, client)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/backup"
+)
+
+// backupCreate writes an encrypted archive of the workdir
+func backupCreate(ctx context.Context, cmd *cli.Command) error {
+
+	awscli, err := backupSealer(cmd)
+	if err != nil {
+		return err
+	}
+
+	data, manifest, err := backup.Create(ctx, awscli, cmd.String("workdir"), fmt.Sprintf("%s %s", appname, version))
+	if err != nil {
+		return err
+	}
+
+	output := cmd.String("output")
+	if output == "" {
+		output = fmt.Sprintf("%s-backup-%s.tkb", appname, manifest.Created.Format("20060102T150405Z"))
+	}
+	if err := os.WriteFile(output, data, 0600); err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %d files from %s to %s\n", len(manifest.Files), cmd.String("workdir"), output)
+
+	return nil
+}
+
+// backupRestore validates an archive and replaces the workdir with it
+func backupRestore(ctx context.Context, cmd *cli.Command) error {
+
+	if cmd.String("input") == "" {
+		return errors.New("required flag \"input\" not set")
+	}
+
+	awscli, err := backupSealer(cmd)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(cmd.String("input"))
+	if err != nil {
+		return err
+	}
+	archive, err := backup.Open(ctx, awscli, data)
+	if err != nil {
+		return err
+	}
+	if err := archive.Validate(ctx, awscli); err != nil {
+		return fmt.Errorf("backup is invalid: %w", err)
+	}
+
+	fmt.Printf("backup of %s by %s with %d files is valid\n",
+		archive.Manifest.Created.Local().Format(time.RFC3339), archive.Manifest.Creator, len(archive.Manifest.Files))
+	for _, f := range archive.Manifest.Files {
+		fmt.Printf("  %s  %s\n", f.SHA256, f.Name)
+	}
+	if cmd.Bool("dry-run") {
+		return nil
+	}
+
+	workdir := cmd.String("workdir")
+	unlock, err := lockWorkdir(cmd)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	entries, _ := os.ReadDir(workdir)
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".lock") && !cmd.Bool("force") {
+			return fmt.Errorf("workdir %s is not empty, use --force to replace it", workdir)
+		}
+	}
+
+	old, err := archive.Restore(workdir)
+	if err != nil {
+		return err
+	}
+	if old != "" {
+		fmt.Printf("moved the previous workdir to %s\n", old)
+	}
+	fmt.Printf("restored %s\n", workdir)
+
+	return nil
+}
+
+// backupSealer returns the AWS KMS client that encrypts the archives,
+// backups only cover the local workdir
+func backupSealer(cmd *cli.Command) (*oraws.AWS, error) {
+
+	if s := cmd.String("storage"); s != "local" && s != "" {
+		return nil, fmt.Errorf("backups are only supported for the local storage, back up the %s storage with its own tools", s)
+	}
+	if cmd.String("aws-kms-key-id") == "" {
+		return nil, errors.New("required flag \"aws-kms-key-id\" not set")
+	}
+
+	return oraws.New(cmd.String("aws-kms-key-id"))
+}
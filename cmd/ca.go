@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/ca"
+)
+
+// caExport prints the private CA bundle for the Talos machine config
+func caExport(ctx context.Context, cmd *cli.Command) error {
+
+	store, err := newStorage(cmd)
+	if err != nil {
+		return err
+	}
+
+	bundle, err := ca.Bundle(ctx, store)
+	if err != nil {
+		return err
+	}
+
+	switch format := cmd.String("format"); format {
+	case "talos":
+		fmt.Print(ca.TalosTrustedRoots(cmd.String("name"), bundle))
+	case "pem":
+		fmt.Print(string(bundle))
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+
+	return nil
+}
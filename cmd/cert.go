@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/acme"
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// revocationReasons maps the --reason values to CRL reason codes
+var revocationReasons = map[string]uint{
+	"unspecified":          legoacme.CRLReasonUnspecified,
+	"keyCompromise":        legoacme.CRLReasonKeyCompromise,
+	"superseded":           legoacme.CRLReasonSuperseded,
+	"cessationOfOperation": legoacme.CRLReasonCessationOfOperation,
+	"affiliationChanged":   legoacme.CRLReasonAffiliationChanged,
+}
+
+// certStatus prints the stored certificates and their renewal schedule
+func certStatus(ctx context.Context, cmd *cli.Command) error {
+
+	services, _, err := certServices(cmd, false)
+	if err != nil {
+		return err
+	}
+
+	for i, svc := range services {
+		if i > 0 {
+			fmt.Println()
+		}
+		if svc.group != "" {
+			fmt.Printf("Group:         %s\n", svc.group)
+		}
+
+		s, err := svc.acme.Status(ctx)
+		if err != nil {
+			fmt.Printf("Status:        %v\n", err)
+			continue
+		}
+
+		fmt.Printf("Domains:       %s\n", strings.Join(s.Domains, ", "))
+		fmt.Printf("Issuer:        %s\n", s.Issuer)
+		fmt.Printf("Not before:    %s\n", s.NotBefore.Local().Format(time.RFC3339))
+		fmt.Printf("Not after:     %s (%s left)\n", s.NotAfter.Local().Format(time.RFC3339),
+			time.Until(s.NotAfter).Round(time.Hour))
+		fmt.Printf("Key type:      %s\n", s.KeyType)
+		fmt.Printf("SPKI sha256:   %s\n", s.SPKIHash)
+		switch {
+		case s.ARIError != nil:
+			fmt.Printf("ARI window:    unavailable: %v\n", s.ARIError)
+		case s.WindowStart.IsZero():
+			fmt.Printf("ARI window:    not supported by the CA\n")
+		default:
+			fmt.Printf("ARI window:    %s to %s\n",
+				s.WindowStart.Local().Format(time.RFC3339), s.WindowEnd.Local().Format(time.RFC3339))
+			if s.Explanation != "" {
+				fmt.Printf("Explanation:   %s\n", s.Explanation)
+			}
+		}
+		fmt.Printf("Next renewal:  between %s and %s\n",
+			s.RenewAfter.Local().Format(time.RFC3339), s.RenewBefore.Local().Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// certRenew issues new certificates if they are due or with --force
+// a running instance picks them up on SIGHUP. With --admin-listen the
+// running instance renews them right away instead.
+func certRenew(ctx context.Context, cmd *cli.Command) error {
+
+	if cmd.String("admin-listen") != "" {
+		return adminRenew(ctx, cmd)
+	}
+
+	services, unlock, err := certServices(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	renewed := 0
+	for _, svc := range services {
+		if !cmd.Bool("force") {
+			s, err := svc.acme.Status(ctx)
+			if err == nil && time.Now().Before(s.RenewAfter) {
+				fmt.Printf("%s: not due before %s, use --force to renew now\n",
+					svc.name(), s.RenewAfter.Local().Format(time.RFC3339))
+				continue
+			}
+		}
+
+		if err := svc.acme.Renew(ctx); err != nil {
+			return fmt.Errorf("%s: %w", svc.name(), err)
+		}
+		fmt.Printf("%s: renewed certificate\n", svc.name())
+		renewed++
+	}
+
+	if renewed > 0 {
+		fmt.Println("send SIGHUP to running instances to load the new certificates")
+	}
+
+	return nil
+}
+
+// certRevoke revokes the stored certificates
+func certRevoke(ctx context.Context, cmd *cli.Command) error {
+
+	reason, ok := revocationReasons[cmd.String("reason")]
+	if !ok {
+		return fmt.Errorf("unknown revocation reason %q", cmd.String("reason"))
+	}
+
+	services, unlock, err := certServices(cmd, true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for _, svc := range services {
+		if err := svc.acme.Revoke(ctx, reason); err != nil {
+			return fmt.Errorf("%s: %w", svc.name(), err)
+		}
+		fmt.Printf("%s: revoked certificate\n", svc.name())
+
+		if cmd.Bool("renew") {
+			if err := svc.acme.Renew(ctx); err != nil {
+				return fmt.Errorf("%s: %w", svc.name(), err)
+			}
+			fmt.Printf("%s: renewed certificate\n", svc.name())
+		}
+	}
+
+	return nil
+}
+
+// certService is the acme service of a certificate group
+type certService struct {
+	group   string
+	domains []string
+	acme    *acme.Acme
+}
+
+func (s certService) name() string {
+
+	if s.group != "" {
+		return s.group
+	}
+
+	return strings.Join(s.domains, ", ")
+}
+
+// certServices creates the acme services of the selected certificate
+// groups for use outside of a running instance. Commands that change the
+// state set lock, the local workdir is then locked until unlock is called.
+func certServices(cmd *cli.Command, lock bool) (services []certService, unlock func(), err error) {
+
+	if cmd.String("cert-source") != "acme" {
+		return nil, nil, errors.New("certificate commands require the acme certificate source")
+	}
+
+	unlock = func() {}
+	if lock {
+		unlock, err = lockWorkdir(cmd)
+		if errors.Is(err, storage.ErrLocked) {
+			return nil, nil, fmt.Errorf("%w, stop the running instance first or use \"admin renew\" to renew through it", err)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	defer func() {
+		if err != nil {
+			unlock()
+		}
+	}()
+
+	store, err := newStorage(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	sealer, err := cliSealer(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+	groups, err := certGroups(cmd)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, g := range groups {
+		if name := cmd.String("group"); name != "" && g.name != name {
+			continue
+		}
+		a, err := newAcme(cmd, g, g.storage(store), sealer, certstore.New())
+		if err != nil {
+			return nil, nil, err
+		}
+		services = append(services, certService{group: g.name, domains: g.domains, acme: a})
+	}
+	if len(services) == 0 {
+		return nil, nil, fmt.Errorf("unknown certificate group %q", cmd.String("group"))
+	}
+
+	return services, unlock, nil
+}
+
+// cliSealer returns the AWS KMS client if private keys are encrypted at
+// rest, nil otherwise
+func cliSealer(cmd *cli.Command) (seal.Sealer, error) {
+
+	if !cmd.Bool("encrypt-at-rest") {
+		return nil, nil
+	}
+	if cmd.String("aws-kms-key-id") == "" {
+		return nil, errors.New("required flag \"aws-kms-key-id\" not set")
+	}
+
+	return oraws.New(cmd.String("aws-kms-key-id"))
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/siderolabs/kms-client/api/kms"
+	"github.com/urfave/cli/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// clientSeal seals the input with a running proxy
+func clientSeal(ctx context.Context, cmd *cli.Command) error {
+
+	data, err := readInput(cmd.String("in"))
+	if err != nil {
+		return err
+	}
+
+	resp, err := callProxy(ctx, cmd, func(ctx context.Context, c kms.KMSServiceClient, req *kms.Request) (*kms.Response, error) {
+		return c.Seal(ctx, req)
+	}, data)
+	if err != nil {
+		return fmt.Errorf("seal: %w", err)
+	}
+
+	out := resp.Data
+	if cmd.Bool("base64") {
+		out = []byte(base64.StdEncoding.EncodeToString(out) + "\n")
+	}
+
+	return writeOutput(cmd.String("out"), out)
+}
+
+// clientUnseal unseals the input with a running proxy
+func clientUnseal(ctx context.Context, cmd *cli.Command) error {
+
+	data, err := readInput(cmd.String("in"))
+	if err != nil {
+		return err
+	}
+	if cmd.Bool("base64") {
+		if data, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err != nil {
+			return fmt.Errorf("invalid base64 input: %w", err)
+		}
+	}
+
+	resp, err := callProxy(ctx, cmd, func(ctx context.Context, c kms.KMSServiceClient, req *kms.Request) (*kms.Response, error) {
+		return c.Unseal(ctx, req)
+	}, data)
+	if err != nil {
+		return fmt.Errorf("unseal: %w", err)
+	}
+
+	return writeOutput(cmd.String("out"), resp.Data)
+}
+
+// callProxy connects to the proxy and sends the request for the node
+func callProxy(ctx context.Context, cmd *cli.Command, call func(context.Context, kms.KMSServiceClient, *kms.Request) (*kms.Response, error), data []byte) (*kms.Response, error) {
+
+	tlsConfig, err := clientTLSConfig(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := grpc.NewClient(cmd.String("endpoint"), grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, cmd.Duration("timeout"))
+	defer cancel()
+
+	return call(ctx, kms.NewKMSServiceClient(conn), &kms.Request{
+		NodeUuid: cmd.String("node-uuid"),
+		Data:     data,
+	})
+}
+
+// clientTLSConfig creates the TLS configuration from the verification flags
+func clientTLSConfig(cmd *cli.Command) (*tls.Config, error) {
+
+	cfg := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         cmd.String("server-name"),
+		InsecureSkipVerify: cmd.Bool("insecure-skip-verify"),
+	}
+
+	if caFile := cmd.String("ca-file"); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+	}
+
+	return cfg, nil
+}
+
+// readInput reads a file or stdin for "-"
+func readInput(path string) ([]byte, error) {
+
+	var (
+		data []byte
+		err  error
+	)
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, errors.New("no input data")
+	}
+
+	return data, nil
+}
+
+// writeOutput writes a file readable only by the owner or stdout for "-"
+func writeOutput(path string, data []byte) error {
+
+	if path == "-" {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
@@ -1,17 +1,472 @@
 package main
 
 import (
+	"time"
+
 	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/acme"
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
+	"github.openresearch.com/talos-kms-proxy/internal/ca"
 )
 
 var (
+	// clientFlags are the flags of the seal and unseal client commands
+	clientFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:     "endpoint",
+			Usage:    "Address of the KMS proxy as host:port",
+			Sources:  cli.EnvVars("KMS_ENDPOINT"),
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:     "node-uuid",
+			Usage:    "UUID of the node the data belongs to",
+			Sources:  cli.EnvVars("NODE_UUID"),
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "in",
+			Usage: "File to read the data from, - reads from stdin",
+			Value: "-",
+		},
+		&cli.StringFlag{
+			Name:  "out",
+			Usage: "File to write the result to, - writes to stdout",
+			Value: "-",
+		},
+		&cli.BoolFlag{
+			Name:  "base64",
+			Usage: "Sealed data is base64 encoded, the output of seal and the input of unseal",
+		},
+		&cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "CA bundle to verify the proxy certificate, the system roots are used by default",
+		},
+		&cli.StringFlag{
+			Name:  "server-name",
+			Usage: "Server name to send via SNI and verify, defaults to the endpoint host",
+		},
+		&cli.BoolFlag{
+			Name:  "insecure-skip-verify",
+			Usage: "Do not verify the proxy certificate",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Timeout of the request",
+			Value: 30 * time.Second,
+		},
+	}
+
+	// adminClientFlags are the flags of the commands calling the admin API
+	adminClientFlags = []cli.Flag{
+		&cli.StringFlag{
+			Name:  "cert",
+			Usage: "Client certificate for the admin TCP listener",
+		},
+		&cli.StringFlag{
+			Name:  "key",
+			Usage: "Private key of the client certificate",
+		},
+		&cli.StringFlag{
+			Name:  "ca-file",
+			Usage: "CA bundle to verify the admin listener certificate",
+		},
+		&cli.StringFlag{
+			Name:  "server-name",
+			Usage: "Server name to verify, defaults to the host of --admin-listen",
+		},
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Timeout of the admin call",
+			Value: 30 * time.Second,
+		},
+	}
+
+	// nodeTenantFlag selects the tenant of the node of the admin commands
+	nodeTenantFlag = &cli.StringFlag{
+		Name:  "tenant",
+		Usage: "Server name of the tenant of the node, empty for the default key",
+	}
+
 	commands = &cli.Command{
 		Name:    appname,
 		Usage:   "Talos KMS Server",
 		Version: version,
 		Before:  prepare,
 		Action:  run,
+		Commands: []*cli.Command{
+			{
+				Name:   "seal",
+				Usage:  "Seal data with a running proxy the way a Talos node does",
+				Action: clientSeal,
+				Flags:  clientFlags,
+			},
+			{
+				Name:   "unseal",
+				Usage:  "Unseal data with a running proxy the way a Talos node does",
+				Action: clientUnseal,
+				Flags:  clientFlags,
+			},
+			{
+				Name:  "cert",
+				Usage: "Inspect, renew and revoke the ACME certificates",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "group",
+						Usage: "Only handle the named certificate group",
+					},
+				},
+				Commands: []*cli.Command{
+					{
+						Name:   "status",
+						Usage:  "Print the stored certificates, the ARI window and the next renewal",
+						Action: certStatus,
+					},
+					{
+						Name:   "renew",
+						Usage:  "Renew the certificates if they are due, or right away through the running instance at --admin-listen if set",
+						Action: certRenew,
+						Flags: append([]cli.Flag{
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Renew even if the certificates are not due",
+							},
+						}, adminClientFlags...),
+					},
+					{
+						Name:   "revoke",
+						Usage:  "Revoke the stored certificates",
+						Action: certRevoke,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "reason",
+								Usage: "Revocation reason (unspecified, keyCompromise, superseded, cessationOfOperation, affiliationChanged)",
+								Value: "unspecified",
+							},
+							&cli.BoolFlag{
+								Name:  "renew",
+								Usage: "Issue a new certificate after the revocation",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "account",
+				Usage: "Manage the ACME accounts",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "group",
+						Usage: "Only handle the account of the named certificate group",
+					},
+				},
+				Commands: []*cli.Command{
+					{
+						Name:   "show",
+						Usage:  "Print the stored accounts and their state at the CA",
+						Action: accountShow,
+					},
+					{
+						Name:   "update-email",
+						Usage:  "Change the account contact to the --email flag",
+						Action: accountUpdateEmail,
+					},
+					{
+						Name:   "key-rollover",
+						Usage:  "Replace the account key with a new key",
+						Action: accountKeyRollover,
+					},
+					{
+						Name:   "deactivate",
+						Usage:  "Deactivate the account at the CA and remove it from storage",
+						Action: accountDeactivate,
+					},
+					{
+						Name:   "import",
+						Usage:  "Import an account directory created by the lego cli",
+						Action: accountImport,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "path",
+								Usage: "lego account directory, e.g. .lego/accounts/<server>/<email>",
+							},
+							&cli.BoolFlag{
+								Name:  "force",
+								Usage: "Replace an existing account",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "admin",
+				Usage: "Control a running proxy through the admin API at --admin-listen",
+				Flags: adminClientFlags,
+				Commands: []*cli.Command{
+					{
+						Name:   "status",
+						Usage:  "Print the served certificates, the KMS key health, the log level and lockdown mode",
+						Action: adminStatus,
+					},
+					{
+						Name:   "renew",
+						Usage:  "Renew the certificates now",
+						Action: adminRenew,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "group",
+								Usage: "Only renew the named certificate group",
+							},
+						},
+					},
+					{
+						Name:   "rollback",
+						Usage:  "Serve the certificate replaced by the last renewal again",
+						Action: adminRollback,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "group",
+								Usage: "Certificate group to roll back, the default group if not set",
+							},
+						},
+					},
+					{
+						Name:      "log-level",
+						Usage:     "Change the log level (trace, debug, info, error)",
+						ArgsUsage: "<level>",
+						Action:    adminLogLevel,
+					},
+					{
+						Name:      "lockdown",
+						Usage:     "Reject all seal and unseal requests (on) or serve them again (off)",
+						ArgsUsage: "<on|off>",
+						Action:    adminLockdown,
+					},
+					{
+						Name:   "nodes",
+						Usage:  "List the nodes that sent seal or unseal requests",
+						Action: adminNodes,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "tenant",
+								Usage: "Only list the nodes of the tenant, an empty value selects the default key",
+							},
+							&cli.StringFlag{
+								Name:  "status",
+								Usage: "Only list nodes with the status (pending, approved, revoked)",
+							},
+						},
+					},
+					{
+						Name:      "approve",
+						Usage:     "Allow a pending or not yet known node to seal and unseal",
+						ArgsUsage: "<node uuid>",
+						Action:    adminApprove,
+						Flags:     []cli.Flag{nodeTenantFlag},
+					},
+					{
+						Name:      "revoke",
+						Usage:     "Reject all further requests of a node",
+						ArgsUsage: "<node uuid>",
+						Action:    adminRevoke,
+						Flags:     []cli.Flag{nodeTenantFlag},
+					},
+					{
+						Name:      "unrevoke",
+						Usage:     "Approve a revoked node again",
+						ArgsUsage: "<node uuid>",
+						Action:    adminUnrevoke,
+						Flags:     []cli.Flag{nodeTenantFlag},
+					},
+					{
+						Name:   "audit",
+						Usage:  "Print the most recent seal, unseal and admin calls, newest first",
+						Action: adminAudit,
+						Flags: []cli.Flag{
+							&cli.IntFlag{
+								Name:  "limit",
+								Usage: "Maximum number of events, 0 prints all kept events",
+								Value: 50,
+							},
+							&cli.StringFlag{
+								Name:  "tenant",
+								Usage: "Only print the events of the tenant, an empty value selects the default key",
+							},
+							&cli.StringFlag{
+								Name:  "node",
+								Usage: "Only print the events of the node uuid",
+							},
+							&cli.StringFlag{
+								Name:  "type",
+								Usage: "Only print events of the type (seal, unseal, admin)",
+							},
+							&cli.DurationFlag{
+								Name:  "since",
+								Usage: "Only print events of the last duration",
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:   "backup",
+				Usage:  "Write an archive of the workdir encrypted with the KMS key",
+				Action: backupCreate,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Archive file (default: <appname>-backup-<time>.tkb)",
+					},
+				},
+			},
+			{
+				Name:   "restore",
+				Usage:  "Validate a backup archive and replace the workdir with it",
+				Action: backupRestore,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "input",
+						Aliases: []string{"i"},
+						Usage:   "Archive file written by the backup command",
+					},
+					&cli.BoolFlag{
+						Name:  "dry-run",
+						Usage: "Only validate the archive",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "Replace a workdir that is not empty, the previous workdir is kept next to it",
+					},
+				},
+			},
+			{
+				Name:   "doctor",
+				Usage:  "Run preflight checks of the AWS, DNS, ACME and local setup before deploying",
+				Action: doctor,
+			},
+			{
+				Name:  "keys",
+				Usage: "Manage the AWS KMS keys used by the proxy",
+				Commands: []*cli.Command{
+					{
+						Name:   "create",
+						Usage:  "Create a key with the key policy template, an alias and automatic rotation",
+						Action: keysCreate,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "Value of the name tag of the key",
+							},
+							&cli.StringFlag{
+								Name:  "alias",
+								Usage: "Alias of the key, the alias/ prefix is optional",
+							},
+							&cli.StringFlag{
+								Name:  "description",
+								Usage: "Description of the key",
+								Value: "Talos disk encryption key",
+							},
+							&cli.StringSliceFlag{
+								Name:  "tag",
+								Usage: "Tag of the key as key=value (can be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "admin-principal",
+								Usage: "ARN of a principal allowed to administer the key (can be repeated)",
+							},
+							&cli.StringSliceFlag{
+								Name:  "proxy-principal",
+								Usage: "ARN of a principal the proxy runs as, allowed to encrypt and decrypt (can be repeated)",
+							},
+							&cli.StringFlag{
+								Name:  "policy-template",
+								Usage: "Go template of the key policy, replaces the built-in template",
+							},
+							&cli.DurationFlag{
+								Name:  "rotation-period",
+								Usage: "Period of the automatic key material rotation, at least 90 days",
+								Value: 365 * 24 * time.Hour,
+							},
+							&cli.BoolFlag{
+								Name:  "dry-run",
+								Usage: "Print the rendered key policy without creating the key",
+							},
+						},
+					},
+					{
+						Name:   "describe",
+						Usage:  "Print the state, rotation status and aliases of a key",
+						Action: keysDescribe,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "key-id",
+								Usage: "ID, ARN or alias of the key, defaults to --aws-kms-key-id",
+							},
+						},
+					},
+					{
+						Name:   "enable-rotation",
+						Usage:  "Enable automatic rotation of the key material",
+						Action: keysEnableRotation,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "key-id",
+								Usage: "ID, ARN or alias of the key, defaults to --aws-kms-key-id",
+							},
+							&cli.DurationFlag{
+								Name:  "rotation-period",
+								Usage: "Period of the automatic key material rotation, at least 90 days",
+								Value: 365 * 24 * time.Hour,
+							},
+						},
+					},
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Inspect the configuration file settings",
+				Commands: []*cli.Command{
+					{
+						Name:   "schema",
+						Usage:  "Print the settings with their type and whether they reload without restart",
+						Action: configPrintSchema,
+					},
+				},
+			},
+			{
+				Name:  "ca",
+				Usage: "Manage the private CA of the ca certificate source",
+				Commands: []*cli.Command{
+					{
+						Name:   "export",
+						Usage:  "Print the CA bundle for the Talos machine config",
+						Action: caExport,
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "format",
+								Usage: "Output format (talos, pem)",
+								Value: "talos",
+							},
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "Name of the Talos TrustedRootsConfig document",
+								Value: "taloskms-ca",
+							},
+						},
+					},
+				},
+			},
+		},
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:     "config",
+				Usage:    "YAML or TOML configuration file, keys are the flag names, flags and environment variables take precedence",
+				Aliases:  []string{"c"},
+				Sources:  cli.EnvVars("CONFIG_FILE"),
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "listen-port",
 				Usage:    "Service listen port",
@@ -20,6 +475,49 @@ var (
 				Sources:  cli.EnvVars("LISTEN_PORT"),
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "admin-listen",
+				Usage:    "Address of the admin API, unix:///path for a socket or host:port for TCP with mTLS (default: disabled)",
+				Sources:  cli.EnvVars("ADMIN_LISTEN"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "admin-cert",
+				Usage:    "PEM file with the server certificate of the admin TCP listener",
+				Sources:  cli.EnvVars("ADMIN_CERT"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "admin-key",
+				Usage:    "PEM file with the private key of the admin TCP listener",
+				Sources:  cli.EnvVars("ADMIN_KEY"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "admin-client-ca",
+				Usage:    "PEM file with the CA of the client certificates accepted by the admin TCP listener",
+				Sources:  cli.EnvVars("ADMIN_CLIENT_CA"),
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "require-node-approval",
+				Usage:    "Reject seal and unseal requests of new nodes until they are approved through the admin API, otherwise new nodes are approved on first use",
+				Sources:  cli.EnvVars("REQUIRE_NODE_APPROVAL"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "node-policy",
+				Usage:    "YAML file with the allowed nodes, networks and rate limits of the nodes of each tenant",
+				Sources:  cli.EnvVars("NODE_POLICY"),
+				Required: false,
+			},
+			&cli.IntFlag{
+				Name:     "audit-events",
+				Usage:    "Number of recent seal, unseal and admin calls kept in the audit log of the storage for the admin API",
+				Value:    audit.DefaultSize,
+				Sources:  cli.EnvVars("AUDIT_EVENTS"),
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "email",
 				Usage:    "Email to use for ACME Client",
@@ -29,10 +527,127 @@ var (
 			},
 			&cli.StringSliceFlag{
 				Name:     "domain",
-				Usage:    "Domain used in SAN filed for the server certificate (can be repeated)",
+				Usage:    "Domain used in SAN filed for the server certificate, IP addresses are allowed with the ca source (can be repeated)",
 				Aliases:  []string{"d"},
 				Sources:  cli.EnvVars("DOMAINS"),
-				Required: true,
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "cert-group",
+				Usage:    "Certificate group served by its own certificate selected by SNI, as name=domain[;domain...][;option=value...] (can be repeated, replaces --domain)",
+				Sources:  cli.EnvVars("CERT_GROUPS"),
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "tenant",
+				Usage:    "Tenant served under an SNI hostname with its own AWS KMS key, as hostname=key-id (can be repeated)",
+				Sources:  cli.EnvVars("TENANTS"),
+				Required: false,
+			},
+			&cli.StringSliceFlag{
+				Name:     "tenant-listen",
+				Usage:    "Additional listen address of a tenant as address=hostname, its requests are served by the tenant regardless of the SNI hostname (can be repeated)",
+				Sources:  cli.EnvVars("TENANT_LISTEN"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "cert-source",
+				Usage:    "Source of the server certificate (acme, static, ca, vault, step-ca)",
+				Value:    "acme",
+				Sources:  cli.EnvVars("CERT_SOURCE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "tls-cert-file",
+				Usage:    "Certificate file used by the static certificate source",
+				Sources:  cli.EnvVars("TLS_CERT_FILE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "tls-key-file",
+				Usage:    "Private key file used by the static certificate source",
+				Sources:  cli.EnvVars("TLS_KEY_FILE"),
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "ca-cert-lifetime",
+				Usage:    "Lifetime of the server certificate issued by the ca source",
+				Value:    ca.DefaultCertLifetime,
+				Sources:  cli.EnvVars("CA_CERT_LIFETIME"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-addr",
+				Usage:    "Address of the Vault server used by the vault source",
+				Sources:  cli.EnvVars("VAULT_ADDR"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-token",
+				Usage:    "Vault token used by the vault source",
+				Sources:  cli.EnvVars("VAULT_TOKEN"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-namespace",
+				Usage:    "Vault namespace used by the vault source",
+				Sources:  cli.EnvVars("VAULT_NAMESPACE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-pki-mount",
+				Usage:    "Mount path of the Vault PKI secrets engine",
+				Value:    "pki",
+				Sources:  cli.EnvVars("VAULT_PKI_MOUNT"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-pki-role",
+				Usage:    "Vault PKI role used to sign the server certificate",
+				Sources:  cli.EnvVars("VAULT_PKI_ROLE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "vault-cacert",
+				Usage:    "PEM file with the CA certificate of the Vault server and the root of its PKI, issued certificates must chain to it",
+				Sources:  cli.EnvVars("VAULT_CACERT"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "step-ca-url",
+				Usage:    "URL of the step-ca server used by the step-ca source",
+				Sources:  cli.EnvVars("STEP_CA_URL"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "step-ca-root",
+				Usage:    "PEM file with the root certificate of the step-ca server, issued certificates must chain to it",
+				Sources:  cli.EnvVars("STEP_CA_ROOT"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "step-provisioner",
+				Usage:    "Name of the step-ca JWK provisioner",
+				Sources:  cli.EnvVars("STEP_PROVISIONER"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "step-provisioner-key",
+				Usage:    "File with the JWK provisioner private key (JWK or encrypted JWE)",
+				Sources:  cli.EnvVars("STEP_PROVISIONER_KEY"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "step-provisioner-password-file",
+				Usage:    "File with the password of an encrypted provisioner key",
+				Sources:  cli.EnvVars("STEP_PROVISIONER_PASSWORD_FILE"),
+				Required: false,
+			},
+			&cli.DurationFlag{
+				Name:     "issuer-cert-ttl",
+				Usage:    "Requested lifetime of certificates from the vault and step-ca sources (default: CA default)",
+				Sources:  cli.EnvVars("ISSUER_CERT_TTL"),
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "workdir",
@@ -42,6 +657,84 @@ var (
 				Sources:  cli.EnvVars("WORKDIR"),
 				Required: false,
 			},
+			&cli.StringFlag{
+				Name:     "storage",
+				Usage:    "Storage for the ACME account and certificates (local, s3, kubernetes)",
+				Value:    "local",
+				Sources:  cli.EnvVars("STORAGE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-s3-bucket",
+				Usage:    "S3 bucket used by the s3 storage",
+				Sources:  cli.EnvVars("STORAGE_S3_BUCKET"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-s3-prefix",
+				Usage:    "Object key prefix used by the s3 storage",
+				Value:    "taloskms",
+				Sources:  cli.EnvVars("STORAGE_S3_PREFIX"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-s3-region",
+				Usage:    "Region of the S3 bucket",
+				Value:    "eu-west-1",
+				Sources:  cli.EnvVars("STORAGE_S3_REGION"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-s3-endpoint",
+				Usage:    "Endpoint of an S3 compatible object storage (e.g. MinIO)",
+				Sources:  cli.EnvVars("STORAGE_S3_ENDPOINT"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-k8s-secret",
+				Usage:    "Name of the Kubernetes Secret used by the kubernetes storage",
+				Value:    "taloskms-state",
+				Sources:  cli.EnvVars("STORAGE_K8S_SECRET"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "storage-k8s-namespace",
+				Usage:    "Namespace of the Kubernetes Secret (default: namespace of the pod)",
+				Sources:  cli.EnvVars("STORAGE_K8S_NAMESPACE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "leader-election",
+				Usage:    "Leader election for replicas sharing the storage (none, file, kubernetes, dynamodb)",
+				Value:    "none",
+				Sources:  cli.EnvVars("LEADER_ELECTION"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "leader-election-name",
+				Usage:    "Name of the Kubernetes Lease or DynamoDB item used for leader election",
+				Value:    "taloskms-leader",
+				Sources:  cli.EnvVars("LEADER_ELECTION_NAME"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "leader-election-identity",
+				Usage:    "Identity of this replica (default: pod name or hostname)",
+				Sources:  cli.EnvVars("LEADER_ELECTION_IDENTITY"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "leader-election-lock-file",
+				Usage:    "Lock file used by the file leader election (default: <workdir>/leader.lock)",
+				Sources:  cli.EnvVars("LEADER_ELECTION_LOCK_FILE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "leader-election-dynamodb-table",
+				Usage:    "DynamoDB table used by the dynamodb leader election",
+				Sources:  cli.EnvVars("LEADER_ELECTION_DYNAMODB_TABLE"),
+				Required: false,
+			},
 			&cli.StringFlag{
 				Name:     "log-level",
 				Usage:    "Logging level to use",
@@ -54,25 +747,96 @@ var (
 				Name:     "aws-kms-key-id",
 				Usage:    "AWS KMS key ID",
 				Sources:  cli.EnvVars("AWS_KMS_KEY_ID"),
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "aws-access-key-id",
 				Usage:    "AWS access key ID",
 				Sources:  cli.EnvVars("AWS_ACCESS_KEY_ID"),
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "aws-secret-access-key",
 				Usage:    "AWS secret access key",
 				Sources:  cli.EnvVars("AWS_SECRET_ACCESS_KEY"),
-				Required: true,
+				Required: false,
 			},
 			&cli.StringFlag{
 				Name:     "aws-hosted-zone-id",
 				Usage:    "AWS hosted zone ID",
 				Sources:  cli.EnvVars("AWS_HOSTED_ZONE_ID"),
-				Required: true,
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "acme-directory-url",
+				Usage:    "ACME directory URL (overrides the Let's Encrypt servers)",
+				Sources:  cli.EnvVars("ACME_DIRECTORY_URL"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "acme-eab-kid",
+				Usage:    "External Account Binding key ID for the ACME server",
+				Sources:  cli.EnvVars("ACME_EAB_KID"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "acme-eab-hmac",
+				Usage:    "External Account Binding HMAC key (base64url) for the ACME server",
+				Sources:  cli.EnvVars("ACME_EAB_HMAC"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "acme-ca-bundle",
+				Usage:    "PEM file with additional CA certificates to trust for the ACME server",
+				Sources:  cli.EnvVars("ACME_CA_BUNDLE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "acme-trust-roots",
+				Usage:    "PEM file with the roots issued certificates must chain to, e.g. the Pebble root from its /roots/0 endpoint (default: system roots for Let's Encrypt, no chain check for other directories)",
+				Sources:  cli.EnvVars("ACME_TRUST_ROOTS"),
+				Required: false,
+			},
+			&cli.FloatFlag{
+				Name:     "renew-fraction",
+				Usage:    "Share of the certificate lifetime after which it is renewed if the CA does not support ARI",
+				Value:    acme.DefaultRenewFraction,
+				Sources:  cli.EnvVars("RENEW_FRACTION"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "key-type",
+				Usage:    "Certificate key type (EC256, EC384, RSA2048, RSA4096)",
+				Value:    "EC256",
+				Sources:  cli.EnvVars("KEY_TYPE"),
+				Required: false,
+			},
+			&cli.StringFlag{
+				Name:     "preferred-chain",
+				Usage:    "Common name of the root or intermediate of the preferred ACME certificate chain",
+				Sources:  cli.EnvVars("PREFERRED_CHAIN"),
+				Required: false,
+			},
+			&cli.BoolFlag{
+				Name:     "ocsp-stapling",
+				Usage:    "Staple OCSP responses to the server certificate",
+				Sources:  cli.EnvVars("OCSP_STAPLING"),
+				Required: false,
+				Value:    true,
+			},
+			&cli.BoolFlag{
+				Name:     "reuse-key",
+				Usage:    "Reuse the existing certificate private key on renewal",
+				Sources:  cli.EnvVars("REUSE_KEY"),
+				Required: false,
+				Value:    false,
+			},
+			&cli.BoolFlag{
+				Name:     "encrypt-at-rest",
+				Usage:    "Encrypt the ACME account key and certificate private key with the AWS KMS key",
+				Sources:  cli.EnvVars("ENCRYPT_AT_REST"),
+				Required: false,
+				Value:    false,
 			},
 			&cli.BoolFlag{
 				Name:     "debug-mode",
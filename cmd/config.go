@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/config"
+)
+
+// reloadable are the settings applied without restart when the
+// configuration file changes
+var reloadable = []string{
+	"log-level",
+	"tenant",
+	"require-node-approval",
+	"node-policy",
+	"ocsp-stapling",
+	"preferred-chain",
+	"tls-cert-file",
+	"tls-key-file",
+}
+
+// configKey is the context key of the loaded configuration
+type configKey struct{}
+
+// configState is the configuration file in effect
+// overridden holds the settings that are also set by flag or environment
+// variable, which take precedence over the file
+type configState struct {
+	file       *config.File
+	schema     config.Schema
+	overridden map[string]bool
+}
+
+// configChange prepares a reloadable setting, the returned function
+// applies it once all changed settings have been prepared successfully
+type configChange func(values []string) (func(), error)
+
+// configSchema derives the configuration file schema from the flags,
+// the keys of the file are the flag names
+func configSchema(cmd *cli.Command) config.Schema {
+
+	schema := config.Schema{}
+	for _, f := range cmd.Root().Flags {
+		name := f.Names()[0]
+		if name == "config" || name == "help" || name == "version" {
+			continue
+		}
+
+		var kind config.Kind
+		switch f.(type) {
+		case *cli.BoolFlag:
+			kind = config.Bool
+		case *cli.IntFlag:
+			kind = config.Int
+		case *cli.FloatFlag:
+			kind = config.Float
+		case *cli.DurationFlag:
+			kind = config.Duration
+		case *cli.StringSliceFlag:
+			kind = config.List
+		default:
+			kind = config.String
+		}
+		schema[name] = config.Setting{
+			Kind:       kind,
+			Reloadable: slices.Contains(reloadable, name),
+		}
+	}
+
+	return schema
+}
+
+// loadConfig reads the configuration file and sets all flags that are
+// not set on the command line or by environment variable
+func loadConfig(ctx context.Context, cmd *cli.Command) (context.Context, error) {
+
+	path := cmd.String("config")
+	if path == "" {
+		return ctx, nil
+	}
+
+	schema := configSchema(cmd)
+	file, err := config.Load(path, schema)
+	if err != nil {
+		return ctx, err
+	}
+
+	state := &configState{
+		file:       file,
+		schema:     schema,
+		overridden: map[string]bool{},
+	}
+	for name, values := range file.Values {
+		if cmd.IsSet(name) {
+			state.overridden[name] = true
+			continue
+		}
+		for _, value := range values {
+			if err := cmd.Set(name, value); err != nil {
+				return ctx, fmt.Errorf("%s: field %q: %w", path, name, err)
+			}
+		}
+	}
+
+	return context.WithValue(ctx, configKey{}, state), nil
+}
+
+// configFromContext returns the loaded configuration or nil if no
+// configuration file is used
+func configFromContext(ctx context.Context) *configState {
+
+	state, _ := ctx.Value(configKey{}).(*configState)
+	return state
+}
+
+// reload applies the changed reloadable settings of a new configuration
+// file. Either all of them are applied or, if one fails, none.
+func (c *configState) reload(file *config.File, changes map[string]configChange) error {
+
+	var apply []func()
+	for _, name := range file.Changed(c.file) {
+		switch {
+		case c.overridden[name]:
+			log.Warn().Msgf("setting %s is set by flag or environment variable, ignoring change", name)
+		case !c.schema[name].Reloadable:
+			log.Warn().Msgf("setting %s changed, restart required to apply it", name)
+		default:
+			fn, err := changes[name](file.Values[name])
+			if err != nil {
+				return fmt.Errorf("setting %s: %w", name, err)
+			}
+			apply = append(apply, fn)
+			log.Info().Msgf("reloading setting %s", name)
+		}
+	}
+
+	for _, fn := range apply {
+		fn()
+	}
+	c.file = file
+
+	return nil
+}
+
+// configPrintSchema prints the settings of the configuration file
+func configPrintSchema(ctx context.Context, cmd *cli.Command) error {
+
+	schema := configSchema(cmd)
+
+	names := make([]string, 0, len(schema))
+	for name := range schema {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	width := 0
+	for _, name := range names {
+		width = max(width, len(name))
+	}
+
+	for _, name := range names {
+		s := schema[name]
+		reload := "restart-only"
+		if s.Reloadable {
+			reload = "reloadable"
+		}
+		fmt.Printf("%-*s  %-8s  %s\n", width, name, s.Kind, reload)
+	}
+
+	return nil
+}
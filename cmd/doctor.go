@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/acme"
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// minRemaining is the remaining certificate lifetime below which the
+// doctor reports the stored certificate as near expiry
+const minRemaining = 7 * 24 * time.Hour
+
+// errSkip marks checks that do not apply to the configuration
+var errSkip = errors.New("skipped")
+
+// doctorCheck is a single preflight check, run returns a detail message
+type doctorCheck struct {
+	name string
+	run  func(ctx context.Context) (string, error)
+}
+
+// doctor runs the preflight checks and reports the result of each
+// it fails if any check fails
+func doctor(ctx context.Context, cmd *cli.Command) error {
+
+	var (
+		awscli *oraws.AWS
+		awserr error
+	)
+	withAWS := func(fn func(ctx context.Context, a *oraws.AWS) (string, error)) func(context.Context) (string, error) {
+		return func(ctx context.Context) (string, error) {
+			if awserr != nil {
+				return "", errors.New("requires working aws credentials")
+			}
+			return fn(ctx, awscli)
+		}
+	}
+
+	checks := []doctorCheck{
+		{"aws credentials", func(ctx context.Context) (string, error) {
+			if awscli, awserr = oraws.NewSession(); awserr != nil {
+				return "", awserr
+			}
+			var account string
+			account, awserr = awscli.AccountID(ctx)
+			return "account " + account, awserr
+		}},
+		{"kms key", withAWS(func(ctx context.Context, a *oraws.AWS) (string, error) {
+			return checkKey(ctx, cmd, a)
+		})},
+		{"kms round trip", withAWS(func(ctx context.Context, a *oraws.AWS) (string, error) {
+			return checkRoundTrip(ctx, cmd, a)
+		})},
+		{"route53 hosted zone", withAWS(func(ctx context.Context, a *oraws.AWS) (string, error) {
+			return checkHostedZone(ctx, cmd, a)
+		})},
+		{"acme directory", func(ctx context.Context) (string, error) {
+			return checkDirectory(ctx, cmd)
+		}},
+		{"workdir", func(ctx context.Context) (string, error) {
+			return checkWorkdir(cmd)
+		}},
+		{"stored certificates", func(ctx context.Context) (string, error) {
+			return checkCerts(ctx, cmd)
+		}},
+		{"listen port", func(ctx context.Context) (string, error) {
+			return checkPort(cmd)
+		}},
+	}
+
+	failed := 0
+	for _, c := range checks {
+		ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		detail, err := c.run(ctx)
+		cancel()
+
+		switch {
+		case errors.Is(err, errSkip):
+			fmt.Printf("[SKIP] %s: %s\n", c.name, detail)
+		case err != nil:
+			failed++
+			fmt.Printf("[FAIL] %s: %v\n", c.name, err)
+		default:
+			fmt.Printf("[PASS] %s: %s\n", c.name, detail)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+
+	return nil
+}
+
+// doctorKey is a KMS key of the proxy or of a tenant
+type doctorKey struct {
+	// name is the tenant, or default for the key of the proxy
+	name  string
+	keyID string
+}
+
+// doctorKeys returns the KMS key of the proxy and the keys of the
+// configured tenants, every key is listed once
+func doctorKeys(cmd *cli.Command) ([]doctorKey, error) {
+
+	keyID := cmd.String("aws-kms-key-id")
+	if keyID == "" {
+		return nil, errors.New("--aws-kms-key-id not set")
+	}
+
+	keys := []doctorKey{{name: "default", keyID: keyID}}
+	for _, value := range cmd.StringSlice("tenant") {
+		host, keyID, err := parseTenant(value)
+		if err != nil {
+			return nil, err
+		}
+		if !slices.ContainsFunc(keys, func(k doctorKey) bool { return k.keyID == keyID }) {
+			keys = append(keys, doctorKey{name: host, keyID: keyID})
+		}
+	}
+
+	return keys, nil
+}
+
+// checkKey checks that the KMS keys exist and are enabled
+func checkKey(ctx context.Context, cmd *cli.Command, a *oraws.AWS) (string, error) {
+
+	keys, err := doctorKeys(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var details []string
+	for _, key := range keys {
+		info, err := a.DescribeKey(ctx, key.keyID)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", key.name, err)
+		}
+		if !info.Enabled {
+			return "", fmt.Errorf("%s: key %s is %s", key.name, info.KeyID, info.State)
+		}
+		details = append(details, fmt.Sprintf("%s: %s is %s", key.name, info.ARN, info.State))
+	}
+
+	return strings.Join(details, ", "), nil
+}
+
+// checkRoundTrip encrypts and decrypts random data with every KMS key
+func checkRoundTrip(ctx context.Context, cmd *cli.Command, a *oraws.AWS) (string, error) {
+
+	keys, err := doctorKeys(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	for _, key := range keys {
+		k := *a
+		k.KeyID = key.keyID
+
+		sealed, err := k.Seal(ctx, data)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", key.name, err)
+		}
+		plain, err := k.Unseal(ctx, sealed)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", key.name, err)
+		}
+		if !bytes.Equal(plain, data) {
+			return "", fmt.Errorf("%s: decrypted data does not match", key.name)
+		}
+	}
+
+	names := make([]string, len(keys))
+	for i, key := range keys {
+		names[i] = key.name
+	}
+
+	return "encrypt and decrypt succeeded for " + strings.Join(names, ", "), nil
+}
+
+// checkHostedZone checks access to the Route53 hosted zone used for the
+// ACME DNS challenge
+func checkHostedZone(ctx context.Context, cmd *cli.Command, a *oraws.AWS) (string, error) {
+
+	if cmd.String("cert-source") != "acme" {
+		return "not using acme", errSkip
+	}
+
+	svc := route53.New(a.Session())
+	if zoneID := cmd.String("aws-hosted-zone-id"); zoneID != "" {
+		zone, err := svc.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(zoneID)})
+		if err != nil {
+			return "", err
+		}
+		return "zone " + aws.StringValue(zone.HostedZone.Name), nil
+	}
+
+	// without a zone ID the zone is looked up by the domain names
+	groups, err := certGroups(cmd)
+	if err != nil {
+		return "", err
+	}
+	var zones []*route53.HostedZone
+	if err := svc.ListHostedZonesPagesWithContext(ctx, &route53.ListHostedZonesInput{},
+		func(page *route53.ListHostedZonesOutput, last bool) bool {
+			zones = append(zones, page.HostedZones...)
+			return true
+		}); err != nil {
+		return "", err
+	}
+	var found []string
+	for _, g := range groups {
+		for _, domain := range g.domains {
+			zone := matchZone(zones, domain)
+			if zone == "" {
+				return "", fmt.Errorf("no hosted zone found for %s", domain)
+			}
+			found = append(found, domain+" in "+zone)
+		}
+	}
+
+	return strings.Join(found, ", "), nil
+}
+
+// matchZone returns the longest zone name the domain belongs to
+func matchZone(zones []*route53.HostedZone, domain string) string {
+
+	domain = strings.TrimPrefix(strings.ToLower(domain), "*.") + "."
+	best := ""
+	for _, z := range zones {
+		name := aws.StringValue(z.Name)
+		if (domain == name || strings.HasSuffix(domain, "."+name)) && len(name) > len(best) {
+			best = name
+		}
+	}
+
+	return best
+}
+
+// checkDirectory fetches the ACME directories of the certificate groups
+func checkDirectory(ctx context.Context, cmd *cli.Command) (string, error) {
+
+	if cmd.String("cert-source") != "acme" {
+		return "not using acme", errSkip
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if bundle := cmd.String("acme-ca-bundle"); bundle != "" {
+		data, err := os.ReadFile(bundle)
+		if err != nil {
+			return "", err
+		}
+		pool.AppendCertsFromPEM(data)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	client := &http.Client{Transport: transport}
+
+	groups, err := certGroups(cmd)
+	if err != nil {
+		return "", err
+	}
+	var urls []string
+	for _, g := range groups {
+		url := acme.DirectoryURL(g.String(cmd, "acme-directory-url"), cmd.Bool("debug-mode"))
+		if slices.Contains(urls, url) {
+			continue
+		}
+		if err := fetchDirectory(ctx, client, url); err != nil {
+			return "", err
+		}
+		urls = append(urls, url)
+	}
+
+	return strings.Join(urls, ", "), nil
+}
+
+// fetchDirectory checks that url serves an ACME directory
+func fetchDirectory(ctx context.Context, client *http.Client, url string) error {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	var dir struct {
+		NewNonce string `json:"newNonce"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&dir); err != nil || dir.NewNonce == "" {
+		return fmt.Errorf("%s is not an ACME directory", url)
+	}
+
+	return nil
+}
+
+// checkWorkdir checks that the workdir is writable and not accessible
+// by other users
+func checkWorkdir(cmd *cli.Command) (string, error) {
+
+	dir := cmd.String("workdir")
+	info, err := os.Stat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if perm := info.Mode().Perm(); perm&0007 != 0 {
+		return "", fmt.Errorf("%s is accessible by other users (%s), use 0750 or stricter", dir, perm)
+	}
+	if err := storage.NewLocal(dir).CheckPermissions(); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return "", fmt.Errorf("%s is not writable: %w", dir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s is writable (%s)", filepath.Clean(dir), info.Mode().Perm()), nil
+}
+
+// checkCerts checks that the stored certificates cover the configured
+// domains and are not near expiry
+func checkCerts(ctx context.Context, cmd *cli.Command) (string, error) {
+
+	if cmd.String("cert-source") == "static" {
+		return "static certificates are not stored", errSkip
+	}
+
+	store, err := newStorage(cmd)
+	if err != nil {
+		return "", err
+	}
+	groups, err := certGroups(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	var details []string
+	for _, g := range groups {
+		crt, err := g.storage(store).Get(ctx, storage.CertKey)
+		if errors.Is(err, os.ErrNotExist) {
+			details = append(details, "no certificate yet for "+strings.Join(g.domains, ", "))
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		leaf, err := certstore.ParseLeaf(crt)
+		if err != nil {
+			return "", err
+		}
+		for _, domain := range g.domains {
+			if err := leaf.VerifyHostname(domain); err != nil {
+				return "", fmt.Errorf("stored certificate does not cover %s", domain)
+			}
+		}
+		remaining := time.Until(leaf.NotAfter)
+		if remaining < minRemaining {
+			return "", fmt.Errorf("stored certificate for %s expires at %s",
+				strings.Join(g.domains, ", "), leaf.NotAfter.Local())
+		}
+		details = append(details, fmt.Sprintf("%s valid until %s",
+			strings.Join(g.domains, ", "), leaf.NotAfter.Local().Format(time.DateOnly)))
+	}
+
+	return strings.Join(details, "; "), nil
+}
+
+// checkPort checks that the listen port and the tenant listeners can be
+// bound
+func checkPort(cmd *cli.Command) (string, error) {
+
+	addrs := []string{cmd.String("listen-port")}
+	for _, value := range cmd.StringSlice("tenant-listen") {
+		addr, _, _ := strings.Cut(value, "=")
+		addrs = append(addrs, strings.TrimSpace(addr))
+	}
+
+	var listeners []net.Listener
+	defer func() {
+		for _, lis := range listeners {
+			lis.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		lis, err := net.Listen("tcp", addr)
+		if err != nil {
+			return "", err
+		}
+		listeners = append(listeners, lis)
+	}
+
+	if len(addrs) == 1 {
+		return addrs[0] + " is free", nil
+	}
+	return strings.Join(addrs, ", ") + " are free", nil
+}
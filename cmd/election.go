@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/election"
+	"github.openresearch.com/talos-kms-proxy/internal/kube"
+)
+
+// newElector creates the leader elector selected by the leader election
+// flags, it returns nil if leader election is disabled
+// every named certificate group is elected separately
+func newElector(cmd *cli.Command, group string) (election.Elector, error) {
+
+	identity := cmd.String("leader-election-identity")
+	if identity == "" {
+		identity = election.Identity()
+	}
+	name := cmd.String("leader-election-name")
+	lock := "leader.lock"
+	if group != "" {
+		name += "-" + group
+		lock = "leader-" + group + ".lock"
+	}
+
+	switch cmd.String("leader-election") {
+	case "none", "":
+		return nil, nil
+	case "file":
+		path := cmd.String("leader-election-lock-file")
+		if path == "" {
+			path = filepath.Join(cmd.String("workdir"), lock)
+		} else if group != "" {
+			path += "-" + group
+		}
+		return election.NewFile(path)
+	case "kubernetes":
+		client, err := kube.NewClient(kube.Config{
+			Namespace: cmd.String("storage-k8s-namespace"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return election.NewKubernetes(client, name, identity), nil
+	case "dynamodb":
+		return election.NewDynamoDB(
+			cmd.String("leader-election-dynamodb-table"),
+			cmd.String("storage-s3-region"),
+			name,
+			identity,
+		)
+	default:
+		return nil, fmt.Errorf("unknown leader election %q", cmd.String("leader-election"))
+	}
+}
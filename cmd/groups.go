@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// groupOptions are the flags that can be overridden per certificate group
+var groupOptions = []string{
+	"email",
+	"key-type",
+	"reuse-key",
+	"preferred-chain",
+	"acme-directory-url",
+	"acme-trust-roots",
+	"acme-eab-kid",
+	"acme-eab-hmac",
+}
+
+// certGroup is a group of domains served by its own certificate
+// options override the command flags of the same name for the group
+type certGroup struct {
+	name    string
+	domains []string
+	options map[string]string
+}
+
+// certGroups returns the certificate groups of the command
+// without --cert-group all domains form a single unnamed group
+func certGroups(cmd *cli.Command) ([]certGroup, error) {
+
+	values := cmd.StringSlice("cert-group")
+	if len(values) == 0 {
+		return []certGroup{{domains: cmd.StringSlice("domain")}}, nil
+	}
+
+	var groups []certGroup
+	for _, value := range values {
+		g, err := parseCertGroup(value)
+		if err != nil {
+			return nil, err
+		}
+		if slices.ContainsFunc(groups, func(o certGroup) bool { return o.name == g.name }) {
+			return nil, fmt.Errorf("duplicate certificate group %q", g.name)
+		}
+		groups = append(groups, g)
+	}
+
+	return groups, nil
+}
+
+// parseCertGroup parses a group definition of the form
+// name=domain[;domain...][;option=value...]
+func parseCertGroup(value string) (certGroup, error) {
+
+	name, spec, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" || strings.ContainsAny(name, "/ ") {
+		return certGroup{}, fmt.Errorf("invalid certificate group %q, expected name=domain[;domain...]", value)
+	}
+
+	g := certGroup{name: name, options: map[string]string{}}
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, val, isOption := strings.Cut(part, "=")
+		if !isOption {
+			g.domains = append(g.domains, part)
+			continue
+		}
+		if !slices.Contains(groupOptions, key) {
+			return certGroup{}, fmt.Errorf("certificate group %s: unknown option %q", name, key)
+		}
+		g.options[key] = val
+	}
+
+	if len(g.domains) == 0 {
+		return certGroup{}, fmt.Errorf("certificate group %s has no domains", name)
+	}
+
+	return g, nil
+}
+
+// storage returns the storage of the group, named groups are kept in
+// their own directory of the shared storage
+func (g certGroup) storage(store storage.Storage) storage.Storage {
+
+	if g.name == "" {
+		return store
+	}
+
+	return storage.WithPrefix(store, "groups/"+g.name)
+}
+
+// String returns the group option or the command flag value
+func (g certGroup) String(cmd *cli.Command, name string) string {
+
+	if v, ok := g.options[name]; ok {
+		return v
+	}
+
+	return cmd.String(name)
+}
+
+// Bool returns the group option or the command flag value
+func (g certGroup) Bool(cmd *cli.Command, name string) (bool, error) {
+
+	if v, ok := g.options[name]; ok {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return false, fmt.Errorf("certificate group %s: invalid %s: %w", g.name, name, err)
+		}
+		return b, nil
+	}
+
+	return cmd.Bool(name), nil
+}
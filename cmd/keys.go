@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v3"
+
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+)
+
+// keysCreate creates a KMS key with the key policy template, an alias
+// and automatic rotation
+func keysCreate(ctx context.Context, cmd *cli.Command) error {
+
+	tags := map[string]string{}
+	for _, tag := range cmd.StringSlice("tag") {
+		k, v, ok := strings.Cut(tag, "=")
+		if !ok || k == "" {
+			return fmt.Errorf("invalid tag %q, expected key=value", tag)
+		}
+		tags[k] = v
+	}
+	if cmd.Duration("rotation-period") < 90*24*time.Hour {
+		return errors.New("rotation period must be at least 90 days")
+	}
+
+	awscli, err := oraws.NewSession()
+	if err != nil {
+		return err
+	}
+
+	// render the key policy for the account of the credentials
+	var tmpl string
+	if path := cmd.String("policy-template"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		tmpl = string(data)
+	}
+	accountID, err := awscli.AccountID(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := oraws.KeyPolicy(tmpl, oraws.PolicyParams{
+		AccountID: accountID,
+		Admins:    cmd.StringSlice("admin-principal"),
+		Users:     cmd.StringSlice("proxy-principal"),
+	})
+	if err != nil {
+		return err
+	}
+
+	if cmd.Bool("dry-run") {
+		fmt.Println(policy)
+		return nil
+	}
+
+	keyID, err := awscli.CreateKey(ctx, oraws.KeyOptions{
+		Name:           cmd.String("name"),
+		Alias:          cmd.String("alias"),
+		Description:    cmd.String("description"),
+		Tags:           tags,
+		Policy:         policy,
+		RotationPeriod: cmd.Duration("rotation-period"),
+	})
+	if err != nil {
+		if keyID != "" {
+			return fmt.Errorf("key %s created, but: %w", keyID, err)
+		}
+		return err
+	}
+
+	return printKey(ctx, awscli, keyID)
+}
+
+// keysDescribe prints the state, rotation status and aliases of a key
+func keysDescribe(ctx context.Context, cmd *cli.Command) error {
+
+	keyID, err := keyIDFlag(cmd)
+	if err != nil {
+		return err
+	}
+
+	awscli, err := oraws.NewSession()
+	if err != nil {
+		return err
+	}
+
+	return printKey(ctx, awscli, keyID)
+}
+
+// keysEnableRotation enables automatic rotation of the key material
+func keysEnableRotation(ctx context.Context, cmd *cli.Command) error {
+
+	keyID, err := keyIDFlag(cmd)
+	if err != nil {
+		return err
+	}
+	if cmd.Duration("rotation-period") < 90*24*time.Hour {
+		return errors.New("rotation period must be at least 90 days")
+	}
+
+	awscli, err := oraws.NewSession()
+	if err != nil {
+		return err
+	}
+	if err := awscli.EnableKeyRotation(ctx, keyID, cmd.Duration("rotation-period")); err != nil {
+		return err
+	}
+
+	return printKey(ctx, awscli, keyID)
+}
+
+// keyIDFlag returns the --key-id flag or the key of the proxy
+func keyIDFlag(cmd *cli.Command) (string, error) {
+
+	if keyID := cmd.String("key-id"); keyID != "" {
+		return keyID, nil
+	}
+	if keyID := cmd.String("aws-kms-key-id"); keyID != "" {
+		return keyID, nil
+	}
+
+	return "", errors.New("required flag \"key-id\" not set")
+}
+
+// printKey prints the description of a key
+func printKey(ctx context.Context, awscli *oraws.AWS, keyID string) error {
+
+	info, err := awscli.DescribeKey(ctx, keyID)
+	if err != nil {
+		return err
+	}
+
+	rotation := "disabled"
+	if info.RotationEnabled {
+		rotation = fmt.Sprintf("enabled, every %d days, next %s",
+			int(info.RotationPeriod/(24*time.Hour)), info.NextRotation.Local().Format(time.DateOnly))
+	}
+	aliases := "-"
+	if len(info.Aliases) > 0 {
+		aliases = strings.Join(info.Aliases, ", ")
+	}
+
+	fmt.Printf("Key ID:       %s\n", info.KeyID)
+	fmt.Printf("ARN:          %s\n", info.ARN)
+	fmt.Printf("Description:  %s\n", info.Description)
+	fmt.Printf("State:        %s\n", info.State)
+	fmt.Printf("Spec:         %s (%s)\n", info.Spec, info.Usage)
+	fmt.Printf("Manager:      %s\n", info.Manager)
+	fmt.Printf("Created:      %s\n", info.Created.Local().Format(time.RFC3339))
+	fmt.Printf("Rotation:     %s\n", rotation)
+	fmt.Printf("Aliases:      %s\n", aliases)
+
+	return nil
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/rs/zerolog/log"
 	"github.com/urfave/cli/v3"
@@ -21,8 +22,9 @@ var (
 // main is the execution entry point of the service
 func main() {
 
-	// create context
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	// create context, cancelled on interrupt and on termination by the
+	// container runtime, SIGHUP is handled by the reload service
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
 	// run cli handler
@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"runtime"
@@ -12,7 +13,19 @@ import (
 	"github.com/urfave/cli/v3"
 
 	"github.openresearch.com/talos-kms-proxy/internal/acme"
+	"github.openresearch.com/talos-kms-proxy/internal/admin"
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/config"
 	"github.openresearch.com/talos-kms-proxy/internal/kms"
+	"github.openresearch.com/talos-kms-proxy/internal/nodes"
+	"github.openresearch.com/talos-kms-proxy/internal/ocsp"
+	"github.openresearch.com/talos-kms-proxy/internal/policy"
+	"github.openresearch.com/talos-kms-proxy/internal/reload"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/static"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
 )
 
 // run executes the main routine and listens for incoming requests
@@ -26,32 +39,234 @@ func run(ctx context.Context, cmd *cli.Command) error {
 		runtime.Version(),
 	)
 
-	// create a channel to pass certificates on
-	certsChannel := make(chan map[string][]byte)
-
 	// create new suture service supervisor
 	supervisor := suture.NewSimple(appname)
 
-	// create new acme service instance
-	a := acme.New(
-		cmd.StringSlice("domain"),
-		cmd.String("email"),
-		cmd.String("workdir"),
-		cmd.Bool("debug-mode"),
-		certsChannel,
+	// create state storage for the acme account and certificates
+	store, err := newStorage(cmd)
+	if err != nil {
+		return err
+	}
+	log.Info().Msgf("using storage %s", store)
+
+	// stop a second process from using the workdir
+	unlock, err := lockWorkdir(cmd)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// create new AWS KMS client, credentials are taken from environment
+	if cmd.String("aws-kms-key-id") == "" {
+		return errors.New("required flag \"aws-kms-key-id\" not set")
+	}
+	awscli, err := oraws.New(cmd.String("aws-kms-key-id"))
+	if err != nil {
+		return err
+	}
+
+	// map the tenant server names to their KMS keys
+	tenants, err := newTenants(cmd.StringSlice("tenant"), awscli)
+	if err != nil {
+		return err
+	}
+	listeners, err := tenantListeners(cmd.StringSlice("tenant-listen"), tenants)
+	if err != nil {
+		return err
+	}
+
+	// encrypt private keys at rest with the AWS KMS key
+	var sealer seal.Sealer
+	if cmd.Bool("encrypt-at-rest") {
+		sealer = awscli
+	}
+
+	groups, err := certGroups(cmd)
+	if err != nil {
+		return err
+	}
+
+	// create the services providing the server certificates, every
+	// certificate group has its own store and storage directory
+	var (
+		kmsGroups []kms.CertGroup
+		reloaders []reload.Reloader
+		renewers  = map[string]admin.Renewer{}
+		staplers  []*ocsp.Stapler
+		// chains are the acme services following --preferred-chain
+		chains []*acme.Acme
+		source *static.Static
 	)
-	supervisor.Add(a)
+	for _, g := range groups {
+		group := kms.CertGroup{
+			Name:    g.name,
+			Store:   certstore.New(),
+			Storage: g.storage(store),
+		}
+
+		service, err := newSource(cmd, g, group.Storage, sealer, group.Store)
+		if err != nil {
+			return err
+		}
+		supervisor.Add(service)
+		if r, ok := service.(reload.Reloader); ok {
+			reloaders = append(reloaders, r)
+		}
+		if r, ok := service.(admin.Renewer); ok {
+			renewers[g.name] = r
+		}
+		if r, ok := service.(kms.Rollbacker); ok {
+			group.Rollbacker = r
+		}
+		switch service := service.(type) {
+		case *acme.Acme:
+			if _, ok := g.options["preferred-chain"]; !ok {
+				chains = append(chains, service)
+			}
+		case *static.Static:
+			source = service
+		}
+
+		// the kms server must not pick up static certificates from storage
+		if cmd.String("cert-source") == "static" {
+			group.Storage = nil
+		}
+
+		// staple OCSP responses to the server certificate, the stapler
+		// also runs while disabled so that stapling can be enabled on reload
+		stapler := ocsp.New(group.Store, cmd.Bool("ocsp-stapling"))
+		supervisor.Add(stapler)
+		staplers = append(staplers, stapler)
+
+		kmsGroups = append(kmsGroups, group)
+	}
+
+	// keep track of the nodes and record their requests, every tenant
+	// has its own node registry and audit log
+	registry := nodes.New(store, cmd.Bool("require-node-approval"))
+	registry.SetTenants(tenantNames(tenants))
+	if err := registry.Load(ctx); err != nil {
+		return fmt.Errorf("could not load node registry: %w", err)
+	}
+	reloaders = append(reloaders, registry)
+	enforcer, err := newEnforcer(cmd.String("node-policy"))
+	if err != nil {
+		return err
+	}
+	reloaders = append(reloaders, enforcer)
+	events := audit.New(int(cmd.Int("audit-events")), store)
+	events.SetTenants(tenantNames(tenants))
+	if err := events.Load(ctx); err != nil {
+		return fmt.Errorf("could not load audit log: %w", err)
+	}
+	supervisor.Add(events)
 
 	// create new kms server instance
 	ks, err := kms.NewServer(
 		cmd.String("listen-port"),
-		cmd.String("workdir"),
-		certsChannel,
+		awscli,
+		tenants,
+		sealer,
+		kmsGroups,
+		registry,
+		enforcer,
+		events,
 	)
 	if err != nil {
 		return err
 	}
+	for _, l := range listeners {
+		ks.ListenTenant(l.address, l.tenant)
+	}
 	supervisor.Add(ks)
+	reloaders = append(reloaders, ks)
+
+	// serve the admin api on its own listener
+	if listen := cmd.String("admin-listen"); listen != "" {
+		supervisor.Add(admin.New(admin.Config{
+			Listen:       listen,
+			CertFile:     cmd.String("admin-cert"),
+			KeyFile:      cmd.String("admin-key"),
+			ClientCAFile: cmd.String("admin-client-ca"),
+			Version:      version,
+		}, ks, registry, events, renewers, setLogLevel))
+	}
+
+	// apply the reloadable settings when the configuration file changes
+	if state := configFromContext(ctx); state != nil {
+		changes := map[string]configChange{
+			"log-level": func(values []string) (func(), error) {
+				level := "info"
+				if len(values) > 0 {
+					level = values[0]
+				}
+				return func() { setLogLevel(level) }, nil
+			},
+			"require-node-approval": func(values []string) (func(), error) {
+				required := len(values) > 0 && values[0] == "true"
+				return func() { registry.SetRequireApproval(required) }, nil
+			},
+			"node-policy": func(values []string) (func(), error) {
+				var p *policy.Policy
+				if len(values) > 0 && values[0] != "" {
+					var err error
+					if p, err = policy.Load(values[0]); err != nil {
+						return nil, err
+					}
+				}
+				return func() { enforcer.Set(p) }, nil
+			},
+			"tenant": func(values []string) (func(), error) {
+				tenants, err := newTenants(values, awscli)
+				if err != nil {
+					return nil, err
+				}
+				for _, l := range listeners {
+					if _, ok := tenants[l.tenant]; !ok {
+						return nil, fmt.Errorf("tenant %s is still served on %s, remove --tenant-listen first", l.tenant, l.address)
+					}
+				}
+				return func() {
+					ks.SetTenants(tenants)
+					registry.SetTenants(tenantNames(tenants))
+					events.SetTenants(tenantNames(tenants))
+				}, nil
+			},
+			"ocsp-stapling": func(values []string) (func(), error) {
+				enabled := len(values) == 0 || values[0] == "true"
+				return func() {
+					for _, s := range staplers {
+						s.SetEnabled(enabled)
+					}
+				}, nil
+			},
+			"preferred-chain": func(values []string) (func(), error) {
+				chain := ""
+				if len(values) > 0 {
+					chain = values[0]
+				}
+				return func() {
+					for _, a := range chains {
+						a.SetPreferredChain(chain)
+					}
+				}, nil
+			},
+			"tls-cert-file": func(values []string) (func(), error) {
+				return staticFile(source, values, func(path string) { source.SetFiles(path, "") })
+			},
+			"tls-key-file": func(values []string) (func(), error) {
+				return staticFile(source, values, func(path string) { source.SetFiles("", path) })
+			},
+		}
+		watcher := config.NewWatcher(state.file.Path, state.schema, func(f *config.File) error {
+			return state.reload(f, changes)
+		})
+		supervisor.Add(watcher)
+		reloaders = append(reloaders, watcher)
+	}
+
+	// reload certificates, keys and configuration on SIGHUP
+	supervisor.Add(reload.New(reloaders...))
 
 	// start services
 	if err := supervisor.Serve(ctx); err != nil {
@@ -61,10 +276,89 @@ func run(ctx context.Context, cmd *cli.Command) error {
 	return nil
 }
 
+// newEnforcer loads the node policy file, without a file all nodes are
+// left to the node registry
+func newEnforcer(path string) (*policy.Enforcer, error) {
+
+	if path == "" {
+		return policy.NewEnforcer(nil), nil
+	}
+	p, err := policy.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load node policy: %w", err)
+	}
+	log.Info().Msgf("loaded node policy %s with rules for %d tenants", path, p.Tenants())
+
+	return policy.NewEnforcer(p), nil
+}
+
+// staticFile prepares the change of a path of the static certificate
+// source, the change is ignored with the other sources
+func staticFile(source *static.Static, values []string, set func(path string)) (func(), error) {
+
+	if source == nil {
+		return func() {}, nil
+	}
+	if len(values) == 0 || values[0] == "" {
+		return nil, errors.New("static certificates require --tls-cert-file and --tls-key-file")
+	}
+
+	return func() { set(values[0]) }, nil
+}
+
+// newSource creates the service providing the server certificates of a
+// certificate group
+func newSource(cmd *cli.Command, g certGroup, store storage.Storage, sealer seal.Sealer, certStore *certstore.Store) (suture.Service, error) {
+
+	switch source := cmd.String("cert-source"); source {
+	case "acme":
+		return newAcme(cmd, g, store, sealer, certStore)
+	case "ca":
+		if g.name != "" {
+			return nil, errors.New("certificate groups are not supported with the ca source, all names share the private ca")
+		}
+		return newCA(cmd, store, sealer, certStore)
+	case "vault", "step-ca":
+		return newIssuer(cmd, g, store, sealer, certStore)
+	case "static":
+		if g.name != "" {
+			return nil, errors.New("certificate groups are not supported with the static source")
+		}
+		if cmd.String("tls-cert-file") == "" || cmd.String("tls-key-file") == "" {
+			return nil, errors.New("static certificates require --tls-cert-file and --tls-key-file")
+		}
+		return static.New(
+			cmd.String("tls-cert-file"),
+			cmd.String("tls-key-file"),
+			certStore,
+		), nil
+	default:
+		return nil, fmt.Errorf("unknown certificate source %q", source)
+	}
+}
+
 func prepare(ctx context.Context, cmd *cli.Command) (context.Context, error) {
 
+	// read the configuration file before the flags are used
+	ctx, err := loadConfig(ctx, cmd)
+	if err != nil {
+		return ctx, err
+	}
+
 	// configure logging
-	logLevel := cmd.String("log-level")
+	setLogLevel(cmd.String("log-level"))
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+
+	// create working directory
+	if err := os.MkdirAll(cmd.String("workdir"), 0750); err != nil {
+		log.Error().Err(err).Msg("")
+	}
+
+	return ctx, nil
+}
+
+// setLogLevel sets the global log level, unknown levels select info
+func setLogLevel(logLevel string) {
 
 	switch logLevel {
 	case "TRACE", "trace":
@@ -78,12 +372,4 @@ func prepare(ctx context.Context, cmd *cli.Command) (context.Context, error) {
 	default:
 		zerolog.SetGlobalLevel(zerolog.InfoLevel)
 	}
-	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
-
-	// create working directory
-	if err := os.MkdirAll(cmd.String("workdir"), 0750); err != nil {
-		log.Error().Err(err).Msg("")
-	}
-
-	return ctx, nil
 }
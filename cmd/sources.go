@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/acme"
+	"github.openresearch.com/talos-kms-proxy/internal/ca"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/issuer"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// newAcme creates the acme service of a certificate group from the
+// command flags and the group options
+func newAcme(cmd *cli.Command, g certGroup, store storage.Storage, sealer seal.Sealer, certStore *certstore.Store) (*acme.Acme, error) {
+
+	if len(g.domains) == 0 {
+		return nil, errors.New("acme certificates require at least one --domain")
+	}
+
+	keyType, err := acme.ParseKeyType(g.String(cmd, "key-type"))
+	if err != nil {
+		return nil, err
+	}
+	reuseKey, err := g.Bool(cmd, "reuse-key")
+	if err != nil {
+		return nil, err
+	}
+
+	// create leader elector for replicas sharing the storage
+	elector, err := newElector(cmd, g.name)
+	if err != nil {
+		return nil, err
+	}
+
+	return acme.New(
+		acme.Config{
+			Domains:        g.domains,
+			Email:          g.String(cmd, "email"),
+			Storage:        store,
+			Dev:            cmd.Bool("debug-mode"),
+			DirectoryURL:   g.String(cmd, "acme-directory-url"),
+			EABKeyID:       g.String(cmd, "acme-eab-kid"),
+			EABHMAC:        g.String(cmd, "acme-eab-hmac"),
+			CABundle:       cmd.String("acme-ca-bundle"),
+			TrustRoots:     g.String(cmd, "acme-trust-roots"),
+			RenewFraction:  cmd.Float("renew-fraction"),
+			KeyType:        keyType,
+			ReuseKey:       reuseKey,
+			PreferredChain: g.String(cmd, "preferred-chain"),
+			Sealer:         sealer,
+			Elector:        elector,
+		},
+		certStore,
+	), nil
+}
+
+// newCA creates the private CA service from the command flags
+func newCA(cmd *cli.Command, store storage.Storage, sealer seal.Sealer, certStore *certstore.Store) (*ca.CA, error) {
+
+	if len(cmd.StringSlice("domain")) == 0 {
+		return nil, errors.New("private ca certificates require at least one --domain")
+	}
+
+	return ca.New(
+		ca.Config{
+			Names:        cmd.StringSlice("domain"),
+			Storage:      store,
+			Sealer:       sealer,
+			CertLifetime: cmd.Duration("ca-cert-lifetime"),
+		},
+		certStore,
+	), nil
+}
+
+// newIssuer creates the issuer service for the vault and step-ca
+// certificate sources of a certificate group from the command flags
+func newIssuer(cmd *cli.Command, g certGroup, store storage.Storage, sealer seal.Sealer, certStore *certstore.Store) (*issuer.Service, error) {
+
+	if len(g.domains) == 0 {
+		return nil, errors.New("issued certificates require at least one --domain")
+	}
+
+	// issued certificates are verified against the roots of the CA
+	rootsFlag := map[string]string{"vault": "vault-cacert", "step-ca": "step-ca-root"}[cmd.String("cert-source")]
+	if cmd.String(rootsFlag) == "" {
+		return nil, fmt.Errorf("the %s source requires --%s to verify the issued certificates", cmd.String("cert-source"), rootsFlag)
+	}
+	roots, err := issuer.LoadRoots(cmd.String(rootsFlag))
+	if err != nil {
+		return nil, err
+	}
+
+	var iss issuer.Issuer
+	switch cmd.String("cert-source") {
+	case "vault":
+		iss, err = issuer.NewVault(issuer.VaultConfig{
+			Address:   cmd.String("vault-addr"),
+			Token:     cmd.String("vault-token"),
+			Namespace: cmd.String("vault-namespace"),
+			Mount:     cmd.String("vault-pki-mount"),
+			Role:      cmd.String("vault-pki-role"),
+			TTL:       cmd.Duration("issuer-cert-ttl"),
+			CACert:    cmd.String("vault-cacert"),
+		})
+	case "step-ca":
+		iss, err = issuer.NewStepCA(issuer.StepCAConfig{
+			URL:          cmd.String("step-ca-url"),
+			Root:         cmd.String("step-ca-root"),
+			Provisioner:  cmd.String("step-provisioner"),
+			KeyFile:      cmd.String("step-provisioner-key"),
+			PasswordFile: cmd.String("step-provisioner-password-file"),
+			TTL:          cmd.Duration("issuer-cert-ttl"),
+		})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return issuer.New(
+		issuer.Config{
+			Names:   g.domains,
+			Storage: store,
+			Sealer:  sealer,
+			Issuer:  iss,
+			Roots:   roots,
+		},
+		certStore,
+	), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/rs/zerolog/log"
+	"github.com/urfave/cli/v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/kube"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// newStorage creates the state storage selected by the storage flags
+func newStorage(cmd *cli.Command) (storage.Storage, error) {
+
+	switch cmd.String("storage") {
+	case "local", "":
+		return storage.NewLocal(cmd.String("workdir")), nil
+	case "s3":
+		return storage.NewS3(storage.S3Config{
+			Bucket:   cmd.String("storage-s3-bucket"),
+			Prefix:   cmd.String("storage-s3-prefix"),
+			Region:   cmd.String("storage-s3-region"),
+			Endpoint: cmd.String("storage-s3-endpoint"),
+		})
+	case "kubernetes":
+		client, err := kube.NewClient(kube.Config{
+			Namespace: cmd.String("storage-k8s-namespace"),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return storage.NewKubernetes(client, cmd.String("storage-k8s-secret"))
+	default:
+		return nil, fmt.Errorf("unknown storage %q", cmd.String("storage"))
+	}
+}
+
+// lockWorkdir takes the instance lock of the local workdir and refuses
+// private keys readable by other users. Replicas using the file leader
+// election share the workdir on purpose and are not locked.
+func lockWorkdir(cmd *cli.Command) (func(), error) {
+
+	if s := cmd.String("storage"); s != "local" && s != "" {
+		return func() {}, nil
+	}
+	dir := storage.NewLocal(cmd.String("workdir"))
+
+	if err := dir.CheckPermissions(); err != nil {
+		return nil, err
+	}
+	if cmd.String("leader-election") == "file" {
+		return func() {}, nil
+	}
+
+	lock, err := dir.Lock()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := lock.Close(); err != nil {
+			log.Warn().Err(err).Msg("could not release the workdir lock")
+		}
+	}, nil
+}
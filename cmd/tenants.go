@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+)
+
+// newTenants creates a KMS client for every tenant of the --tenant
+// values, clients of tenants sharing a key are reused
+func newTenants(values []string, awscli *oraws.AWS) (map[string]*oraws.AWS, error) {
+
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	tenants := make(map[string]*oraws.AWS)
+	clients := make(map[string]*oraws.AWS)
+	for _, value := range values {
+		host, keyID, err := parseTenant(value)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := tenants[host]; ok {
+			return nil, fmt.Errorf("duplicate tenant %q", host)
+		}
+
+		client, ok := clients[keyID]
+		if !ok {
+			if client, err = awscli.WithKey(keyID); err != nil {
+				return nil, fmt.Errorf("tenant %s: %w", host, err)
+			}
+			clients[keyID] = client
+		}
+		tenants[host] = client
+
+		log.Info().Msgf("serving tenant %s with key %s", host, keyID)
+	}
+
+	return tenants, nil
+}
+
+// tenantNames returns the sorted server names of the tenants
+func tenantNames(tenants map[string]*oraws.AWS) []string {
+
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// tenantListener is an additional listener of a tenant
+type tenantListener struct {
+	address string
+	tenant  string
+}
+
+// tenantListeners parses the --tenant-listen values of the form
+// address=hostname, every hostname must be a configured tenant
+func tenantListeners(values []string, tenants map[string]*oraws.AWS) ([]tenantListener, error) {
+
+	listeners := make([]tenantListener, 0, len(values))
+	seen := map[string]bool{}
+	for _, value := range values {
+		address, host, ok := strings.Cut(value, "=")
+		address = strings.TrimSpace(address)
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || address == "" || host == "" {
+			return nil, fmt.Errorf("invalid tenant listener %q, expected address=hostname", value)
+		}
+		if _, ok := tenants[host]; !ok {
+			return nil, fmt.Errorf("tenant listener %s: unknown tenant %q, add it with --tenant", address, host)
+		}
+		if seen[address] {
+			return nil, fmt.Errorf("duplicate tenant listener %q", address)
+		}
+		seen[address] = true
+		listeners = append(listeners, tenantListener{address: address, tenant: host})
+	}
+
+	return listeners, nil
+}
+
+// parseTenant parses a tenant definition of the form hostname=key-id
+func parseTenant(value string) (host, keyID string, err error) {
+
+	host, keyID, ok := strings.Cut(value, "=")
+	host = strings.ToLower(strings.TrimSpace(host))
+	keyID = strings.TrimSpace(keyID)
+	if !ok || host == "" || keyID == "" {
+		return "", "", fmt.Errorf("invalid tenant %q, expected hostname=key-id", value)
+	}
+
+	return host, keyID, nil
+}
@@ -0,0 +1,365 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	legoacme "github.com/go-acme/lego/v4/acme"
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/lego"
+	"github.com/go-acme/lego/v4/registration"
+	"github.com/go-jose/go-jose/v4"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// Account describes the ACME account
+type Account struct {
+	Email     string
+	URI       string
+	Status    string
+	Contact   []string
+	Directory string
+	KeyType   string
+	// QueryError is set if the account could not be queried from the CA
+	QueryError error
+}
+
+// Account reads the stored account and queries its state from the CA.
+// The stored account is described even if the CA is unreachable.
+func (a *Acme) Account(ctx context.Context) (*Account, error) {
+
+	if err := a.restoreUser(ctx); err != nil {
+		return nil, err
+	}
+
+	acc := &Account{
+		Email:     a.user.Email,
+		Directory: a.directory(),
+	}
+	if a.user.Registration != nil {
+		acc.URI = a.user.Registration.URI
+	}
+	if keyType, err := publicKeyType(a.user.key.(crypto.Signer).Public()); err == nil {
+		acc.KeyType = string(keyType)
+	}
+
+	client, err := a.createLegoClient()
+	if err != nil {
+		acc.QueryError = err
+		return acc, nil
+	}
+	reg, err := client.Registration.QueryRegistration()
+	if err != nil {
+		acc.QueryError = err
+		return acc, nil
+	}
+	acc.Status = reg.Body.Status
+	acc.Contact = reg.Body.Contact
+
+	return acc, nil
+}
+
+// UpdateEmail changes the contact of the account to the configured email
+func (a *Acme) UpdateEmail(ctx context.Context) error {
+
+	if a.email == "" {
+		return errors.New("required flag \"email\" not set")
+	}
+	if err := a.restoreUser(ctx); err != nil {
+		return err
+	}
+	if a.user.Email == a.email {
+		return fmt.Errorf("the account email is already %s", a.email)
+	}
+
+	previous := a.user.Email
+	a.user.Email = a.email
+
+	client, err := a.createLegoClient()
+	if err != nil {
+		return err
+	}
+	reg, err := client.Registration.UpdateRegistration(registration.RegisterOptions{TermsOfServiceAgreed: true})
+	if err != nil {
+		return fmt.Errorf("could not update acme account: %w", err)
+	}
+	a.user.Registration = reg
+
+	if err := a.writeState(ctx); err != nil {
+		return err
+	}
+
+	logger.Info().Msgf("changed acme account email from %s to %s", previous, a.email)
+
+	return nil
+}
+
+// Deactivate deactivates the account at the CA and removes it from
+// storage, the next start registers a new account
+func (a *Acme) Deactivate(ctx context.Context) error {
+
+	if err := a.restoreUser(ctx); err != nil {
+		return err
+	}
+
+	client, err := a.createLegoClient()
+	if err != nil {
+		return err
+	}
+	if err := client.Registration.DeleteRegistration(); err != nil {
+		return fmt.Errorf("could not deactivate acme account: %w", err)
+	}
+
+	if err := a.storage.Delete(ctx, storage.StateKey); err != nil {
+		return err
+	}
+
+	logger.Info().Msgf("deactivated acme account %s", a.user.Registration.URI)
+
+	return nil
+}
+
+// RolloverKey replaces the account key with a new key (RFC 8555
+// section 7.3.5). lego does not implement the key change, so the
+// request is signed and sent here.
+func (a *Acme) RolloverKey(ctx context.Context) error {
+
+	if err := a.restoreUser(ctx); err != nil {
+		return err
+	}
+	if a.user.Registration == nil {
+		return errors.New("acme account is not registered")
+	}
+	accountURL := a.user.Registration.URI
+
+	config, err := a.legoConfig()
+	if err != nil {
+		return err
+	}
+	core, err := api.New(config.HTTPClient, config.UserAgent, config.CADirURL, accountURL, a.user.key)
+	if err != nil {
+		return err
+	}
+	dir := core.GetDirectory()
+	if dir.KeyChangeURL == "" {
+		return errors.New("the acme server does not support key changes")
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	pkb, err := x509.MarshalECPrivateKey(newKey)
+	if err != nil {
+		return err
+	}
+
+	// the inner object is signed by the new key and names the old key
+	oldKey := jose.JSONWebKey{Key: a.user.key.(crypto.Signer).Public()}
+	payload, err := json.Marshal(struct {
+		Account string          `json:"account"`
+		OldKey  jose.JSONWebKey `json:"oldKey"`
+	}{accountURL, oldKey})
+	if err != nil {
+		return err
+	}
+	inner, err := signJWS(jose.JSONWebKey{Key: newKey}, payload,
+		(&jose.SignerOptions{EmbedJWK: true}).WithHeader("url", dir.KeyChangeURL))
+	if err != nil {
+		return err
+	}
+
+	// a nonce rejected by the server is retried once with a fresh one
+	err = postKeyChange(ctx, config, dir.KeyChangeURL, dir.NewNonceURL, a.user.key, accountURL, inner)
+	if errors.Is(err, errBadNonce) {
+		logger.Debug().Err(err).Msg("retrying the key change with a fresh nonce")
+		err = postKeyChange(ctx, config, dir.KeyChangeURL, dir.NewNonceURL, a.user.key, accountURL, inner)
+	}
+	if err != nil {
+		return err
+	}
+
+	a.user.key = newKey
+	a.user.PKB = pkb
+	if err := a.writeState(ctx); err != nil {
+		return fmt.Errorf("the key was changed but could not be saved: %w", err)
+	}
+
+	logger.Info().Msgf("rolled over the key of acme account %s", accountURL)
+
+	return nil
+}
+
+// errBadNonce is returned by postKeyChange if the server rejected the nonce
+var errBadNonce = errors.New("acme server rejected the nonce")
+
+// postKeyChange sends the inner key change object signed by the old key
+// with a fresh nonce
+func postKeyChange(ctx context.Context, config *lego.Config, keyChangeURL, nonceURL string,
+	oldKey crypto.PrivateKey, accountURL, inner string) error {
+
+	nonce, err := newNonce(ctx, config.HTTPClient, nonceURL)
+	if err != nil {
+		return err
+	}
+	outer, err := signJWS(jose.JSONWebKey{Key: oldKey, KeyID: accountURL}, []byte(inner),
+		(&jose.SignerOptions{}).WithHeader("url", keyChangeURL).WithHeader("nonce", nonce))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, keyChangeURL, strings.NewReader(outer))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/jose+json")
+	req.Header.Set("User-Agent", config.UserAgent)
+	resp, err := config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var problem legoacme.ProblemDetails
+		if json.Unmarshal(body, &problem) == nil && problem.Type == legoacme.BadNonceErr {
+			return fmt.Errorf("acme key change failed: %w", errBadNonce)
+		}
+		return fmt.Errorf("acme key change failed: %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// signJWS signs the payload and returns the flattened JSON serialization
+func signJWS(key jose.JSONWebKey, payload []byte, opts *jose.SignerOptions) (string, error) {
+
+	alg := jose.ES256
+	if priv, ok := key.Key.(*ecdsa.PrivateKey); ok {
+		switch priv.Curve {
+		case elliptic.P384():
+			alg = jose.ES384
+		case elliptic.P521():
+			alg = jose.ES512
+		}
+	}
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, opts)
+	if err != nil {
+		return "", err
+	}
+	sig, err := signer.Sign(payload)
+	if err != nil {
+		return "", err
+	}
+
+	return sig.FullSerialize(), nil
+}
+
+// newNonce fetches a fresh replay nonce from the acme server
+func newNonce(ctx context.Context, client *http.Client, url string) (string, error) {
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", errors.New("acme server returned no nonce")
+	}
+
+	return nonce, nil
+}
+
+// legoAccount is the account.json written by the lego cli
+type legoAccount struct {
+	Email        string                 `json:"email"`
+	Registration *registration.Resource `json:"registration"`
+}
+
+// Import reads an account created by the lego cli from its account
+// directory (.lego/accounts/<server>/<email>), verifies it with the CA
+// and stores it. An existing account is only replaced with force.
+func (a *Acme) Import(ctx context.Context, dir string, force bool) error {
+
+	if _, err := a.storage.Get(ctx, storage.StateKey); err == nil && !force {
+		return fmt.Errorf("an acme account is already stored in %s", a.storage)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "account.json"))
+	if err != nil {
+		return err
+	}
+	var acc legoAccount
+	if err := json.Unmarshal(data, &acc); err != nil {
+		return fmt.Errorf("could not parse lego account: %w", err)
+	}
+	if acc.Registration == nil || acc.Registration.URI == "" {
+		return errors.New("lego account is not registered")
+	}
+
+	data, err = os.ReadFile(filepath.Join(dir, "keys", acc.Email+".key"))
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return errors.New("could not decode lego account key")
+	}
+	key, err := x509.ParseECPrivateKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("only EC account keys are supported: %w", err)
+	}
+
+	a.user = &AcmeUser{
+		Email:        acc.Email,
+		Registration: acc.Registration,
+		key:          key,
+		PKB:          block.Bytes,
+	}
+
+	// make sure the account exists at the configured CA
+	client, err := a.createLegoClient()
+	if err != nil {
+		return err
+	}
+	reg, err := client.Registration.ResolveAccountByKey()
+	if err != nil {
+		return fmt.Errorf("could not find the account at %s: %w", a.directory(), err)
+	}
+	if reg.URI != acc.Registration.URI {
+		return fmt.Errorf("account key belongs to %s, not %s", reg.URI, acc.Registration.URI)
+	}
+
+	if err := a.writeState(ctx); err != nil {
+		return err
+	}
+
+	logger.Info().Msgf("imported acme account %s", reg.URI)
+
+	return nil
+}
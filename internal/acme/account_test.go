@@ -0,0 +1,144 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/go-acme/lego/v4/registration"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// newTestAccount stores an account registered at directoryURL
+func newTestAccount(t *testing.T, directoryURL string) *Acme {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Acme{
+		email:        "ops@example.com",
+		storage:      storage.NewLocal(t.TempDir()),
+		directoryURL: directoryURL,
+		user: &AcmeUser{
+			Email:        "ops@example.com",
+			Registration: &registration.Resource{URI: directoryURL + "/acct/1"},
+			key:          key,
+			PKB:          pkb,
+		},
+	}
+	if err := a.writeState(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestUpdateEmail(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		email   string
+		wantErr string
+	}{
+		{name: "empty", email: "", wantErr: "email"},
+		{name: "unchanged", email: "ops@example.com", wantErr: "already ops@example.com"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a := newTestAccount(t, "http://127.0.0.1:1/directory")
+			a.email = tt.email
+			if err := a.UpdateEmail(context.Background()); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRolloverKey(t *testing.T) {
+
+	tests := []struct {
+		name string
+		// badNonces is the number of key changes rejected with badNonce
+		badNonces int
+		// status is returned for the key change if set
+		status    int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "accepted", wantCalls: 1},
+		{name: "bad nonce retried", badNonces: 1, wantCalls: 2},
+		{name: "bad nonce twice", badNonces: 2, wantErr: true, wantCalls: 2},
+		{name: "other error not retried", status: http.StatusConflict, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			var calls atomic.Int32
+			mux := http.NewServeMux()
+			server := httptest.NewServer(mux)
+			defer server.Close()
+
+			mux.HandleFunc("/directory", func(w http.ResponseWriter, r *http.Request) {
+				json.NewEncoder(w).Encode(map[string]string{
+					"newNonce":   server.URL + "/nonce",
+					"newAccount": server.URL + "/account",
+					"newOrder":   server.URL + "/order",
+					"keyChange":  server.URL + "/key-change",
+				})
+			})
+			mux.HandleFunc("/nonce", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Replay-Nonce", "nonce")
+			})
+			mux.HandleFunc("/key-change", func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				w.Header().Set("Content-Type", "application/problem+json")
+				switch {
+				case int(n) <= tt.badNonces:
+					w.WriteHeader(http.StatusBadRequest)
+					w.Write([]byte(`{"type":"urn:ietf:params:acme:error:badNonce","detail":"stale nonce"}`))
+				case tt.status != 0:
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`{"type":"urn:ietf:params:acme:error:malformed","detail":"key in use"}`))
+				}
+			})
+
+			a := newTestAccount(t, server.URL+"/directory")
+			oldPKB := a.user.PKB
+
+			err := a.RolloverKey(context.Background())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %t", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Fatalf("got %d key change requests, want %d", got, tt.wantCalls)
+			}
+
+			// the stored key only changes if the CA accepted the new key
+			stored := &Acme{storage: a.storage, user: &AcmeUser{}}
+			if err := stored.restoreUser(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if changed := string(stored.user.PKB) != string(oldPKB); changed == tt.wantErr {
+				t.Fatalf("stored key changed: %t, want %t", changed, !tt.wantErr)
+			}
+		})
+	}
+}
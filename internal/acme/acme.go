@@ -6,13 +6,15 @@ import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
-	"crypto/tls"
 	"crypto/x509"
 	"errors"
+	"fmt"
+	"net/http"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/go-acme/lego/v4/acme/api"
 	"github.com/go-acme/lego/v4/certcrypto"
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/go-acme/lego/v4/challenge/dns01"
@@ -21,18 +23,84 @@ import (
 	"github.com/go-acme/lego/v4/registration"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/election"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
 )
 
+// Config holds the settings of the ACME client
+type Config struct {
+	Domains []string
+	Email   string
+	Storage storage.Storage
+	Dev     bool
+
+	// DirectoryURL overrides the Let's Encrypt directory, e.g. for ZeroSSL,
+	// Google Trust Services, step-ca or a local Pebble instance
+	DirectoryURL string
+	// EABKeyID and EABHMAC are the External Account Binding credentials
+	// required by some CAs to register a new account
+	EABKeyID string
+	EABHMAC  string
+	// CABundle is a PEM file with additional roots to trust for the
+	// connection to the ACME server
+	CABundle string
+	// TrustRoots is a PEM file with the roots the issued certificates
+	// must chain to. Without it the chain is verified against the system
+	// roots for the Let's Encrypt production directory only.
+	TrustRoots string
+
+	// RenewFraction is the share of the certificate lifetime after which
+	// the certificate is renewed if the CA does not support ARI
+	RenewFraction float64
+
+	// KeyType is the type of the certificate private key (default EC256)
+	KeyType certcrypto.KeyType
+	// ReuseKey keeps the existing private key across renewals so that its
+	// SPKI hash can be pinned by clients
+	ReuseKey bool
+	// PreferredChain selects an alternate chain by the common name of its
+	// root or intermediate, empty uses the default chain of the CA
+	PreferredChain string
+
+	// Sealer encrypts the account key and the certificate private key
+	// at rest, nil stores them in plaintext
+	Sealer seal.Sealer
+
+	// Elector restricts certificate issuance to the elected leader when
+	// several replicas share the storage, nil always issues certificates
+	Elector election.Elector
+}
+
 type Acme struct {
-	domains      []string
-	email        string
-	dev          bool
-	workdir      string
-	certsChannel chan map[string][]byte
-	client       *lego.Client
-	certs        map[string][]byte
-	user         *AcmeUser
-	timer        *time.Timer
+	domains       []string
+	email         string
+	dev           bool
+	storage       storage.Storage
+	directoryURL  string
+	eabKeyID      string
+	eabHMAC       string
+	caBundle      string
+	trustRoots    string
+	renewFraction float64
+	keyType       certcrypto.KeyType
+	reuseKey      bool
+	preferred     atomic.Pointer[string]
+	sealer        seal.Sealer
+	elector       election.Elector
+	electionMu    sync.Mutex
+	certStore     *certstore.Store
+	client        *lego.Client
+	certs         map[string][]byte
+	user          *AcmeUser
+	timer         *time.Timer
+	renewAt       time.Time
+	failures      int
+	trigger       chan struct{}
+	rollbacks     chan chan rollbackResult
+	leading       atomic.Bool
 }
 
 type AcmeUser struct {
@@ -42,6 +110,9 @@ type AcmeUser struct {
 	PKB          []byte
 }
 
+// errNotLeader is returned by requests that only the leader handles
+var errNotLeader = errors.New("this replica is not the leader, send the request to the leader")
+
 var (
 	logger = log.With().Str("service", "acme").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
 )
@@ -60,66 +131,153 @@ func (a *Acme) Stop() {
 	// not used
 }
 
-func New(domains []string, email, dir string, dev bool, certsChannel chan map[string][]byte) *Acme {
+func New(cfg Config, certStore *certstore.Store) *Acme {
+
+	if cfg.KeyType == "" {
+		cfg.KeyType = certcrypto.EC256
+	}
 
-	return &Acme{
-		domains:      domains,
-		email:        email,
-		dev:          dev,
-		workdir:      dir,
-		certsChannel: certsChannel,
-		user:         &AcmeUser{},
+	a := &Acme{
+		domains:       cfg.Domains,
+		email:         cfg.Email,
+		dev:           cfg.Dev,
+		storage:       cfg.Storage,
+		directoryURL:  cfg.DirectoryURL,
+		eabKeyID:      cfg.EABKeyID,
+		eabHMAC:       cfg.EABHMAC,
+		caBundle:      cfg.CABundle,
+		trustRoots:    cfg.TrustRoots,
+		renewFraction: cfg.RenewFraction,
+		keyType:       cfg.KeyType,
+		reuseKey:      cfg.ReuseKey,
+		sealer:        cfg.Sealer,
+		elector:       cfg.Elector,
+		certStore:     certStore,
+		user:          &AcmeUser{},
+		trigger:       make(chan struct{}, 1),
+		rollbacks:     make(chan chan rollbackResult),
 	}
+	a.SetPreferredChain(cfg.PreferredChain)
+
+	return a
+}
+
+// SetPreferredChain changes the preferred certificate chain of the next
+// renewals
+func (a *Acme) SetPreferredChain(chain string) {
+	a.preferred.Store(&chain)
 }
 
 func (a *Acme) Serve(ctx context.Context) error {
 
 	logger.Info().Msg("starting")
 
-	if err := a.restore(); errors.Is(err, os.ErrNotExist) {
+	// without leader election this instance always manages the certificates
+	if a.elector == nil {
+		return a.lead(ctx)
+	}
+
+	return a.campaign(ctx)
+}
+
+// lead restores or creates the acme account and issues and renews the
+// certificates until the context is done
+func (a *Acme) lead(ctx context.Context) error {
+
+	// drop a renewal requested while this replica was not leading
+	select {
+	case <-a.trigger:
+	default:
+	}
+	a.leading.Store(true)
+	defer a.leading.Store(false)
+
+	if err := a.restore(ctx); errors.Is(err, os.ErrNotExist) {
 		logger.Debug().Msg("acme user not found - creating new user")
 
 		// create new acme user
-		if err := a.initLego(); err != nil {
-			return err
-		}
-
-		// create new certificate
-		if err := a.createCertificate(); err != nil {
+		if err := a.initLego(ctx); err != nil {
 			return err
 		}
 	} else if err != nil {
 		return err
 	}
 
-	// start renewal process
-	a.timer = time.NewTimer(time.Until(time.Now().Local().Add(5 * time.Minute)))
-	go a.renewCertificate()
+	// issue a certificate right away if none exists yet or if the existing
+	// one does not match the configuration, otherwise schedule its renewal
+	a.timer = time.NewTimer(0)
+	defer a.timer.Stop()
+	if a.certs != nil {
+		if err := a.checkCertificate(ctx); err != nil {
+			logger.Info().Msgf("reissuing certificate: %v", err)
+		} else {
+			a.schedule()
+		}
+	}
 
 	for {
 		select {
 		case <-ctx.Done():
 			return nil
 		case <-a.timer.C:
+			// the timer also fires to refresh the ARI window
+			if time.Now().Before(a.renewAt) {
+				a.schedule()
+				continue
+			}
+
 			logger.Debug().Msgf("certificate renewal timer triggered")
 
-			if err := a.createCertificate(); err != nil {
-				return err
+			// failed renewals are retried with backoff instead of
+			// restarting the service, which could hit CA rate limits
+			if err := a.createCertificate(ctx); err != nil {
+				a.retry(err)
+				continue
 			}
 
-			// start renewal process again
-			go a.renewCertificate()
+			a.schedule()
+		case <-a.trigger:
+			logger.Info().Msg("certificate renewal requested")
+			if err := a.createCertificate(ctx); err != nil {
+				a.retry(err)
+				continue
+			}
+
+			a.schedule()
+		case done := <-a.rollbacks:
+			bundle, err := a.rollback(ctx)
+			done <- rollbackResult{bundle: bundle, err: err}
+			if err == nil {
+				a.schedule()
+			}
 		}
 	}
 }
 
+// TriggerRenewal asks the running service to renew the certificate now.
+// It returns false if a renewal is already pending and an error if this
+// replica is not the leader, only the leader renews.
+func (a *Acme) TriggerRenewal() (bool, error) {
+
+	if !a.leading.Load() {
+		return false, errNotLeader
+	}
+
+	select {
+	case a.trigger <- struct{}{}:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
 // initLego prepares the lego user and client
 // * creates a new private key
 // * creates a new ACME registration
 // * inits new lego client
 // * creates new acme account registration
 // * writes the account state data to filesystem
-func (a *Acme) initLego() error {
+func (a *Acme) initLego(ctx context.Context) error {
 
 	logger.Debug().Msgf("creating new lego account for %s", a.email)
 
@@ -147,15 +305,26 @@ func (a *Acme) initLego() error {
 	}
 	a.client = client
 
-	// New users will need to register
-	reg, err := a.client.Registration.Register(
-		registration.RegisterOptions{TermsOfServiceAgreed: true})
+	// New users will need to register, using External Account Binding
+	// if the CA requires it
+	var reg *registration.Resource
+	if a.eabKeyID != "" {
+		reg, err = a.client.Registration.RegisterWithExternalAccountBinding(
+			registration.RegisterEABOptions{
+				TermsOfServiceAgreed: true,
+				Kid:                  a.eabKeyID,
+				HmacEncoded:          a.eabHMAC,
+			})
+	} else {
+		reg, err = a.client.Registration.Register(
+			registration.RegisterOptions{TermsOfServiceAgreed: true})
+	}
 	if err != nil {
 		return err
 	}
 	a.user.Registration = reg
 
-	if err := a.writeState(); err != nil {
+	if err := a.writeState(ctx); err != nil {
 		return err
 	}
 
@@ -170,7 +339,7 @@ func (a *Acme) initLego() error {
 // * obtains certificates
 // * send certs to KMS service (via channel)
 // * pass certs to writeCerts method
-func (a *Acme) createCertificate() error {
+func (a *Acme) createCertificate(ctx context.Context) error {
 
 	logger.Debug().Msgf("creating new certs for %s", a.domains)
 
@@ -187,8 +356,20 @@ func (a *Acme) createCertificate() error {
 
 	// create new certificate request
 	request := certificate.ObtainRequest{
-		Domains: a.domains,
-		Bundle:  true,
+		Domains:        a.domains,
+		Bundle:         true,
+		PreferredChain: a.preferredChain(),
+	}
+
+	// sign the CSR with the existing private key if it should be reused
+	if a.reuseKey {
+		key, err := a.currentKey()
+		if err != nil {
+			logger.Warn().Msgf("not reusing private key: %v", err)
+		} else if key != nil {
+			logger.Debug().Msg("reusing existing private key")
+			request.PrivateKey = key
+		}
 	}
 
 	// obtain certificate
@@ -197,60 +378,141 @@ func (a *Acme) createCertificate() error {
 		return err
 	}
 
-	// send new certificate and private key to kms server
-	certsMap := map[string][]byte{
+	// validate the new certificate before it replaces the live one,
+	// a rejected certificate is retried like a failed renewal
+	bundle, err := certstore.NewBundle(certificates.Certificate, certificates.PrivateKey, "acme")
+	if err != nil {
+		return fmt.Errorf("invalid certificate: %w", err)
+	}
+	opts, err := a.validateOptions()
+	if err != nil {
+		return err
+	}
+	if err := certstore.Validate(bundle, opts); err != nil {
+		return fmt.Errorf("rejected new certificate: %w", err)
+	}
+
+	// another replica may have taken over while the certificate was
+	// obtained, only the leader writes to the shared storage
+	if err := a.confirmLeadership(ctx); err != nil {
+		return fmt.Errorf("dropping new certificate: %w", err)
+	}
+
+	// keep the current certificate as rollback target
+	if err := a.writePrevious(ctx); err != nil {
+		return err
+	}
+
+	// pass the new certificate and private key to the kms server
+	a.certStore.Set(bundle)
+	a.certs = map[string][]byte{
 		"certificate": certificates.Certificate,
 		"privatekey":  certificates.PrivateKey,
 	}
-	a.certsChannel <- certsMap
-	a.certs = certsMap
 
-	if err := a.writeCerts(certificates); err != nil {
+	if err := a.writeCerts(ctx, certificates); err != nil {
 		return err
 	}
 
 	logger.Info().Msgf("successfully created new certs for: %s", a.domains)
+	if leaf, err := certstore.ParseLeaf(certificates.Certificate); err == nil {
+		logger.Info().Msgf("certificate public key pin (sha256): %s", SPKIHash(leaf))
+	}
 
 	return nil
 }
 
-// renewCertificate renews certificates
-func (a *Acme) renewCertificate() {
+// preferredChain returns the preferred certificate chain, empty selects
+// the default chain of the CA
+func (a *Acme) preferredChain() string {
+
+	if chain := a.preferred.Load(); chain != nil {
+		return *chain
+	}
+
+	return ""
+}
+
+// currentKey returns the private key of the current certificate
+// it returns nil if there is no certificate yet and an error if the
+// key does not match the configured key type
+func (a *Acme) currentKey() (crypto.PrivateKey, error) {
+
+	if a.certs == nil {
+		return nil, nil
+	}
 
-	cert, err := tls.X509KeyPair(a.certs["certificate"], a.certs["privatekey"])
+	key, err := certcrypto.ParsePEMPrivateKey(a.certs["privatekey"])
 	if err != nil {
-		logger.Error().Err(err).Msg("convert cert to x509")
+		return nil, err
 	}
 
-	renewalInfo, err := a.client.Certificate.GetRenewalInfo(
-		certificate.RenewalInfoRequest{
-			Cert: cert.Leaf,
-		},
-	)
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	keyType, err := publicKeyType(signer.Public())
 	if err != nil {
-		if errors.Is(err, api.ErrNoARI) {
-			// The server does not advertise a renewal info endpoint.
-			logger.Warn().Msgf("acme renew: %v", err)
-		}
-		logger.Warn().Msgf("acme: calling renewal info endpoint: %v", err)
+		return nil, err
+	}
+	if keyType != a.keyType {
+		return nil, fmt.Errorf("existing key type %s does not match configured key type %s",
+			keyType, a.keyType)
+	}
+
+	return key, nil
+}
+
+// validateOptions returns the checks for newly issued certificates
+// the chain is verified against the trust roots if they are set. Without
+// them only the Let's Encrypt production chain is verified against the
+// system roots, the staging server and custom directories like Pebble
+// issue from roots that are not known here.
+func (a *Acme) validateOptions() (certstore.ValidateOptions, error) {
+
+	opts := certstore.ValidateOptions{Names: a.domains}
+
+	if a.trustRoots == "" {
+		opts.SkipChain = a.dev || a.directoryURL != ""
+		return opts, nil
+	}
+
+	pool, err := lego.CreateCertPool([]string{a.trustRoots}, false)
+	if err != nil {
+		return opts, fmt.Errorf("could not load acme trust roots: %w", err)
 	}
+	opts.Roots = pool
+
+	return opts, nil
+}
 
-	// get the renewal suggestion time and reset timer to that time
-	renew := renewalInfo.RenewalInfoResponse.SuggestedWindow.Start
-	a.timer.Reset(time.Until(renew))
-	logger.Info().Msgf("reattempting certificate renewal at: %s", renew)
+// directory returns the ACME directory URL to use
+func (a *Acme) directory() string {
+	return DirectoryURL(a.directoryURL, a.dev)
+}
+
+// DirectoryURL returns the configured ACME directory URL or the Let's
+// Encrypt production or staging directory
+func DirectoryURL(url string, dev bool) string {
+
+	switch {
+	case url != "":
+		return url
+	case dev:
+		return lego.LEDirectoryStaging
+	default:
+		return lego.LEDirectoryProduction
+	}
 }
 
 func (a *Acme) createLegoClient() (*lego.Client, error) {
 
-	config := lego.NewConfig(a.user)
-	if a.dev {
-		logger.Debug().Msg("running in debug mode, using Let's Encrypt staging server")
-		config.CADirURL = lego.LEDirectoryStaging
-	} else {
-		config.CADirURL = lego.LEDirectoryProduction
+	config, err := a.legoConfig()
+	if err != nil {
+		return nil, err
 	}
-	config.Certificate.KeyType = certcrypto.EC256
+
+	logger.Debug().Msgf("using ACME directory %s", config.CADirURL)
 
 	// A client facilitates communication with the CA server.
 	client, err := lego.NewClient(config)
@@ -260,3 +522,28 @@ func (a *Acme) createLegoClient() (*lego.Client, error) {
 
 	return client, nil
 }
+
+// legoConfig returns the lego configuration for the account user
+func (a *Acme) legoConfig() (*lego.Config, error) {
+
+	config := lego.NewConfig(a.user)
+	config.CADirURL = a.directory()
+	config.Certificate.KeyType = a.keyType
+
+	// trust additional roots for the ACME server connection
+	if a.caBundle != "" {
+		pool, err := lego.CreateCertPool([]string{a.caBundle}, true)
+		if err != nil {
+			return nil, fmt.Errorf("could not load acme ca bundle: %w", err)
+		}
+		transport, ok := config.HTTPClient.Transport.(*http.Transport)
+		if !ok {
+			return nil, errors.New("unexpected acme http transport")
+		}
+		transport = transport.Clone()
+		transport.TLSClientConfig.RootCAs = pool
+		config.HTTPClient.Transport = transport
+	}
+
+	return config, nil
+}
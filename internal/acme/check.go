@@ -0,0 +1,146 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/go-acme/lego/v4/certcrypto"
+	"github.com/go-acme/lego/v4/certificate"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// checkCertificate compares the loaded certificate with the current
+// configuration and returns an error describing the first mismatch
+// * the SANs must equal the configured domains
+// * the public key must be of the configured key type
+// * the certificate must have been issued by the configured ACME server
+func (a *Acme) checkCertificate(ctx context.Context) error {
+
+	leaf, err := certstore.ParseLeaf(a.certs["certificate"])
+	if err != nil {
+		return err
+	}
+
+	// compare SANs with the configured domains
+	want := normalizeDomains(a.domains)
+	have := normalizeDomains(leaf.DNSNames)
+	if !slices.Equal(want, have) {
+		return fmt.Errorf("certificate domains %v do not match configured domains %v", have, want)
+	}
+
+	// compare key type
+	keyType, err := publicKeyType(leaf.PublicKey)
+	if err != nil {
+		return err
+	}
+	if keyType != a.keyType {
+		return fmt.Errorf("certificate key type %s does not match configured key type %s",
+			keyType, a.keyType)
+	}
+
+	// compare issuer using the metadata stored by writeCerts
+	meta, err := a.storage.Get(ctx, storage.MetadataKey(a.domains[0]))
+	if err != nil {
+		logger.Debug().Err(err).Msg("no certificate metadata found, skipping issuer check")
+		return nil
+	}
+	var res certificate.Resource
+	if err := json.Unmarshal(meta, &res); err != nil {
+		return fmt.Errorf("could not parse certificate metadata: %w", err)
+	}
+	issuer, err := url.Parse(res.CertURL)
+	if err != nil {
+		return fmt.Errorf("could not parse certificate url: %w", err)
+	}
+	directory, err := url.Parse(a.directory())
+	if err != nil {
+		return fmt.Errorf("could not parse acme directory url: %w", err)
+	}
+	if !strings.EqualFold(issuer.Host, directory.Host) {
+		return fmt.Errorf("certificate issued by %s, configured acme server is %s",
+			issuer.Host, directory.Host)
+	}
+
+	return nil
+}
+
+// normalizeDomains returns the sorted, lower-cased and deduplicated domains
+func normalizeDomains(domains []string) []string {
+
+	normalized := make([]string, 0, len(domains))
+	for _, d := range domains {
+		normalized = append(normalized, strings.ToLower(strings.TrimSuffix(d, ".")))
+	}
+	slices.Sort(normalized)
+
+	return slices.Compact(normalized)
+}
+
+// publicKeyType maps a certificate public key to the lego key type
+func publicKeyType(pub any) (certcrypto.KeyType, error) {
+
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return certcrypto.EC256, nil
+		case elliptic.P384():
+			return certcrypto.EC384, nil
+		}
+	case *rsa.PublicKey:
+		switch key.N.BitLen() {
+		case 2048:
+			return certcrypto.RSA2048, nil
+		case 3072:
+			return certcrypto.RSA3072, nil
+		case 4096:
+			return certcrypto.RSA4096, nil
+		case 8192:
+			return certcrypto.RSA8192, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported certificate public key %T", pub)
+}
+
+// ParseKeyType parses the name of a certificate key type
+// (EC256, EC384, RSA2048, RSA3072, RSA4096 or RSA8192)
+func ParseKeyType(name string) (certcrypto.KeyType, error) {
+
+	switch strings.ToUpper(name) {
+	case "EC256", "P256":
+		return certcrypto.EC256, nil
+	case "EC384", "P384":
+		return certcrypto.EC384, nil
+	case "RSA2048":
+		return certcrypto.RSA2048, nil
+	case "RSA3072":
+		return certcrypto.RSA3072, nil
+	case "RSA4096":
+		return certcrypto.RSA4096, nil
+	case "RSA8192":
+		return certcrypto.RSA8192, nil
+	}
+
+	return "", fmt.Errorf("unknown key type %q", name)
+}
+
+// SPKIHash returns the base64 encoded SHA-256 hash of the certificate's
+// subject public key info, as used for public key pinning
+func SPKIHash(cert *x509.Certificate) string {
+
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
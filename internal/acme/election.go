@@ -0,0 +1,142 @@
+package acme
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/election"
+)
+
+// campaign runs the leader election loop
+// the leader issues and renews the certificates while followers load the
+// certificates issued by the leader from the shared storage
+func (a *Acme) campaign(ctx context.Context) error {
+
+	logger.Info().Msgf("using leader election %s", a.elector)
+
+	ticker := time.NewTicker(election.RenewInterval)
+	defer ticker.Stop()
+
+	var (
+		cancel context.CancelFunc
+		done   chan error
+	)
+	defer func() {
+		if cancel != nil {
+			cancel()
+			<-done
+		}
+		if err := a.elector.Release(context.Background()); err != nil {
+			logger.Warn().Err(err).Msg("could not release leadership")
+		}
+	}()
+
+	for {
+		leader, err := a.tryAcquire(ctx)
+		if err != nil {
+			logger.Warn().Err(err).Msg("leader election failed")
+		}
+
+		switch {
+		case leader && cancel == nil:
+			logger.Info().Msg("acquired leadership, managing certificates")
+			cancel, done = a.startLeading(ctx)
+		case !leader && cancel != nil:
+			logger.Warn().Msg("lost leadership, following")
+			cancel()
+			<-done
+			cancel, done = nil, nil
+		case !leader:
+			a.follow(ctx)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-done:
+			// the leader routine failed, give up leadership and let the
+			// supervisor restart the service
+			cancel()
+			cancel, done = nil, nil
+			if err != nil {
+				return err
+			}
+		case <-ticker.C:
+		}
+	}
+}
+
+// startLeading runs the leader routine in the background
+// it returns a function to stop it and a channel receiving its result
+func (a *Acme) startLeading(ctx context.Context) (context.CancelFunc, chan error) {
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- a.lead(leaderCtx)
+	}()
+
+	return cancel, done
+}
+
+// tryAcquire acquires or renews the leadership lease, the campaign and
+// confirmLeadership never update the lease concurrently
+func (a *Acme) tryAcquire(ctx context.Context) (bool, error) {
+
+	a.electionMu.Lock()
+	defer a.electionMu.Unlock()
+
+	return a.elector.TryAcquire(ctx)
+}
+
+// confirmLeadership renews the lease and returns an error if this replica
+// is no longer the leader. Without leader election it always succeeds.
+func (a *Acme) confirmLeadership(ctx context.Context) error {
+
+	if a.elector == nil {
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("leadership lost: %w", err)
+	}
+
+	leader, err := a.tryAcquire(ctx)
+	if err != nil {
+		return fmt.Errorf("could not confirm leadership: %w", err)
+	}
+	if !leader {
+		return errors.New("leadership lost to another replica")
+	}
+
+	return nil
+}
+
+// follow loads the certificates issued by the leader from storage and
+// passes them on to the kms service if they changed
+func (a *Acme) follow(ctx context.Context) {
+
+	previous := a.certs
+	if err := a.loadCerts(ctx, false); errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		logger.Warn().Err(err).Msg("could not load certificates issued by the leader")
+		return
+	}
+
+	if previous != nil && bytes.Equal(previous["certificate"], a.certs["certificate"]) {
+		return
+	}
+
+	bundle, err := certstore.NewBundle(a.certs["certificate"], a.certs["privatekey"], "acme")
+	if err != nil {
+		logger.Warn().Err(err).Msg("invalid certificates issued by the leader")
+		return
+	}
+	a.certStore.Set(bundle)
+	logger.Info().Msg("loaded certificates issued by the leader")
+}
@@ -0,0 +1,66 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// fakeElector reports a fixed election result
+type fakeElector struct {
+	leader bool
+	err    error
+	calls  int
+}
+
+func (f *fakeElector) TryAcquire(ctx context.Context) (bool, error) {
+	f.calls++
+	return f.leader, f.err
+}
+
+func (f *fakeElector) Release(ctx context.Context) error {
+	return nil
+}
+
+func (f *fakeElector) String() string {
+	return "fake"
+}
+
+func TestConfirmLeadership(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		elector   *fakeElector
+		cancelled bool
+		wantErr   bool
+		wantCalls int
+	}{
+		{name: "without election"},
+		{name: "still leading", elector: &fakeElector{leader: true}, wantCalls: 1},
+		{name: "lost", elector: &fakeElector{}, wantErr: true, wantCalls: 1},
+		{name: "election failed", elector: &fakeElector{leader: true, err: errors.New("timeout")}, wantErr: true, wantCalls: 1},
+		{name: "stopped leading", elector: &fakeElector{leader: true}, cancelled: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			a := &Acme{}
+			if tt.elector != nil {
+				a.elector = tt.elector
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			if tt.cancelled {
+				cancel()
+			}
+			defer cancel()
+
+			if err := a.confirmLeadership(ctx); (err != nil) != tt.wantErr {
+				t.Fatalf("got %v, want error %t", err, tt.wantErr)
+			}
+			if tt.elector != nil && tt.elector.calls != tt.wantCalls {
+				t.Fatalf("got %d lease renewals, want %d", tt.elector.calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-acme/lego/v4/certificate"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+)
+
+// Status describes the stored certificate and its renewal
+type Status struct {
+	Domains   []string
+	Issuer    string
+	NotBefore time.Time
+	NotAfter  time.Time
+	KeyType   string
+	SPKIHash  string
+
+	// WindowStart and WindowEnd are the renewal window suggested by the
+	// CA through ARI, they are zero if the CA does not support ARI
+	WindowStart time.Time
+	WindowEnd   time.Time
+	Explanation string
+	// ARIError is set if the renewal information could not be fetched
+	ARIError error
+
+	// RenewAfter and RenewBefore bound the scheduled renewal, which is
+	// chosen randomly in between
+	RenewAfter  time.Time
+	RenewBefore time.Time
+}
+
+// Status reads the stored certificate and asks the CA for its renewal
+// window. The certificate is described even if the CA is unreachable.
+func (a *Acme) Status(ctx context.Context) (*Status, error) {
+
+	if err := a.loadCerts(ctx, false); err != nil {
+		return nil, err
+	}
+	leaf, err := certstore.ParseLeaf(a.certs["certificate"])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Status{
+		Domains:   leaf.DNSNames,
+		Issuer:    leaf.Issuer.String(),
+		NotBefore: leaf.NotBefore,
+		NotAfter:  leaf.NotAfter,
+		SPKIHash:  SPKIHash(leaf),
+	}
+	if keyType, err := publicKeyType(leaf.PublicKey); err == nil {
+		s.KeyType = string(keyType)
+	} else {
+		s.KeyType = fmt.Sprintf("%T", leaf.PublicKey)
+	}
+
+	s.RenewAfter, s.RenewBefore = fallbackWindow(leaf, a.renewFraction)
+
+	if err := a.restore(ctx); err != nil {
+		s.ARIError = fmt.Errorf("could not restore acme account: %w", err)
+		return s, nil
+	}
+	info, err := a.client.Certificate.GetRenewalInfo(certificate.RenewalInfoRequest{Cert: leaf})
+	if err != nil {
+		s.ARIError = err
+		return s, nil
+	}
+	s.WindowStart = info.SuggestedWindow.Start
+	s.WindowEnd = info.SuggestedWindow.End
+	s.Explanation = info.ExplanationURL
+	s.RenewAfter, s.RenewBefore = s.WindowStart, s.WindowEnd
+
+	return s, nil
+}
+
+// Renew issues a new certificate right away, independent of the renewal
+// schedule. With leader election it fails unless this process can
+// become the leader, so it never races with a running instance.
+func (a *Acme) Renew(ctx context.Context) error {
+
+	if a.elector != nil {
+		leader, err := a.tryAcquire(ctx)
+		if err != nil {
+			return fmt.Errorf("leader election failed: %w", err)
+		}
+		if !leader {
+			return errors.New("another instance is the leader, renew the certificate there")
+		}
+		defer func() {
+			if err := a.elector.Release(context.Background()); err != nil {
+				logger.Warn().Err(err).Msg("could not release leadership")
+			}
+		}()
+	}
+
+	if err := a.restore(ctx); errors.Is(err, os.ErrNotExist) {
+		if err := a.initLego(ctx); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	return a.createCertificate(ctx)
+}
+
+// Revoke revokes the stored certificate with the CRL reason code
+func (a *Acme) Revoke(ctx context.Context, reason uint) error {
+
+	if err := a.restore(ctx); err != nil {
+		return err
+	}
+	if a.certs == nil {
+		return fmt.Errorf("no certificate stored for %s", strings.Join(a.domains, ", "))
+	}
+
+	if err := a.client.Certificate.RevokeWithReason(a.certs["certificate"], &reason); err != nil {
+		return fmt.Errorf("could not revoke certificate: %w", err)
+	}
+
+	logger.Info().Msgf("revoked certificate for %s", strings.Join(a.domains, ", "))
+
+	return nil
+}
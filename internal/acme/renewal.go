@@ -0,0 +1,149 @@
+package acme
+
+import (
+	"crypto/x509"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/go-acme/lego/v4/acme/api"
+	"github.com/go-acme/lego/v4/certificate"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+)
+
+const (
+	// DefaultRenewFraction is the share of the certificate lifetime after
+	// which the certificate is renewed when the CA does not support ARI
+	DefaultRenewFraction = 0.66
+
+	// recheckInterval caps how long the scheduler sleeps before it asks
+	// the ACME server for updated renewal information again
+	recheckInterval = 24 * time.Hour
+
+	// minRetryDelay and maxRetryDelay bound the backoff between
+	// failed renewal attempts
+	minRetryDelay = time.Minute
+	maxRetryDelay = 6 * time.Hour
+
+	// jitterFraction is the share of the certificate lifetime that is
+	// randomly added to the fallback renewal time
+	jitterFraction = 0.05
+)
+
+// schedule computes the next renewal time of the current certificate
+// and resets the renewal timer accordingly
+func (a *Acme) schedule() {
+
+	a.failures = 0
+	a.renewAt = a.renewalTime()
+
+	// wake up at least once per recheckInterval to refresh the ARI window
+	a.timer.Reset(min(time.Until(a.renewAt), recheckInterval))
+
+	logger.Info().Msgf("next certificate renewal at: %s", a.renewAt.Local())
+}
+
+// retry reschedules a failed renewal with exponential backoff
+// the delay never skips past the expiry of the current certificate
+func (a *Acme) retry(err error) {
+
+	a.failures++
+
+	delay := backoff(a.failures)
+	if leaf, lerr := certstore.ParseLeaf(a.certs["certificate"]); lerr == nil {
+		remaining := time.Until(leaf.NotAfter)
+		if remaining <= 0 {
+			logger.Error().Msgf("certificate expired at %s", leaf.NotAfter.Local())
+		}
+		delay = retryDelay(a.failures, remaining)
+	}
+
+	a.timer.Reset(delay)
+
+	logger.Error().Err(err).Msgf("certificate renewal failed (attempt %d), retrying in %s",
+		a.failures, delay)
+}
+
+// backoff returns the delay after the given number of failures
+func backoff(failures int) time.Duration {
+
+	if failures >= 16 {
+		return maxRetryDelay
+	}
+
+	return min(minRetryDelay<<(failures-1), maxRetryDelay)
+}
+
+// retryDelay returns the backoff after the given number of failures, it
+// is capped at half of the remaining validity of the current certificate.
+// An expired certificate is retried after the minimum delay.
+func retryDelay(failures int, remaining time.Duration) time.Duration {
+
+	if remaining <= 0 {
+		return minRetryDelay
+	}
+	delay := backoff(failures)
+	if remaining < delay {
+		delay = max(remaining/2, minRetryDelay)
+	}
+
+	return delay
+}
+
+// renewalTime returns the time at which the current certificate should be
+// renewed. It prefers the ACME Renewal Information (ARI) window and falls
+// back to a fraction of the certificate lifetime with jitter.
+func (a *Acme) renewalTime() time.Time {
+
+	leaf, err := certstore.ParseLeaf(a.certs["certificate"])
+	if err != nil {
+		logger.Warn().Err(err).Msg("could not parse current certificate, renewing now")
+		return time.Now()
+	}
+
+	info, err := a.client.Certificate.GetRenewalInfo(
+		certificate.RenewalInfoRequest{
+			Cert: leaf,
+		},
+	)
+	switch {
+	case errors.Is(err, api.ErrNoARI):
+		logger.Debug().Msg("acme server does not support ARI, using certificate lifetime")
+	case err != nil:
+		logger.Warn().Msgf("acme: calling renewal info endpoint: %v", err)
+	default:
+		if at := info.ShouldRenewAt(time.Now(), time.Until(leaf.NotAfter)); at != nil {
+			return *at
+		}
+	}
+
+	return fallbackRenewal(leaf, a.renewFraction)
+}
+
+// fallbackRenewal returns a random point in time of the fallback
+// window, so that several instances do not renew at the same moment
+func fallbackRenewal(leaf *x509.Certificate, fraction float64) time.Time {
+
+	start, end := fallbackWindow(leaf, fraction)
+	if jitter := int64(end.Sub(start)); jitter > 0 {
+		return start.Add(time.Duration(rand.Int64N(jitter)))
+	}
+
+	return start
+}
+
+// fallbackWindow returns the renewal window used if the CA does not
+// support ARI, it starts after `fraction` of the certificate lifetime has
+// passed and lasts jitterFraction of the lifetime
+func fallbackWindow(leaf *x509.Certificate, fraction float64) (start, end time.Time) {
+
+	if fraction <= 0 || fraction >= 1 {
+		fraction = DefaultRenewFraction
+	}
+
+	start = certstore.RenewalTime(leaf, fraction)
+	end = start.Add(time.Duration(float64(leaf.NotAfter.Sub(leaf.NotBefore)) * jitterFraction))
+
+	return start, end
+}
@@ -0,0 +1,76 @@
+package acme
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+)
+
+func TestFallbackRenewal(t *testing.T) {
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	lifetime := 90 * 24 * time.Hour
+	leaf := &x509.Certificate{NotBefore: start, NotAfter: start.Add(lifetime)}
+
+	tests := []struct {
+		name     string
+		fraction float64
+		want     float64
+	}{
+		{name: "zero uses default", fraction: 0, want: DefaultRenewFraction},
+		{name: "negative uses default", fraction: -0.5, want: DefaultRenewFraction},
+		{name: "one uses default", fraction: 1, want: DefaultRenewFraction},
+		{name: "above one uses default", fraction: 1.5, want: DefaultRenewFraction},
+		{name: "half", fraction: 0.5, want: 0.5},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			wantStart := start.Add(time.Duration(float64(lifetime) * tt.want))
+			wantEnd := wantStart.Add(time.Duration(float64(lifetime) * jitterFraction))
+
+			from, to := fallbackWindow(leaf, tt.fraction)
+			if !from.Equal(wantStart) || !to.Equal(wantEnd) {
+				t.Fatalf("got window %s to %s, want %s to %s", from, to, wantStart, wantEnd)
+			}
+
+			// the jitter stays within the window
+			for range 1000 {
+				at := fallbackRenewal(leaf, tt.fraction)
+				if at.Before(wantStart) || !at.Before(wantEnd) {
+					t.Fatalf("renewal at %s outside of %s to %s", at, wantStart, wantEnd)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		failures  int
+		remaining time.Duration
+		want      time.Duration
+	}{
+		{name: "first failure", failures: 1, remaining: 30 * 24 * time.Hour, want: minRetryDelay},
+		{name: "doubled", failures: 3, remaining: 30 * 24 * time.Hour, want: 4 * minRetryDelay},
+		{name: "far from expiry", failures: 10, remaining: 30 * 24 * time.Hour, want: maxRetryDelay},
+		{name: "no overflow", failures: 100, remaining: 30 * 24 * time.Hour, want: maxRetryDelay},
+		{name: "half of the remaining validity", failures: 10, remaining: 2 * time.Hour, want: time.Hour},
+		{name: "not below the minimum", failures: 10, remaining: 90 * time.Second, want: minRetryDelay},
+		{name: "backoff below the cap", failures: 1, remaining: 10 * time.Minute, want: minRetryDelay},
+		{name: "expiring now", failures: 10, want: minRetryDelay},
+		{name: "expired", failures: 10, remaining: -time.Hour, want: minRetryDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := retryDelay(tt.failures, tt.remaining); got != tt.want {
+				t.Fatalf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package acme
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// rollbackTimeout limits the wait for a renewal in progress
+const rollbackTimeout = 5 * time.Minute
+
+// rollbackResult is the result of a rollback in the leader routine
+type rollbackResult struct {
+	bundle *certstore.Bundle
+	err    error
+}
+
+// Rollback serves the previous certificate again and swaps it with the
+// current one in storage, so that the rollback survives restarts and
+// reaches the other replicas. It runs in the leader routine, after a
+// renewal in progress, and returns an error if this replica is not the
+// leader.
+func (a *Acme) Rollback(ctx context.Context) (*certstore.Bundle, error) {
+
+	if !a.leading.Load() {
+		return nil, errNotLeader
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, rollbackTimeout)
+	defer cancel()
+
+	done := make(chan rollbackResult, 1)
+	select {
+	case a.rollbacks <- done:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rollback not started: %w", ctx.Err())
+	}
+	select {
+	case r := <-done:
+		return r.bundle, r.err
+	case <-ctx.Done():
+		return nil, fmt.Errorf("rollback not finished: %w", ctx.Err())
+	}
+}
+
+// rollback swaps the current and the previous certificate in storage and
+// serves the previous one, the caller schedules its renewal
+func (a *Acme) rollback(ctx context.Context) (*certstore.Bundle, error) {
+
+	names := []string{storage.CertKey, storage.KeyKey, storage.PrevCertKey, storage.PrevKeyKey}
+	data := make(map[string][]byte, len(names))
+	for _, name := range names {
+		d, err := a.storage.Get(ctx, name)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errors.New("no previous certificate to roll back to")
+		} else if err != nil {
+			return nil, err
+		}
+		data[name] = d
+	}
+
+	key, _, err := seal.Decode(ctx, a.sealer, data[storage.PrevKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal previous private key: %w", err)
+	}
+	bundle, err := certstore.NewBundle(data[storage.PrevCertKey], key, "rollback")
+	if err != nil {
+		return nil, fmt.Errorf("invalid previous certificate: %w", err)
+	}
+	if err := certstore.Validate(bundle, certstore.ValidateOptions{SkipChain: true}); err != nil {
+		return nil, fmt.Errorf("previous certificate: %w", err)
+	}
+
+	// only the leader writes to the shared storage
+	if err := a.confirmLeadership(ctx); err != nil {
+		return nil, err
+	}
+
+	// write the keys first, so that a certificate is never stored without
+	// its key
+	if err := storage.PutAll(ctx, a.storage,
+		storage.Object{Name: storage.KeyKey, Data: data[storage.PrevKeyKey]},
+		storage.Object{Name: storage.PrevKeyKey, Data: data[storage.KeyKey]},
+		storage.Object{Name: storage.CertKey, Data: data[storage.PrevCertKey]},
+		storage.Object{Name: storage.PrevCertKey, Data: data[storage.CertKey]},
+	); err != nil {
+		return nil, err
+	}
+
+	// the renewal is scheduled for the certificate served from now on
+	a.certs = map[string][]byte{"certificate": data[storage.PrevCertKey], "privatekey": key}
+	a.certStore.Set(bundle)
+
+	return bundle, nil
+}
@@ -0,0 +1,102 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// newTestCertificate returns a self-signed certificate and its key in PEM
+func newTestCertificate(t *testing.T, serial int64) (certPEM, keyPEM []byte) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "kms.example.com"},
+		DNSNames:     []string{"kms.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func TestRollback(t *testing.T) {
+
+	ctx := context.Background()
+	a := &Acme{storage: storage.NewLocal(t.TempDir()), certStore: certstore.New()}
+
+	// followers reject the rollback
+	if _, err := a.Rollback(ctx); !errors.Is(err, errNotLeader) {
+		t.Fatalf("got %v, want %v", err, errNotLeader)
+	}
+
+	if _, err := a.rollback(ctx); err == nil {
+		t.Fatal("rollback without a previous certificate succeeded")
+	}
+
+	cert, key := newTestCertificate(t, 2)
+	prevCert, prevKey := newTestCertificate(t, 1)
+	if err := storage.PutAll(ctx, a.storage,
+		storage.Object{Name: storage.KeyKey, Data: key},
+		storage.Object{Name: storage.CertKey, Data: cert},
+		storage.Object{Name: storage.PrevKeyKey, Data: prevKey},
+		storage.Object{Name: storage.PrevCertKey, Data: prevCert},
+	); err != nil {
+		t.Fatal(err)
+	}
+
+	bundle, err := a.rollback(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bundle.Leaf.SerialNumber.Int64() != 1 {
+		t.Fatalf("got serial %d, want the previous certificate", bundle.Leaf.SerialNumber)
+	}
+	if a.certStore.Current() != bundle {
+		t.Fatal("the previous certificate is not served")
+	}
+	if string(a.certs["certificate"]) != string(prevCert) {
+		t.Fatal("the renewal is not scheduled for the previous certificate")
+	}
+
+	// the certificates are swapped in storage
+	for name, want := range map[string][]byte{
+		storage.CertKey:     prevCert,
+		storage.KeyKey:      prevKey,
+		storage.PrevCertKey: cert,
+		storage.PrevKeyKey:  key,
+	} {
+		got, err := a.storage.Get(ctx, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != string(want) {
+			t.Fatalf("%s was not swapped", name)
+		}
+	}
+}
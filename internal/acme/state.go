@@ -1,21 +1,57 @@
 package acme
 
 import (
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 
 	"github.com/go-acme/lego/v4/certificate"
 	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
 )
 
 // restore loads the existing account state and certificates to memory
-func (a *Acme) restore() error {
+func (a *Acme) restore(ctx context.Context) error {
+
+	if err := a.restoreUser(ctx); err != nil {
+		return err
+	}
+
+	// the contact of an existing account is not changed by the flag
+	if a.email != "" && a.user.Email != a.email {
+		logger.Warn().Msgf("configured email %s differs from the account email %s, run 'account update-email' to change it",
+			a.email, a.user.Email)
+	}
+
+	// load certs, a missing certificate is issued by the renewal loop
+	if err := a.loadCerts(ctx, true); errors.Is(err, os.ErrNotExist) {
+		log.Debug().Msg("no existing certs found")
+	} else if err != nil {
+		return err
+	}
+
+	// load lego client
+	client, err := a.createLegoClient()
+	if err != nil {
+		return err
+	}
+	a.client = client
+
+	return nil
+}
+
+// restoreUser loads the existing account state and unseals the account key
+func (a *Acme) restoreUser(ctx context.Context) error {
 
 	log.Debug().Msgf("restoring user information")
 
-	state, err := os.ReadFile(fmt.Sprintf("%s/state.json", a.workdir))
+	state, err := a.storage.Get(ctx, storage.StateKey)
 	if err != nil {
 		return err
 	}
@@ -24,6 +60,13 @@ func (a *Acme) restore() error {
 		return err
 	}
 
+	// unseal the account key if it is encrypted at rest
+	pkb, sealed, err := seal.Decode(ctx, a.sealer, a.user.PKB)
+	if err != nil {
+		return fmt.Errorf("could not unseal acme account key: %w", err)
+	}
+	a.user.PKB = pkb
+
 	// restore private key from DER format
 	pk, err := x509.ParseECPrivateKey(a.user.PKB)
 	if err != nil {
@@ -31,115 +74,168 @@ func (a *Acme) restore() error {
 	}
 	a.user.key = pk
 
-	// load certs
-	if err := a.loadCerts(); err != nil {
-		return err
+	// migrate a plaintext account key
+	if a.sealer != nil && !sealed {
+		log.Info().Msg("encrypting existing acme account key at rest")
+		if err := a.writeState(ctx); err != nil {
+			return err
+		}
 	}
 
-	// load lego client
-	client, err := a.createLegoClient()
+	return nil
+}
+
+// loadCerts reads the certificates from storage and stores them into
+// the certificates map, falling back to the previous certificate if the
+// current one is not a valid key pair. Plaintext private keys are only
+// encrypted if migrate is set, as only the leader writes to the storage.
+func (a *Acme) loadCerts(ctx context.Context, migrate bool) error {
+
+	certs, err := a.readCerts(ctx, storage.CertKey, storage.KeyKey, migrate)
 	if err != nil {
 		return err
 	}
-	a.client = client
+
+	if _, err := tls.X509KeyPair(certs["certificate"], certs["privatekey"]); err != nil {
+		log.Warn().Err(err).Msg("stored certificate is invalid, rolling back to previous certificate")
+		prev, perr := a.readCerts(ctx, storage.PrevCertKey, storage.PrevKeyKey, migrate)
+		if perr != nil {
+			return fmt.Errorf("invalid stored certificate: %w", err)
+		}
+		certs = prev
+	}
+
+	// assign existing certs to our server instance
+	a.certs = certs
+
+	log.Debug().Msgf("successfully loaded certs from %s", a.storage)
 
 	return nil
 }
 
-// loadCerts reads the certificates from filesystem and stores them into
-// the certificates map
-func (a *Acme) loadCerts() error {
+// readCerts reads a certificate and its private key from storage
+func (a *Acme) readCerts(ctx context.Context, certKey, keyKey string, migrate bool) (map[string][]byte, error) {
 
 	certs := make(map[string][]byte)
 
-	// try to read cert.pem
-	crt, err := os.ReadFile(fmt.Sprintf("%s/certs/cert.pem", a.workdir))
+	// try to read the certificate
+	crt, err := a.storage.Get(ctx, certKey)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	certs["certificate"] = crt
 
-	// try to read key.pem
-	pk, err := os.ReadFile(fmt.Sprintf("%s/certs/key.pem", a.workdir))
+	// try to read the private key
+	pk, err := a.storage.Get(ctx, keyKey)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	key, sealed, err := seal.Decode(ctx, a.sealer, pk)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal private key: %w", err)
+	}
+	certs["privatekey"] = key
+
+	// migrate a plaintext private key
+	if migrate && a.sealer != nil && !sealed {
+		log.Info().Msgf("encrypting existing private key %s at rest", keyKey)
+		if err := a.writeKey(ctx, keyKey, key); err != nil {
+			return nil, err
+		}
 	}
-	certs["privatekey"] = pk
-
-	// assign existing certs to our server instance
-	a.certs = certs
-
-	log.Debug().Msgf("successfully loaded certs from %s/certs", a.workdir)
 
-	return nil
+	return certs, nil
 }
 
-// writeCerts sends the new certificates to kms service via a channel
-// and it saves the certificates to the filesystem
-func (a *Acme) writeCerts(certificates *certificate.Resource) error {
+// writePrevious saves the current certificate as rollback target before
+// it is replaced
+func (a *Acme) writePrevious(ctx context.Context) error {
 
-	// create certificates directory
-	// write certificate and private key to filesystem
-	//
-	if err := os.MkdirAll(fmt.Sprintf("%s/certs", a.workdir), 0750); err != nil {
-		log.Error().Err(err).Msg("")
+	if a.certs == nil {
+		return nil
 	}
 
-	// write metadata
-	cmd, err := json.Marshal(certificates)
+	key, err := a.sealKey(ctx, a.certs["privatekey"])
 	if err != nil {
-		log.Error().Err(err).Msg("")
+		return err
 	}
 
-	if err := os.WriteFile(
-		fmt.Sprintf("%s/certs/%s", a.workdir, a.domains[0]),
-		cmd,
-		0600,
-	); err != nil {
-		log.Error().Err(err).Msg("")
+	return storage.PutAll(ctx, a.storage,
+		storage.Object{Name: storage.PrevKeyKey, Data: key},
+		storage.Object{Name: storage.PrevCertKey, Data: a.certs["certificate"]},
+	)
+}
 
-	}
+// writeCerts saves the certificate, its private key and the lego
+// metadata to the storage as one unit
+func (a *Acme) writeCerts(ctx context.Context, certificates *certificate.Resource) error {
 
-	// * write certificate chain (issuer + certificate)
-	if err := os.WriteFile(
-		fmt.Sprintf("%s/certs/cert.pem", a.workdir),
-		certificates.Certificate,
-		0600,
-	); err != nil {
-		log.Error().Err(err).Msg("write to fs")
+	metadata, err := json.Marshal(certificates)
+	if err != nil {
+		return err
+	}
+	key, err := a.sealKey(ctx, certificates.PrivateKey)
+	if err != nil {
 		return err
 	}
-	// * write certificate private key
-	if err := os.WriteFile(
-		fmt.Sprintf("%s/certs/key.pem", a.workdir),
-		certificates.PrivateKey,
-		0600,
+
+	if err := storage.PutAll(ctx, a.storage,
+		storage.Object{Name: storage.KeyKey, Data: key},
+		storage.Object{Name: storage.CertKey, Data: certificates.Certificate},
+		storage.Object{Name: storage.MetadataKey(a.domains[0]), Data: metadata},
 	); err != nil {
-		log.Error().Err(err).Msg("write to fs")
+		log.Error().Err(err).Msg("write to storage")
 		return err
 	}
-	log.Debug().Msgf("successfully written new certs to: %s/certs", a.workdir)
+	log.Debug().Msgf("successfully written new certs to: %s", a.storage)
 
 	return nil
 }
 
-// writeState saves the account state to the filesystem
-func (a *Acme) writeState() error {
+// writeKey saves a certificate private key to the storage
+// sealed with the key backend if encryption at rest is enabled
+func (a *Acme) writeKey(ctx context.Context, name string, key []byte) error {
 
-	// store state to filesystem
-	state, err := json.Marshal(a.user)
+	data, err := a.sealKey(ctx, key)
 	if err != nil {
 		return err
 	}
 
-	if err := os.WriteFile(
-		fmt.Sprintf("%s/state.json", a.workdir),
-		state,
-		0600,
-	); err != nil {
+	return a.storage.Put(ctx, name, data)
+}
+
+// sealKey seals a private key if encryption at rest is enabled
+func (a *Acme) sealKey(ctx context.Context, key []byte) ([]byte, error) {
+
+	data, err := seal.Encode(ctx, a.sealer, key)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal private key: %w", err)
+	}
+
+	return data, nil
+}
+
+// writeState saves the account state to the storage
+func (a *Acme) writeState(ctx context.Context) error {
+
+	// seal the account key if encryption at rest is enabled
+	pkb, err := seal.Encode(ctx, a.sealer, a.user.PKB)
+	if err != nil {
+		return fmt.Errorf("could not seal acme account key: %w", err)
+	}
+	user := *a.user
+	user.PKB = pkb
+
+	// store state to storage
+	state, err := json.Marshal(&user)
+	if err != nil {
+		return err
+	}
+
+	if err := a.storage.Put(ctx, storage.StateKey, state); err != nil {
 		return err
 	}
 
-	log.Debug().Msgf("successfully written state to %s/state.json", a.workdir)
+	log.Debug().Msgf("successfully written state to %s", a.storage)
 	return nil
 }
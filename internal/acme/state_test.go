@@ -0,0 +1,61 @@
+package acme
+
+import (
+	"context"
+	"testing"
+
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// fakeSealer stores the plaintext as ciphertext
+type fakeSealer struct{}
+
+func (fakeSealer) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	return plaintext, nil
+}
+
+func (fakeSealer) Unseal(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	return ciphertext, nil
+}
+
+func TestLoadCertsMigration(t *testing.T) {
+
+	tests := []struct {
+		name       string
+		migrate    bool
+		wantSealed bool
+	}{
+		{name: "leader", migrate: true, wantSealed: true},
+		{name: "follower", migrate: false, wantSealed: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctx := context.Background()
+			a := &Acme{storage: storage.NewLocal(t.TempDir()), sealer: fakeSealer{}}
+			cert, key := newTestCertificate(t, 1)
+			if err := storage.PutAll(ctx, a.storage,
+				storage.Object{Name: storage.KeyKey, Data: key},
+				storage.Object{Name: storage.CertKey, Data: cert},
+			); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := a.loadCerts(ctx, tt.migrate); err != nil {
+				t.Fatal(err)
+			}
+			if string(a.certs["privatekey"]) != string(key) {
+				t.Fatal("the private key was not loaded")
+			}
+			stored, err := a.storage.Get(ctx, storage.KeyKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if seal.IsSealed(stored) != tt.wantSealed {
+				t.Fatalf("got sealed %t, want %t", seal.IsSealed(stored), tt.wantSealed)
+			}
+		})
+	}
+}
@@ -0,0 +1,374 @@
+package admin
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative admin.proto
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/kms"
+	"github.openresearch.com/talos-kms-proxy/internal/nodes"
+)
+
+// Renewer renews the certificates of a group on request
+// TriggerRenewal returns false if a renewal is already pending and an
+// error if the service cannot renew, e.g. because it is not the leader
+type Renewer interface {
+	TriggerRenewal() (bool, error)
+}
+
+// Config configures the admin listener
+type Config struct {
+	// Listen is a unix:///path socket or a host:port TCP address
+	Listen string
+	// CertFile, KeyFile and ClientCAFile are the server certificate and
+	// the CA of the accepted client certificates of the TCP listener
+	CertFile     string
+	KeyFile      string
+	ClientCAFile string
+	Version      string
+}
+
+// Server implements the admin gRPC service
+type Server struct {
+	UnimplementedAdminServer
+
+	cfg         Config
+	kms         *kms.Server
+	nodes       *nodes.Registry
+	events      *audit.Log
+	renewers    map[string]Renewer
+	setLogLevel func(string)
+}
+
+var (
+	logger = log.With().Str("service", "admin").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// logLevels are the levels accepted by SetLogLevel
+var logLevels = []string{"trace", "debug", "info", "error"}
+
+// New creates the admin service
+// registry holds the nodes known to the kms server and events its audit
+// log, which also records the admin calls. renewers maps the certificate
+// group names to the services renewing their certificates, setLogLevel
+// changes the global log level.
+func New(cfg Config, ks *kms.Server, registry *nodes.Registry, events *audit.Log,
+	renewers map[string]Renewer, setLogLevel func(string)) *Server {
+
+	return &Server{
+		cfg:         cfg,
+		kms:         ks,
+		nodes:       registry,
+		events:      events,
+		renewers:    renewers,
+		setLogLevel: setLogLevel,
+	}
+}
+
+// Serve implements the suture service
+func (s *Server) Serve(ctx context.Context) error {
+
+	logger.Info().Msgf("starting admin listener on %s", s.cfg.Listen)
+
+	lis, creds, err := s.listen()
+	if err != nil {
+		return err
+	}
+
+	opts := []grpc.ServerOption{grpc.UnaryInterceptor(s.audit)}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	srv := grpc.NewServer(opts...)
+	RegisterAdminServer(srv, s)
+	reflection.Register(srv)
+
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	if err := srv.Serve(lis); err != nil {
+		return fmt.Errorf("admin listener failed: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Server) String() string {
+	return "admin"
+}
+
+// listen opens the unix socket, which is only accessible by the owner,
+// or the TCP listener, which requires client certificates
+func (s *Server) listen() (net.Listener, credentials.TransportCredentials, error) {
+
+	if path, ok := strings.CutPrefix(s.cfg.Listen, "unix://"); ok {
+		lis, err := listenUnix(path)
+		return lis, nil, err
+	}
+
+	if s.cfg.CertFile == "" || s.cfg.KeyFile == "" || s.cfg.ClientCAFile == "" {
+		return nil, nil, errors.New("the admin tcp listener requires a certificate, a key and a client ca")
+	}
+	cert, err := tls.LoadX509KeyPair(s.cfg.CertFile, s.cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pem, err := os.ReadFile(s.cfg.ClientCAFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, nil, fmt.Errorf("no certificates found in %s", s.cfg.ClientCAFile)
+	}
+
+	lis, err := net.Listen("tcp", s.cfg.Listen)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return lis, credentials.NewTLS(&tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}), nil
+}
+
+// listenUnix listens on a unix socket that only the owner can access
+// The socket is created in a private directory and then moved into place,
+// so that other users can never connect to it. A stale socket left by a
+// previous run is replaced, any other file is left alone.
+func listenUnix(path string) (net.Listener, error) {
+
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("%s is used by another process", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".admin-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "admin.sock")
+	lis, err := net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(tmp, 0600); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		lis.Close()
+		return nil, err
+	}
+	lis.SetUnlinkOnClose(false)
+
+	return &unixListener{UnixListener: lis, path: path}, nil
+}
+
+// unixListener removes the socket when it is closed
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Close() error {
+
+	err := l.UnixListener.Close()
+	if rmErr := os.Remove(l.path); rmErr != nil && !errors.Is(rmErr, fs.ErrNotExist) && err == nil {
+		err = rmErr
+	}
+
+	return err
+}
+
+// Status returns the served certificates and the health of the KMS keys
+func (s *Server) Status(ctx context.Context, req *StatusRequest) (*StatusResponse, error) {
+
+	resp := &StatusResponse{
+		Version:  s.cfg.Version,
+		LogLevel: zerolog.GlobalLevel().String(),
+		Lockdown: s.kms.Lockdown(),
+	}
+
+	for _, g := range s.kms.Groups() {
+		resp.Certificates = append(resp.Certificates, certificate(g.Name, g.Store.Current()))
+	}
+
+	for _, b := range s.kms.CheckBackends() {
+		backend := &Backend{Tenant: b.Tenant, KeyId: b.KeyID}
+		if b.Err != nil {
+			backend.Error = b.Err.Error()
+		}
+		resp.Backends = append(resp.Backends, backend)
+	}
+
+	return resp, nil
+}
+
+// Renew triggers the renewal of the certificates of a group or of all groups
+// A failed group fails the call if it was selected, otherwise it is listed
+// in the response and the other groups are still renewed.
+func (s *Server) Renew(ctx context.Context, req *RenewRequest) (*RenewResponse, error) {
+
+	if len(s.renewers) == 0 {
+		return nil, status.Error(codes.FailedPrecondition, "the certificate source does not support renewals")
+	}
+
+	names := make([]string, 0, len(s.renewers))
+	for name := range s.renewers {
+		if req.Group == "" || name == req.Group {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, status.Errorf(codes.NotFound, "unknown certificate group %q", req.Group)
+	}
+	sort.Strings(names)
+
+	resp := &RenewResponse{}
+	for _, name := range names {
+		triggered, err := s.renewers[name].TriggerRenewal()
+		if err != nil && req.Group != "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "group %s: %v", name, err)
+		} else if err != nil {
+			resp.Failed = append(resp.Failed, &RenewFailure{Group: name, Error: err.Error()})
+			continue
+		}
+		if triggered {
+			resp.Triggered = append(resp.Triggered, name)
+		}
+	}
+
+	return resp, nil
+}
+
+// Rollback serves the previous certificate of a group again
+func (s *Server) Rollback(ctx context.Context, req *RollbackRequest) (*RollbackResponse, error) {
+
+	b, err := s.kms.Rollback(ctx, req.Group)
+	switch {
+	case errors.Is(err, kms.ErrUnknownGroup):
+		return nil, status.Error(codes.NotFound, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	logger.Warn().Msgf("rolled back certificate of group %q to the one valid until %s", req.Group, b.Leaf.NotAfter.Local())
+
+	return &RollbackResponse{Certificate: certificate(req.Group, b)}, nil
+}
+
+// SetLogLevel changes the global log level
+func (s *Server) SetLogLevel(ctx context.Context, req *SetLogLevelRequest) (*SetLogLevelResponse, error) {
+
+	level := strings.ToLower(req.Level)
+	for _, l := range logLevels {
+		if l == level {
+			s.setLogLevel(level)
+			logger.Info().Msgf("log level set to %s", level)
+			return &SetLogLevelResponse{}, nil
+		}
+	}
+
+	return nil, status.Errorf(codes.InvalidArgument, "unknown log level %q, use one of %s",
+		req.Level, strings.Join(logLevels, ", "))
+}
+
+// SetLockdown enables or disables lockdown mode
+func (s *Server) SetLockdown(ctx context.Context, req *SetLockdownRequest) (*SetLockdownResponse, error) {
+
+	s.kms.SetLockdown(req.Enabled)
+
+	return &SetLockdownResponse{}, nil
+}
+
+// certificate describes the bundle served for a group, b may be nil
+func certificate(group string, b *certstore.Bundle) *Certificate {
+
+	c := &Certificate{Group: group}
+	if b == nil {
+		c.Error = "no certificate available"
+		return c
+	}
+	c.Domains = b.Leaf.DNSNames
+	c.Issuer = b.Leaf.Issuer.String()
+	c.NotAfter = timestamppb.New(b.Leaf.NotAfter)
+	c.Source = b.Source
+	c.Loaded = timestamppb.New(b.Loaded)
+
+	return c
+}
+
+// audit logs and records every admin call with the identity of the caller
+func (s *Server) audit(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+
+	resp, err := handler(ctx, req)
+
+	peer := caller(ctx)
+	event := logger.Info()
+	if err != nil {
+		event = logger.Warn().Err(err)
+	}
+	event.Str("peer", peer).Msgf("admin call %s", info.FullMethod)
+
+	e := audit.Event{Type: audit.Admin, Peer: peer, Method: info.FullMethod}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	s.events.Record(e)
+
+	return resp, err
+}
+
+// caller returns the subject of the client certificate, or the unix
+// socket for local callers
+func caller(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "unknown"
+	}
+	if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) > 0 {
+		return info.State.PeerCertificates[0].Subject.String()
+	}
+
+	return "unix socket"
+}
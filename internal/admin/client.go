@@ -0,0 +1,39 @@
+package admin
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Client calls the admin service of a running proxy
+type Client struct {
+	AdminClient
+
+	conn *grpc.ClientConn
+}
+
+// NewClient connects to the admin listener, a unix:// address uses the
+// socket, other addresses use TLS with the client certificate of tlsConfig
+func NewClient(address string, tlsConfig *tls.Config) (*Client, error) {
+
+	creds := credentials.NewTLS(tlsConfig)
+	if strings.HasPrefix(address, "unix://") {
+		creds = insecure.NewCredentials()
+	}
+
+	conn, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{AdminClient: NewAdminClient(conn), conn: conn}, nil
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
@@ -0,0 +1,122 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
+	"github.openresearch.com/talos-kms-proxy/internal/nodes"
+)
+
+// nodeStatus maps the registry status to the API enum
+var nodeStatus = map[nodes.Status]NodeStatus{
+	nodes.Pending:  NodeStatus_NODE_STATUS_PENDING,
+	nodes.Approved: NodeStatus_NODE_STATUS_APPROVED,
+	nodes.Revoked:  NodeStatus_NODE_STATUS_REVOKED,
+}
+
+// ListNodes returns the known nodes
+func (s *Server) ListNodes(ctx context.Context, req *ListNodesRequest) (*ListNodesResponse, error) {
+
+	resp := &ListNodesResponse{}
+	for _, n := range s.nodes.List() {
+		if req.Tenant != nil && n.Tenant != req.GetTenant() {
+			continue
+		}
+		if req.Status != NodeStatus_NODE_STATUS_UNSPECIFIED && nodeStatus[n.Status] != req.Status {
+			continue
+		}
+		resp.Nodes = append(resp.Nodes, node(n))
+	}
+
+	return resp, nil
+}
+
+// ApproveNode allows a pending or not yet known node to seal and unseal
+func (s *Server) ApproveNode(ctx context.Context, req *NodeRequest) (*NodeResponse, error) {
+	return s.changeNode(ctx, req, s.nodes.Approve)
+}
+
+// RevokeNode rejects all further requests of a node
+func (s *Server) RevokeNode(ctx context.Context, req *NodeRequest) (*NodeResponse, error) {
+	return s.changeNode(ctx, req, s.nodes.Revoke)
+}
+
+// UnrevokeNode approves a revoked node again
+func (s *Server) UnrevokeNode(ctx context.Context, req *NodeRequest) (*NodeResponse, error) {
+	return s.changeNode(ctx, req, s.nodes.Unrevoke)
+}
+
+// changeNode applies a status change to the node of the request
+func (s *Server) changeNode(ctx context.Context, req *NodeRequest,
+	change func(ctx context.Context, tenant, uuid string) (nodes.Node, error)) (*NodeResponse, error) {
+
+	if req.Uuid == "" {
+		return nil, status.Error(codes.InvalidArgument, "missing node uuid")
+	}
+
+	n, err := change(ctx, req.Tenant, req.Uuid)
+	switch {
+	case errors.Is(err, nodes.ErrRevoked), errors.Is(err, nodes.ErrNotRevoked):
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "could not update node registry: %v", err)
+	}
+
+	return &NodeResponse{Node: node(n)}, nil
+}
+
+// ListAuditEvents returns the most recent audit events
+func (s *Server) ListAuditEvents(ctx context.Context, req *ListAuditEventsRequest) (*ListAuditEventsResponse, error) {
+
+	since := req.Since.AsTime()
+	events := s.events.Recent(int(req.Limit), func(e audit.Event) bool {
+		return (req.Tenant == nil || e.Tenant == req.GetTenant()) &&
+			(req.NodeUuid == "" || e.Node == req.NodeUuid) &&
+			(req.Type == "" || e.Type == req.Type) &&
+			(req.Since == nil || !e.Time.Before(since))
+	})
+
+	resp := &ListAuditEventsResponse{}
+	for _, e := range events {
+		resp.Events = append(resp.Events, &AuditEvent{
+			Time:     timestamppb.New(e.Time),
+			Type:     e.Type,
+			Tenant:   e.Tenant,
+			NodeUuid: e.Node,
+			Peer:     e.Peer,
+			Method:   e.Method,
+			Error:    e.Error,
+		})
+	}
+
+	return resp, nil
+}
+
+// node converts a registry node to its API message
+func node(n nodes.Node) *Node {
+
+	return &Node{
+		Uuid:      n.UUID,
+		Tenant:    n.Tenant,
+		Status:    nodeStatus[n.Status],
+		FirstSeen: timestamp(n.FirstSeen),
+		LastSeen:  timestamp(n.LastSeen),
+		Address:   n.Address,
+	}
+}
+
+// timestamp converts t to its API message, the zero time is left unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+
+	if t.IsZero() {
+		return nil
+	}
+
+	return timestamppb.New(t)
+}
@@ -0,0 +1,304 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// DefaultSize is the number of events kept by default
+const DefaultSize = 1000
+
+// flushInterval is how often new events are written to storage
+const flushInterval = 10 * time.Second
+
+// Types of audit events
+const (
+	Seal   = "seal"
+	Unseal = "unseal"
+	Admin  = "admin"
+)
+
+// Event is a seal or unseal request of a node or an admin call
+type Event struct {
+	Time time.Time `json:"time"`
+	Type string    `json:"type"`
+	// Tenant is the server name of the tenant, empty for the default key
+	Tenant string `json:"tenant,omitempty"`
+	// Node is the UUID of the node of a seal or unseal request
+	Node string `json:"node,omitempty"`
+	// Peer is the remote address of the node, or the caller of an admin call
+	Peer string `json:"peer,omitempty"`
+	// Method is the full gRPC method of an admin call
+	Method string `json:"method,omitempty"`
+	// Error is empty if the request succeeded
+	Error string `json:"error,omitempty"`
+}
+
+// Log keeps the most recent events in memory and, if it has a storage,
+// writes them to storage in the background. The events of every tenant
+// are written to the storage of the tenant, admin calls to the storage of
+// the default key.
+type Log struct {
+	storage storage.Storage
+
+	mu     sync.Mutex
+	events []Event
+	next   int
+	full   bool
+	// tenants are loaded by Load in addition to the default key
+	tenants []string
+	// pending are the events of each tenant not written to storage yet
+	pending map[string][]Event
+}
+
+// file is the format of the persisted events
+type file struct {
+	Events []Event `json:"events"`
+}
+
+var (
+	logger = log.With().Str("service", "audit").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// New creates an audit log keeping the last size events
+// s persists the events, it may be nil to keep them in memory only.
+func New(size int, s storage.Storage) *Log {
+
+	if size <= 0 {
+		size = DefaultSize
+	}
+
+	return &Log{storage: s, events: make([]Event, size), pending: map[string][]Event{}}
+}
+
+// SetTenants sets the tenants whose events are read by Load
+func (l *Log) SetTenants(tenants []string) {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tenants = tenants
+}
+
+// Load reads the persisted events of the default key and all tenants,
+// e.g. to keep the history of a previous run
+func (l *Log) Load(ctx context.Context) error {
+
+	if l.storage == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var events []Event
+	for _, tenant := range append([]string{""}, l.tenants...) {
+		stored, err := l.read(ctx, tenant)
+		if err != nil {
+			if tenant != "" {
+				err = fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+			return err
+		}
+		events = append(events, stored...)
+	}
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+
+	if len(events) > len(l.events) {
+		events = events[len(events)-len(l.events):]
+	}
+	for _, e := range events {
+		l.add(e)
+	}
+
+	return nil
+}
+
+// Record adds an event, replacing the oldest one if the log is full
+func (l *Log) Record(e Event) {
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.add(e)
+	if l.storage != nil {
+		l.queue(e.Tenant, e)
+	}
+}
+
+// add puts the event into the ring buffer
+func (l *Log) add(e Event) {
+
+	l.events[l.next] = e
+	l.next = (l.next + 1) % len(l.events)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// queue adds events to the pending events of the tenant, dropping the
+// oldest ones beyond the size of the log
+func (l *Log) queue(tenant string, events ...Event) {
+
+	pending := append(l.pending[tenant], events...)
+	if over := len(pending) - len(l.events); over > 0 {
+		pending = pending[over:]
+	}
+	l.pending[tenant] = pending
+}
+
+// Recent returns up to limit events matching the filter, newest first
+// A limit of zero or less returns all matching events, a nil filter
+// matches all events.
+func (l *Log) Recent(limit int, filter func(Event) bool) []Event {
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := l.next
+	if l.full {
+		n = len(l.events)
+	}
+
+	var events []Event
+	for i := 1; i <= n; i++ {
+		e := l.events[(l.next-i+len(l.events))%len(l.events)]
+		if filter != nil && !filter(e) {
+			continue
+		}
+		events = append(events, e)
+		if limit > 0 && len(events) == limit {
+			break
+		}
+	}
+
+	return events
+}
+
+// Serve implements the suture service
+// It writes new events to storage periodically and once more on stop.
+func (l *Log) Serve(ctx context.Context) error {
+
+	if l.storage == nil {
+		<-ctx.Done()
+		return nil
+	}
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			ctx, cancel := context.WithTimeout(context.Background(), flushInterval)
+			defer cancel()
+			if err := l.Flush(ctx); err != nil {
+				logger.Error().Err(err).Msg("could not write audit events")
+			}
+			return nil
+		case <-ticker.C:
+			if err := l.Flush(ctx); err != nil {
+				logger.Error().Err(err).Msg("could not write audit events")
+			}
+		}
+	}
+}
+
+// Flush writes the pending events to the storage of their tenants
+func (l *Log) Flush(ctx context.Context) error {
+
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = map[string][]Event{}
+	l.mu.Unlock()
+
+	if l.storage == nil {
+		return nil
+	}
+
+	var errs []error
+	for tenant, events := range pending {
+		if err := l.flush(ctx, tenant, events); err != nil {
+			if tenant != "" {
+				err = fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// flush writes the pending events of a tenant. They are merged with the
+// stored events, which may have been written by another replica sharing
+// the storage, and the newest events up to the size of the log are kept.
+func (l *Log) flush(ctx context.Context, tenant string, pending []Event) error {
+
+	// requeue the events on failure, before the ones recorded meanwhile
+	requeue := func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.pending[tenant] = append(pending, l.pending[tenant]...)
+		l.queue(tenant)
+	}
+
+	events, err := l.read(ctx, tenant)
+	if err != nil {
+		requeue()
+		return err
+	}
+	events = append(events, pending...)
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.Before(events[j].Time) })
+	if over := len(events) - len(l.events); over > 0 {
+		events = events[over:]
+	}
+
+	data, err := json.MarshalIndent(file{Events: events}, "", "  ")
+	if err != nil {
+		requeue()
+		return err
+	}
+	if err := storage.ForTenant(l.storage, tenant).Put(ctx, storage.AuditKey, data); err != nil {
+		requeue()
+		return err
+	}
+
+	return nil
+}
+
+// read returns the stored events of the tenant, oldest first
+func (l *Log) read(ctx context.Context, tenant string) ([]Event, error) {
+
+	data, err := storage.ForTenant(l.storage, tenant).Get(ctx, storage.AuditKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("invalid audit log: %w", err)
+	}
+
+	return f.Events, nil
+}
+
+func (l *Log) String() string {
+	return "audit log"
+}
@@ -0,0 +1,144 @@
+package audit
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+func TestLog(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		recorded int
+		limit    int
+		filter   func(Event) bool
+		want     []string
+	}{
+		{name: "empty", recorded: 0, want: nil},
+		{name: "newest first", recorded: 3, want: []string{"node-2", "node-1", "node-0"}},
+		{name: "limit", recorded: 3, limit: 2, want: []string{"node-2", "node-1"}},
+		{name: "oldest replaced", recorded: 6, want: []string{"node-5", "node-4", "node-3", "node-2"}},
+		{
+			name:     "filter",
+			recorded: 6,
+			filter:   func(e Event) bool { return e.Type == Unseal },
+			want:     []string{"node-5", "node-3"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			l := New(4, nil)
+			for i := range tt.recorded {
+				typ := Seal
+				if i%2 == 1 {
+					typ = Unseal
+				}
+				l.Record(Event{Type: typ, Node: fmt.Sprintf("node-%d", i)})
+			}
+
+			var got []string
+			for _, e := range l.Recent(tt.limit, tt.filter) {
+				if e.Time.IsZero() {
+					t.Fatal("event without time")
+				}
+				got = append(got, e.Node)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPersist(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.NewLocal(t.TempDir())
+
+	// another replica sharing the storage wrote an event meanwhile
+	start := time.Now()
+	other := New(3, store)
+	other.Record(Event{Time: start.Add(2 * time.Second), Type: Seal, Node: "other"})
+	if err := other.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	l := New(3, store)
+	for i := range 3 {
+		l.Record(Event{Time: start.Add(time.Duration(i) * time.Second), Type: Unseal, Node: fmt.Sprintf("node-%d", i)})
+	}
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a restart keeps the newest events of both replicas
+	restarted := New(3, store)
+	if err := restarted.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range restarted.Recent(0, nil) {
+		got = append(got, e.Node)
+	}
+	if want := []string{"node-2", "other", "node-1"}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// loaded events are not written again
+	if err := restarted.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.pending) != 0 {
+		t.Fatalf("got %d pending events after flush", len(restarted.pending))
+	}
+}
+
+func TestTenantStreams(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.NewLocal(t.TempDir())
+
+	l := New(10, store)
+	l.Record(Event{Type: Admin, Method: "/admin/Status"})
+	l.Record(Event{Type: Seal, Tenant: "cluster-b.example.com", Node: "node-b"})
+	if err := l.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// every tenant has its own audit log in the storage
+	for _, tt := range []struct{ tenant, want string }{
+		{tenant: "", want: "/admin/Status"},
+		{tenant: "cluster-b.example.com", want: "node-b"},
+	} {
+		events, err := l.read(ctx, tt.tenant)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || (events[0].Method != tt.want && events[0].Node != tt.want) {
+			t.Fatalf("tenant %q: got %+v, want the event of %s", tt.tenant, events, tt.want)
+		}
+	}
+
+	// tenants that are not configured are not loaded
+	restarted := New(10, store)
+	if err := restarted.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(restarted.Recent(0, nil)); got != 1 {
+		t.Fatalf("got %d events without tenants, want 1", got)
+	}
+	restarted = New(10, store)
+	restarted.SetTenants([]string{"cluster-b.example.com"})
+	if err := restarted.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(restarted.Recent(0, nil)); got != 2 {
+		t.Fatalf("got %d events with tenants, want 2", got)
+	}
+}
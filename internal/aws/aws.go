@@ -6,13 +6,17 @@ import (
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
 	awskms "github.com/aws/aws-sdk-go/service/kms"
 )
 
 // AWS implaments the AWS KMS client
 type AWS struct {
 	Svc   *awskms.KMS
+	sess  *session.Session
 	KeyID string
+	// PinKey restricts decryption to ciphertexts created with KeyID
+	PinKey bool
 }
 
 // NewAWS initializes a new AWS KMS client
@@ -20,21 +24,55 @@ func NewAWS(svc *awskms.KMS) *AWS {
 	return &AWS{Svc: svc}
 }
 
-// CreateKey creates a new KMS key in AWS with metadata
-func (a *AWS) CreateKey(keyname string) (string, error) {
-	result, err := a.Svc.CreateKey(&awskms.CreateKeyInput{
-		Tags: []*awskms.Tag{
-			{
-				TagKey:   aws.String("name"),
-				TagValue: aws.String(keyname),
-			},
-		},
-	})
+// New creates an AWS KMS client for the given key ID and checks that
+// the key exists, credentials are taken from the environment
+func New(keyID string) (*AWS, error) {
+
+	a, err := NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	// assign the keyID to use
+	a.KeyID = keyID
+	if err := a.CheckKeyExists(); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// NewSession creates an AWS KMS client without a key, for managing keys
+// credentials are taken from the environment
+func NewSession() (*AWS, error) {
+
+	// create aws client session
+	sess, err := session.NewSession(&aws.Config{Region: aws.String("eu-west-1")})
 	if err != nil {
-		return "", fmt.Errorf("could not create aws kms key: %w", err)
+		return nil, err
+	}
+
+	a := NewAWS(awskms.New(sess))
+	a.sess = sess
+
+	return a, nil
+}
+
+// Session returns the AWS session of the client
+func (a *AWS) Session() *session.Session {
+	return a.sess
+}
+
+// WithKey returns a client sharing the session that encrypts with keyID
+// and only decrypts ciphertexts created with that key
+func (a *AWS) WithKey(keyID string) (*AWS, error) {
+
+	k := &AWS{Svc: a.Svc, sess: a.sess, KeyID: keyID, PinKey: true}
+	if err := k.CheckKeyExists(); err != nil {
+		return nil, err
 	}
 
-	return *result.KeyMetadata.KeyId, nil
+	return k, nil
 }
 
 // EncryptData encrypts the `data` payload with the preconfigured
@@ -54,9 +92,14 @@ func (a *AWS) EncryptData(data string, ctx context.Context) (*awskms.EncryptOutp
 // DecryptData decrypts the `data` payload with AWS KMS key and retuns the
 // decrypted payload
 func (a *AWS) DecryptData(data string, ctx context.Context) (*awskms.DecryptOutput, error) {
-	result, err := a.Svc.DecryptWithContext(ctx, &awskms.DecryptInput{
+	input := &awskms.DecryptInput{
 		CiphertextBlob: []byte(data),
-	})
+	}
+	if a.PinKey {
+		input.KeyId = &a.KeyID
+	}
+
+	result, err := a.Svc.DecryptWithContext(ctx, input)
 	if err != nil {
 		return nil, fmt.Errorf("could not decrypt data: %w", err)
 	}
@@ -64,6 +107,28 @@ func (a *AWS) DecryptData(data string, ctx context.Context) (*awskms.DecryptOutp
 	return result, nil
 }
 
+// Seal encrypts the plaintext with the preconfigured AWS KMS key
+// and implements the seal.Sealer interface
+func (a *AWS) Seal(ctx context.Context, plaintext []byte) ([]byte, error) {
+	result, err := a.EncryptData(string(plaintext), ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.CiphertextBlob, nil
+}
+
+// Unseal decrypts a ciphertext created by Seal
+// and implements the seal.Sealer interface
+func (a *AWS) Unseal(ctx context.Context, ciphertext []byte) ([]byte, error) {
+	result, err := a.DecryptData(string(ciphertext), ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Plaintext, nil
+}
+
 // CheckKeyExists checks if the provided KeyID exists in AWS
 // returns error if the key is invalid or not found
 func (a *AWS) CheckKeyExists() error {
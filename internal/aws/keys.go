@@ -0,0 +1,185 @@
+package oraws
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	awskms "github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// KeyOptions are the settings of a new KMS key
+type KeyOptions struct {
+	// Name is stored in the "name" tag
+	Name        string
+	Alias       string
+	Description string
+	Tags        map[string]string
+	// Policy is the JSON key policy, empty uses the AWS default policy
+	Policy string
+	// RotationPeriod enables automatic rotation of the key material,
+	// zero disables it
+	RotationPeriod time.Duration
+}
+
+// KeyInfo describes a KMS key
+type KeyInfo struct {
+	KeyID           string
+	ARN             string
+	Description     string
+	State           string
+	Enabled         bool
+	Created         time.Time
+	Manager         string
+	Spec            string
+	Usage           string
+	RotationEnabled bool
+	RotationPeriod  time.Duration
+	NextRotation    time.Time
+	Aliases         []string
+}
+
+// CreateKey creates a new KMS key in AWS with metadata and returns its ID
+func (a *AWS) CreateKey(ctx context.Context, opts KeyOptions) (string, error) {
+
+	input := &awskms.CreateKeyInput{}
+	if opts.Description != "" {
+		input.Description = aws.String(opts.Description)
+	}
+	if opts.Policy != "" {
+		input.Policy = aws.String(opts.Policy)
+	}
+
+	tags := map[string]string{}
+	for k, v := range opts.Tags {
+		tags[k] = v
+	}
+	if opts.Name != "" {
+		tags["name"] = opts.Name
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		input.Tags = append(input.Tags, &awskms.Tag{
+			TagKey:   aws.String(k),
+			TagValue: aws.String(tags[k]),
+		})
+	}
+
+	result, err := a.Svc.CreateKeyWithContext(ctx, input)
+	if err != nil {
+		return "", fmt.Errorf("could not create aws kms key: %w", err)
+	}
+	keyID := *result.KeyMetadata.KeyId
+
+	if opts.Alias != "" {
+		if _, err := a.Svc.CreateAliasWithContext(ctx, &awskms.CreateAliasInput{
+			AliasName:   aws.String(aliasName(opts.Alias)),
+			TargetKeyId: aws.String(keyID),
+		}); err != nil {
+			return keyID, fmt.Errorf("could not create alias for key %s: %w", keyID, err)
+		}
+	}
+
+	if opts.RotationPeriod > 0 {
+		if err := a.EnableKeyRotation(ctx, keyID, opts.RotationPeriod); err != nil {
+			return keyID, err
+		}
+	}
+
+	return keyID, nil
+}
+
+// EnableKeyRotation enables automatic rotation of the key material
+// the period is rounded to days, zero uses the AWS default of one year
+func (a *AWS) EnableKeyRotation(ctx context.Context, keyID string, period time.Duration) error {
+
+	input := &awskms.EnableKeyRotationInput{
+		KeyId: aws.String(keyID),
+	}
+	if days := int64(period / (24 * time.Hour)); days > 0 {
+		input.RotationPeriodInDays = aws.Int64(days)
+	}
+
+	if _, err := a.Svc.EnableKeyRotationWithContext(ctx, input); err != nil {
+		return fmt.Errorf("could not enable rotation of key %s: %w", keyID, err)
+	}
+
+	return nil
+}
+
+// DescribeKey returns the state, rotation status and aliases of a key
+func (a *AWS) DescribeKey(ctx context.Context, keyID string) (*KeyInfo, error) {
+
+	desc, err := a.Svc.DescribeKeyWithContext(ctx, &awskms.DescribeKeyInput{
+		KeyId: aws.String(keyID),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not describe key %s: %w", keyID, err)
+	}
+	meta := desc.KeyMetadata
+
+	info := &KeyInfo{
+		KeyID:       aws.StringValue(meta.KeyId),
+		ARN:         aws.StringValue(meta.Arn),
+		Description: aws.StringValue(meta.Description),
+		State:       aws.StringValue(meta.KeyState),
+		Enabled:     aws.BoolValue(meta.Enabled),
+		Created:     aws.TimeValue(meta.CreationDate),
+		Manager:     aws.StringValue(meta.KeyManager),
+		Spec:        aws.StringValue(meta.KeySpec),
+		Usage:       aws.StringValue(meta.KeyUsage),
+	}
+
+	// rotation is only supported for symmetric customer managed keys
+	rotation, err := a.Svc.GetKeyRotationStatusWithContext(ctx, &awskms.GetKeyRotationStatusInput{
+		KeyId: meta.KeyId,
+	})
+	if err == nil {
+		info.RotationEnabled = aws.BoolValue(rotation.KeyRotationEnabled)
+		info.RotationPeriod = time.Duration(aws.Int64Value(rotation.RotationPeriodInDays)) * 24 * time.Hour
+		info.NextRotation = aws.TimeValue(rotation.NextRotationDate)
+	}
+
+	err = a.Svc.ListAliasesPagesWithContext(ctx, &awskms.ListAliasesInput{
+		KeyId: meta.KeyId,
+	}, func(page *awskms.ListAliasesOutput, last bool) bool {
+		for _, alias := range page.Aliases {
+			info.Aliases = append(info.Aliases, aws.StringValue(alias.AliasName))
+		}
+		return true
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list aliases of key %s: %w", keyID, err)
+	}
+
+	return info, nil
+}
+
+// AccountID returns the AWS account of the credentials
+func (a *AWS) AccountID(ctx context.Context) (string, error) {
+
+	identity, err := sts.New(a.sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", fmt.Errorf("could not get caller identity: %w", err)
+	}
+
+	return aws.StringValue(identity.Account), nil
+}
+
+// aliasName adds the alias/ prefix required by AWS
+func aliasName(alias string) string {
+
+	if strings.HasPrefix(alias, "alias/") {
+		return alias
+	}
+
+	return "alias/" + alias
+}
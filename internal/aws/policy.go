@@ -0,0 +1,57 @@
+package oraws
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"text/template"
+)
+
+//go:embed keypolicy.json.tmpl
+var defaultKeyPolicy string
+
+// PolicyParams are the values available to key policy templates
+type PolicyParams struct {
+	// AccountID is the AWS account owning the key, the account root keeps
+	// full access so that the key cannot become unmanageable
+	AccountID string
+	// Admins are the principal ARNs allowed to administer the key
+	Admins []string
+	// Users are the principal ARNs of the proxy, allowed to encrypt and
+	// decrypt with the key
+	Users []string
+}
+
+// KeyPolicy renders a key policy template, an empty template selects the
+// default policy. The result is checked to be valid JSON.
+func KeyPolicy(tmpl string, params PolicyParams) (string, error) {
+
+	if tmpl == "" {
+		if len(params.Users) == 0 {
+			return "", errors.New("the default key policy requires at least one proxy principal")
+		}
+		tmpl = defaultKeyPolicy
+	}
+
+	t, err := template.New("policy").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("invalid key policy template: %w", err)
+	}
+
+	var b strings.Builder
+	if err := t.Execute(&b, params); err != nil {
+		return "", fmt.Errorf("could not render key policy: %w", err)
+	}
+	if !json.Valid([]byte(b.String())) {
+		return "", errors.New("rendered key policy is not valid JSON")
+	}
+
+	return b.String(), nil
+}
@@ -0,0 +1,419 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// Version is the archive format version written by Create
+const Version = 1
+
+// format identifies backup archives in the header line
+const format = "talos-kms-backup"
+
+// manifestName is the first entry of the archive
+const manifestName = "manifest.json"
+
+// header is the plaintext first line of an archive, it carries the data
+// key sealed with the key backend and is authenticated with the content
+type header struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+	Key     []byte `json:"key"`
+}
+
+// Manifest lists the files of an archive with their checksums
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Creator string    `json:"creator"`
+	Files   []File    `json:"files"`
+}
+
+// File is an entry of the manifest
+type File struct {
+	Name   string      `json:"name"`
+	Size   int64       `json:"size"`
+	Mode   fs.FileMode `json:"mode"`
+	SHA256 string      `json:"sha256"`
+}
+
+// Archive is a decrypted backup whose checksums have been verified
+type Archive struct {
+	Manifest Manifest
+	files    map[string][]byte
+}
+
+// Create packages the regular files of dir into an archive encrypted with
+// a data key sealed by the key backend. Lock files and hidden temporary
+// files are skipped.
+func Create(ctx context.Context, sealer seal.Sealer, dir, creator string) ([]byte, *Manifest, error) {
+
+	if sealer == nil {
+		return nil, nil, errors.New("backups require a key backend")
+	}
+
+	manifest := &Manifest{Version: Version, Created: time.Now().UTC(), Creator: creator}
+	files := map[string][]byte{}
+	err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(d.Name(), ".lock") || strings.HasPrefix(d.Name(), ".") {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		files[name] = data
+		manifest.Files = append(manifest.Files, File{
+			Name:   name,
+			Size:   int64(len(data)),
+			Mode:   info.Mode().Perm(),
+			SHA256: checksum(data),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(manifest.Files) == 0 {
+		return nil, nil, fmt.Errorf("no files found in %s", dir)
+	}
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+
+	// tar the manifest and the files, then gzip them
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	mdata, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := writeEntry(tw, manifestName, 0600, mdata); err != nil {
+		return nil, nil, err
+	}
+	for _, f := range manifest.Files {
+		if err := writeEntry(tw, f.Name, f.Mode, files[f.Name]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, nil, err
+	}
+
+	// encrypt with a fresh data key, the key backend seals the data key
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, nil, err
+	}
+	sealed, err := sealer.Seal(ctx, key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not seal backup key: %w", err)
+	}
+	line, err := json.Marshal(header{Format: format, Version: Version, Key: sealed})
+	if err != nil {
+		return nil, nil, err
+	}
+	line = append(line, '\n')
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, nil, err
+	}
+	out := append(line, nonce...)
+	out = aead.Seal(out, nonce, buf.Bytes(), line)
+
+	return out, manifest, nil
+}
+
+// Open decrypts an archive and verifies the manifest and the checksums
+// of all files
+func Open(ctx context.Context, sealer seal.Sealer, data []byte) (*Archive, error) {
+
+	if sealer == nil {
+		return nil, errors.New("backups require a key backend")
+	}
+
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, errors.New("not a backup archive")
+	}
+	line, body := data[:i+1], data[i+1:]
+	var h header
+	if err := json.Unmarshal(line, &h); err != nil || h.Format != format {
+		return nil, errors.New("not a backup archive")
+	}
+	if h.Version != Version {
+		return nil, fmt.Errorf("unsupported backup version %d", h.Version)
+	}
+
+	key, err := sealer.Unseal(ctx, h.Key)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal backup key: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(body) < aead.NonceSize() {
+		return nil, errors.New("backup archive is truncated")
+	}
+	plaintext, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], line)
+	if err != nil {
+		return nil, errors.New("backup archive is corrupted or was modified")
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(plaintext))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(bufio.NewReader(gz))
+
+	a := &Archive{files: map[string][]byte{}}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if !validName(hdr.Name) {
+			return nil, fmt.Errorf("invalid file name %q in backup", hdr.Name)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := a.files[hdr.Name]; ok {
+			return nil, fmt.Errorf("duplicate file %s in backup", hdr.Name)
+		}
+		a.files[hdr.Name] = content
+	}
+
+	mdata, ok := a.files[manifestName]
+	if !ok {
+		return nil, errors.New("backup has no manifest")
+	}
+	delete(a.files, manifestName)
+	if err := json.Unmarshal(mdata, &a.Manifest); err != nil {
+		return nil, fmt.Errorf("invalid backup manifest: %w", err)
+	}
+	if a.Manifest.Version != Version {
+		return nil, fmt.Errorf("unsupported manifest version %d", a.Manifest.Version)
+	}
+
+	// every file must be listed and match its checksum
+	if len(a.Manifest.Files) != len(a.files) {
+		return nil, fmt.Errorf("backup has %d files but the manifest lists %d", len(a.files), len(a.Manifest.Files))
+	}
+	for _, f := range a.Manifest.Files {
+		content, ok := a.files[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("%s: missing from backup", f.Name)
+		}
+		if int64(len(content)) != f.Size || checksum(content) != f.SHA256 {
+			return nil, fmt.Errorf("%s: checksum mismatch", f.Name)
+		}
+	}
+
+	return a, nil
+}
+
+// Validate checks the content of the archive: account states, the node
+// registry and the audit log must be valid JSON and every certificate
+// must match its private key
+func (a *Archive) Validate(ctx context.Context, sealer seal.Sealer) error {
+
+	for _, f := range a.Manifest.Files {
+		dir, base := path.Split(f.Name)
+		switch {
+		case base == storage.StateKey:
+			if !json.Valid(a.files[f.Name]) {
+				return fmt.Errorf("%s: invalid account state", f.Name)
+			}
+		case base == storage.NodesKey, base == storage.AuditKey:
+			if !json.Valid(a.files[f.Name]) {
+				return fmt.Errorf("%s: invalid JSON", f.Name)
+			}
+		case strings.HasSuffix(f.Name, storage.CertKey), strings.HasSuffix(f.Name, storage.PrevCertKey):
+			keyName := dir + strings.Replace(base, "cert", "key", 1)
+			key, ok := a.files[keyName]
+			if !ok {
+				return fmt.Errorf("%s: private key %s missing", f.Name, keyName)
+			}
+			key, _, err := seal.Decode(ctx, sealer, key)
+			if err != nil {
+				return fmt.Errorf("%s: %w", keyName, err)
+			}
+			if _, err := tls.X509KeyPair(a.files[f.Name], key); err != nil {
+				return fmt.Errorf("%s: %w", f.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Restore writes the archive to a new directory next to dir and swaps
+// it into place. An existing dir is kept and its new path is returned,
+// unless it holds nothing but the lock file.
+func (a *Archive) Restore(dir string) (string, error) {
+
+	dir = filepath.Clean(dir)
+	if err := os.MkdirAll(filepath.Dir(dir), 0750); err != nil {
+		return "", err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), filepath.Base(dir)+".restore-")
+	if err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp, 0750); err != nil {
+		return "", err
+	}
+
+	for _, f := range a.Manifest.Files {
+		p := filepath.Join(tmp, filepath.FromSlash(f.Name))
+		if err := storage.WriteFile(p, a.files[f.Name]); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	}
+
+	// a workdir holding nothing but the lock, e.g. created by the caller
+	// just to lock it, is restored in place and keeps its lock
+	empty, err := onlyLock(dir)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if empty {
+		return "", moveEntries(tmp, dir)
+	}
+
+	var old string
+	if _, err := os.Stat(dir); err == nil {
+		old = fmt.Sprintf("%s.%s.old", dir, time.Now().UTC().Format("20060102T150405Z"))
+		if err := os.Rename(dir, old); err != nil {
+			os.RemoveAll(tmp)
+			return "", err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		os.RemoveAll(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return old, err
+	}
+
+	return old, nil
+}
+
+// onlyLock reports whether dir exists and holds no file besides the lock
+func onlyLock(dir string) (bool, error) {
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, e := range entries {
+		if e.Name() != storage.LockName {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// moveEntries moves the entries of src into dst and removes src
+func moveEntries(src, dst string) error {
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.Rename(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.Remove(src)
+}
+
+func writeEntry(tw *tar.Writer, name string, mode fs.FileMode, data []byte) error {
+
+	if err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    int64(mode.Perm()),
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	}); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validName rejects absolute paths and names escaping the directory
+func validName(name string) bool {
+	return name != "" && !path.IsAbs(name) && path.Clean(name) == name && !strings.HasPrefix(name, "../") && name != ".."
+}
@@ -0,0 +1,395 @@
+package ca
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+const (
+	// caLifetime is the validity of the root CA certificate
+	caLifetime = 10 * 365 * 24 * time.Hour
+
+	// DefaultCertLifetime is the default validity of the serving certificate
+	DefaultCertLifetime = 90 * 24 * time.Hour
+
+	// renewFraction is the share of the serving certificate lifetime after
+	// which it is renewed
+	renewFraction = 2.0 / 3.0
+
+	// retryDelay is the time to wait after a failed issuance
+	retryDelay = time.Minute
+)
+
+// Config holds the settings of the private CA
+type Config struct {
+	// Names are the DNS names and IP addresses of the serving certificate
+	Names   []string
+	Storage storage.Storage
+	// Sealer encrypts the CA key and the serving certificate private key
+	// at rest, nil stores them in plaintext
+	Sealer seal.Sealer
+	// CertLifetime is the validity of the serving certificate
+	CertLifetime time.Duration
+}
+
+// CA is a private certificate authority issuing the serving certificate
+// of the kms server, for clusters that cannot reach a public ACME server
+type CA struct {
+	names     []string
+	storage   storage.Storage
+	sealer    seal.Sealer
+	lifetime  time.Duration
+	certStore *certstore.Store
+	caCert    *x509.Certificate
+	caKey     crypto.Signer
+}
+
+// errNoCA is returned by loadCA if no root CA has been created yet
+var errNoCA = errors.New("no root ca found")
+
+var (
+	logger = log.With().Str("service", "ca").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// New creates a new private CA service
+func New(cfg Config, certStore *certstore.Store) *CA {
+
+	if cfg.CertLifetime <= 0 {
+		cfg.CertLifetime = DefaultCertLifetime
+	}
+
+	return &CA{
+		names:     cfg.Names,
+		storage:   cfg.Storage,
+		sealer:    cfg.Sealer,
+		lifetime:  cfg.CertLifetime,
+		certStore: certStore,
+	}
+}
+
+// Serve implements the suture service
+// It loads or creates the root CA and issues and rotates the serving
+// certificate
+func (c *CA) Serve(ctx context.Context) error {
+
+	logger.Info().Msg("starting")
+
+	if err := c.loadCA(ctx); errors.Is(err, errNoCA) {
+		if err := c.createCA(ctx); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// reuse the current serving certificate if it is still valid
+	renewAt := time.Now()
+	if leaf, err := c.currentCert(ctx); err != nil {
+		logger.Info().Msgf("issuing new serving certificate: %v", err)
+	} else {
+		renewAt = certstore.RenewalTime(leaf, renewFraction)
+	}
+
+	timer := time.NewTimer(time.Until(renewAt))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			leaf, err := c.issue(ctx)
+			if err != nil {
+				logger.Error().Err(err).Msgf("could not issue serving certificate, retrying in %s", retryDelay)
+				timer.Reset(retryDelay)
+				continue
+			}
+			renewAt = certstore.RenewalTime(leaf, renewFraction)
+			timer.Reset(time.Until(renewAt))
+			logger.Info().Msgf("next certificate renewal at: %s", renewAt.Local())
+		}
+	}
+}
+
+// loadCA reads the root CA certificate and key from storage
+// It returns errNoCA only if both are missing. A root CA with only one of
+// them stored is an error, replacing it would break the trust bundle in
+// the machine configs of every node.
+func (c *CA) loadCA(ctx context.Context) error {
+
+	crt, crtErr := c.storage.Get(ctx, storage.CACertKey)
+	if crtErr != nil && !errors.Is(crtErr, os.ErrNotExist) {
+		return crtErr
+	}
+	data, keyErr := c.storage.Get(ctx, storage.CAKeyKey)
+	if keyErr != nil && !errors.Is(keyErr, os.ErrNotExist) {
+		return keyErr
+	}
+	switch {
+	case crtErr != nil && keyErr != nil:
+		return errNoCA
+	case crtErr != nil:
+		return fmt.Errorf("root ca key found without certificate %s, restore it or remove the key to create a new root ca", storage.CACertKey)
+	case keyErr != nil:
+		return fmt.Errorf("root ca certificate found without key %s, restore it or remove the certificate to create a new root ca", storage.CAKeyKey)
+	}
+
+	caCert, err := certstore.ParseLeaf(crt)
+	if err != nil {
+		return err
+	}
+	pk, _, err := seal.Decode(ctx, c.sealer, data)
+	if err != nil {
+		return fmt.Errorf("could not unseal ca key: %w", err)
+	}
+	caKey, err := parseKey(pk)
+	if err != nil {
+		return err
+	}
+
+	c.caCert, c.caKey = caCert, caKey
+	logger.Debug().Msgf("loaded root ca %s", caCert.Subject)
+
+	return nil
+}
+
+// createCA creates a new root CA and writes it to storage
+func (c *CA) createCA(ctx context.Context) error {
+
+	logger.Info().Msg("creating new root ca")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "Talos KMS Proxy Root CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caLifetime),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return err
+	}
+
+	pk, err := encodeKey(key)
+	if err != nil {
+		return err
+	}
+	sealed, err := seal.Encode(ctx, c.sealer, pk)
+	if err != nil {
+		return fmt.Errorf("could not seal ca key: %w", err)
+	}
+
+	// write the key first, so that a certificate is never stored without it
+	if err := storage.PutAll(ctx, c.storage,
+		storage.Object{Name: storage.CAKeyKey, Data: sealed},
+		storage.Object{Name: storage.CACertKey, Data: encodeCert(der)},
+	); err != nil {
+		return err
+	}
+
+	c.caCert, c.caKey = caCert, key
+
+	return nil
+}
+
+// currentCert returns the stored serving certificate if it was issued by
+// the CA for the configured names and is not due for renewal, and passes
+// it on to the kms server
+func (c *CA) currentCert(ctx context.Context) (*x509.Certificate, error) {
+
+	crt, err := c.storage.Get(ctx, storage.CertKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := certstore.ParseLeaf(crt)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := leaf.CheckSignatureFrom(c.caCert); err != nil {
+		return nil, fmt.Errorf("certificate not issued by the current ca: %w", err)
+	}
+	if !slices.Equal(certstore.CertNames(leaf), certstore.SortedNames(c.names)) {
+		return nil, fmt.Errorf("certificate names %v do not match configured names", certstore.CertNames(leaf))
+	}
+	if time.Now().After(certstore.RenewalTime(leaf, renewFraction)) {
+		return nil, errors.New("certificate is due for renewal")
+	}
+
+	data, err := c.storage.Get(ctx, storage.KeyKey)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, err := seal.Decode(ctx, c.sealer, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal private key: %w", err)
+	}
+
+	bundle, err := c.validate(crt, pk)
+	if err != nil {
+		return nil, err
+	}
+	c.certStore.Set(bundle)
+
+	return leaf, nil
+}
+
+// issue creates a new serving certificate signed by the CA, writes it to
+// storage and passes it on to the kms server
+func (c *CA) issue(ctx context.Context) (*x509.Certificate, error) {
+
+	logger.Debug().Msgf("issuing serving certificate for %s", c.names)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	serial, err := serialNumber()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    now.Add(-5 * time.Minute),
+		NotAfter:     now.Add(c.lifetime),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, name := range c.names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	if len(template.DNSNames) > 0 {
+		template.Subject.CommonName = template.DNSNames[0]
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, c.caCert, key.Public(), c.caKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	// the chain contains the serving certificate followed by the root
+	crt := append(encodeCert(der), encodeCert(c.caCert.Raw)...)
+	pk, err := encodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// validate the new certificate before it replaces the stored and the
+	// live one
+	bundle, err := c.validate(crt, pk)
+	if err != nil {
+		return nil, fmt.Errorf("rejected new certificate: %w", err)
+	}
+
+	sealed, err := seal.Encode(ctx, c.sealer, pk)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal private key: %w", err)
+	}
+	if err := storage.PutAll(ctx, c.storage,
+		storage.Object{Name: storage.KeyKey, Data: sealed},
+		storage.Object{Name: storage.CertKey, Data: crt},
+	); err != nil {
+		return nil, err
+	}
+
+	c.certStore.Set(bundle)
+	logger.Info().Msgf("successfully issued serving certificate for: %s", c.names)
+
+	return leaf, nil
+}
+
+// validate parses the certificate and private key and checks them like
+// any other certificate source, with the root CA as the only trusted root
+func (c *CA) validate(crt, pk []byte) (*certstore.Bundle, error) {
+
+	bundle, err := certstore.NewBundle(crt, pk, "ca")
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(c.caCert)
+	if err := certstore.Validate(bundle, certstore.ValidateOptions{Names: c.names, Roots: roots}); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// serialNumber returns a random 128 bit serial number
+func serialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func encodeCert(der []byte) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func encodeKey(key *ecdsa.PrivateKey) ([]byte, error) {
+
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), nil
+}
+
+func parseKey(data []byte) (crypto.Signer, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no private key found in pem data")
+	}
+
+	return x509.ParseECPrivateKey(block.Bytes)
+}
@@ -0,0 +1,40 @@
+package ca
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// Bundle returns the PEM encoded root CA certificate from storage
+func Bundle(ctx context.Context, store storage.Storage) ([]byte, error) {
+
+	crt, err := store.Get(ctx, storage.CACertKey)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ca certificate: %w", err)
+	}
+	if _, err := certstore.ParseLeaf(crt); err != nil {
+		return nil, err
+	}
+
+	return crt, nil
+}
+
+// TalosTrustedRoots renders the CA bundle as a Talos TrustedRootsConfig
+// document that can be appended to the machine config
+func TalosTrustedRoots(name string, bundle []byte) string {
+
+	var b strings.Builder
+	b.WriteString("apiVersion: v1alpha1\n")
+	b.WriteString("kind: TrustedRootsConfig\n")
+	fmt.Fprintf(&b, "name: %s\n", name)
+	b.WriteString("certificates: |-\n")
+	for _, line := range strings.Split(strings.TrimSpace(string(bundle)), "\n") {
+		fmt.Fprintf(&b, "  %s\n", line)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,177 @@
+package certstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNoCertificate is returned by GetCertificate before the first
+// certificate has been stored
+var ErrNoCertificate = errors.New("no server certificate available yet")
+
+// Bundle is a parsed server certificate ready to be used for handshakes
+type Bundle struct {
+	// Certificate is the parsed key pair including the leaf and the
+	// OCSP staple
+	Certificate *tls.Certificate
+	// Leaf is the parsed server certificate
+	Leaf *x509.Certificate
+	// CertPEM and KeyPEM are the PEM encoded certificate chain and key
+	CertPEM []byte
+	KeyPEM  []byte
+	// Source names the service that provided the certificate
+	Source string
+	// Loaded is the time the bundle was created
+	Loaded time.Time
+}
+
+// NewBundle parses a PEM encoded certificate chain and private key
+func NewBundle(certPEM, keyPEM []byte, source string) (*Bundle, error) {
+
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Bundle{
+		Certificate: &cert,
+		Leaf:        cert.Leaf,
+		CertPEM:     certPEM,
+		KeyPEM:      keyPEM,
+		Source:      source,
+		Loaded:      time.Now(),
+	}, nil
+}
+
+// Store holds the current server certificate
+// The bundle is swapped atomically, so that TLS handshakes never block
+// and never parse PEM data. Subscribers are notified of every change.
+type Store struct {
+	current  atomic.Pointer[Bundle]
+	previous atomic.Pointer[Bundle]
+
+	mu          sync.Mutex
+	subscribers map[chan *Bundle]struct{}
+}
+
+// New creates an empty certificate store
+func New() *Store {
+	return &Store{subscribers: map[chan *Bundle]struct{}{}}
+}
+
+// Current returns the current bundle or nil if none has been stored yet
+func (s *Store) Current() *Bundle {
+	return s.current.Load()
+}
+
+// Previous returns the bundle replaced by the last Set, which is the
+// rollback target, or nil if there is none
+func (s *Store) Previous() *Bundle {
+	return s.previous.Load()
+}
+
+// Set replaces the current bundle and notifies the subscribers
+// the replaced bundle is kept as rollback target
+func (s *Store) Set(b *Bundle) {
+
+	if old := s.current.Swap(b); old != nil {
+		s.previous.Store(old)
+	}
+	s.notify(b)
+}
+
+// Rollback restores the previous bundle
+func (s *Store) Rollback() error {
+
+	prev := s.previous.Load()
+	if prev == nil {
+		return errors.New("no previous certificate to roll back to")
+	}
+	s.Set(prev)
+
+	return nil
+}
+
+// Staple attaches an OCSP response to the bundle if it is still the
+// current one and returns the stapled bundle, or nil if the bundle has
+// been replaced meanwhile. The bundle is copied, so that handshakes in
+// flight keep using the old staple. Subscribers are not notified.
+func (s *Store) Staple(b *Bundle, staple []byte) *Bundle {
+
+	cert := *b.Certificate
+	cert.OCSPStaple = staple
+
+	stapled := *b
+	stapled.Certificate = &cert
+
+	if !s.current.CompareAndSwap(b, &stapled) {
+		return nil
+	}
+
+	return &stapled
+}
+
+// Init stores the bundle only if the store is still empty, so that
+// certificates loaded at startup never replace newer ones
+func (s *Store) Init(b *Bundle) bool {
+
+	if !s.current.CompareAndSwap(nil, b) {
+		return false
+	}
+	s.notify(b)
+
+	return true
+}
+
+// Subscribe returns a channel receiving every new bundle and a function
+// to cancel the subscription. Slow subscribers only see the latest bundle.
+func (s *Store) Subscribe() (<-chan *Bundle, func()) {
+
+	ch := make(chan *Bundle, 1)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	return ch, func() {
+		s.mu.Lock()
+		delete(s.subscribers, ch)
+		s.mu.Unlock()
+	}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	b := s.current.Load()
+	if b == nil {
+		return nil, ErrNoCertificate
+	}
+
+	return b.Certificate, nil
+}
+
+// notify passes the bundle to all subscribers without blocking,
+// replacing a bundle they have not received yet
+func (s *Store) notify(b *Bundle) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.subscribers {
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- b
+	}
+}
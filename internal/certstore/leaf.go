@@ -0,0 +1,55 @@
+package certstore
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net"
+	"slices"
+	"time"
+)
+
+// ParseLeaf parses the first certificate of a PEM encoded chain
+func ParseLeaf(data []byte) (*x509.Certificate, error) {
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no certificate found in pem data")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// RenewalTime returns the point in time after `fraction` of the
+// certificate lifetime has passed
+func RenewalTime(leaf *x509.Certificate, fraction float64) time.Time {
+
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	return leaf.NotBefore.Add(time.Duration(float64(lifetime) * fraction))
+}
+
+// CertNames returns the sorted DNS names and IP addresses of a certificate
+func CertNames(cert *x509.Certificate) []string {
+
+	names := slices.Clone(cert.DNSNames)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+
+	return SortedNames(names)
+}
+
+// SortedNames returns the names sorted and without duplicates, with IP
+// addresses in their canonical form, to compare them with CertNames
+func SortedNames(names []string) []string {
+
+	sorted := slices.Clone(names)
+	for i, name := range sorted {
+		if ip := net.ParseIP(name); ip != nil {
+			sorted[i] = ip.String()
+		}
+	}
+	slices.Sort(sorted)
+
+	return slices.Compact(sorted)
+}
@@ -0,0 +1,61 @@
+package certstore
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSortedNames(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		names []string
+		want  []string
+	}{
+		{name: "empty", names: nil, want: []string{}},
+		{name: "sorted", names: []string{"b.example.com", "a.example.com"}, want: []string{"a.example.com", "b.example.com"}},
+		{name: "duplicates", names: []string{"a.example.com", "a.example.com"}, want: []string{"a.example.com"}},
+		{name: "canonical ip", names: []string{"2001:db8:0:0::1", "2001:db8::1"}, want: []string{"2001:db8::1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			if got := SortedNames(tt.names); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	cert := &x509.Certificate{
+		DNSNames:    []string{"kms.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	}
+	if got := fmt.Sprint(CertNames(cert)); got != fmt.Sprint(SortedNames([]string{"kms.example.com", "192.0.2.1"})) {
+		t.Fatalf("certificate names %s do not match the configured names", got)
+	}
+}
+
+func TestRenewalTime(t *testing.T) {
+
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	leaf := &x509.Certificate{NotBefore: start, NotAfter: start.Add(90 * time.Hour)}
+
+	tests := []struct {
+		fraction float64
+		want     time.Time
+	}{
+		{fraction: 0, want: start},
+		{fraction: 2.0 / 3.0, want: start.Add(60 * time.Hour)},
+		{fraction: 1, want: start.Add(90 * time.Hour)},
+	}
+
+	for _, tt := range tests {
+		if got := RenewalTime(leaf, tt.fraction); !got.Equal(tt.want) {
+			t.Errorf("fraction %v: got %s, want %s", tt.fraction, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package certstore
+
+import (
+	"crypto/tls"
+)
+
+// Router selects the certificate for a TLS handshake by the SNI server
+// name from several stores, each serving its own group of names
+type Router struct {
+	stores []*Store
+}
+
+// NewRouter creates a router over the stores, the first store is the
+// default for clients that send no or an unknown server name
+func NewRouter(stores ...*Store) *Router {
+	return &Router{stores: stores}
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+// It returns the first certificate valid for the requested server name
+func (r *Router) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+
+	if hello.ServerName != "" {
+		for _, s := range r.stores {
+			b := s.Current()
+			if b != nil && b.Leaf.VerifyHostname(hello.ServerName) == nil {
+				return b.Certificate, nil
+			}
+		}
+	}
+
+	// fall back to the first store holding a certificate
+	for _, s := range r.stores {
+		if b := s.Current(); b != nil {
+			return b.Certificate, nil
+		}
+	}
+
+	return nil, ErrNoCertificate
+}
@@ -0,0 +1,76 @@
+package certstore
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// clockSkew is the tolerated difference between our clock and the CA's
+	clockSkew = 5 * time.Minute
+
+	// minRemaining is the minimum remaining validity of a new certificate
+	minRemaining = time.Hour
+)
+
+// ValidateOptions configures the checks of Validate
+type ValidateOptions struct {
+	// Names must all be covered by the certificate SANs
+	Names []string
+	// Roots to build the chain to, nil uses the system roots
+	Roots *x509.CertPool
+	// SkipChain disables the chain verification, e.g. for staging CAs
+	SkipChain bool
+}
+
+// Validate checks a new bundle before it replaces the live certificate
+// * the private key matches the certificate (checked by NewBundle)
+// * the validity period is sane
+// * the SANs cover all configured names
+// * the chain builds to a trusted root
+func Validate(b *Bundle, opts ValidateOptions) error {
+
+	leaf := b.Leaf
+	now := time.Now()
+
+	if !leaf.NotBefore.Before(leaf.NotAfter) {
+		return errors.New("certificate NotBefore is not before NotAfter")
+	}
+	if leaf.NotBefore.After(now.Add(clockSkew)) {
+		return fmt.Errorf("certificate is not valid before %s", leaf.NotBefore.Local())
+	}
+	if leaf.NotAfter.Before(now.Add(minRemaining)) {
+		return fmt.Errorf("certificate expires at %s", leaf.NotAfter.Local())
+	}
+
+	for _, name := range opts.Names {
+		if err := leaf.VerifyHostname(name); err != nil {
+			return fmt.Errorf("certificate does not cover %s: %w", name, err)
+		}
+	}
+
+	if opts.SkipChain {
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, der := range b.Certificate.Certificate[1:] {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return fmt.Errorf("could not parse certificate chain: %w", err)
+		}
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         opts.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   now.Add(clockSkew),
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}); err != nil {
+		return fmt.Errorf("certificate chain does not verify: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,241 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Kind is the value type of a setting
+type Kind int
+
+const (
+	String Kind = iota
+	Bool
+	Int
+	Float
+	Duration
+	List
+)
+
+func (k Kind) String() string {
+	switch k {
+	case Bool:
+		return "bool"
+	case Int:
+		return "int"
+	case Float:
+		return "float"
+	case Duration:
+		return "duration"
+	case List:
+		return "list"
+	default:
+		return "string"
+	}
+}
+
+// Setting describes a key of the configuration file
+type Setting struct {
+	Kind Kind
+	// Reloadable settings are applied to the running process when the
+	// file changes, all other settings require a restart
+	Reloadable bool
+}
+
+// Schema maps the setting names to their description
+type Schema map[string]Setting
+
+// File is a parsed and validated configuration file
+// Values holds the settings in their command line representation
+type File struct {
+	Path   string
+	Values map[string][]string
+}
+
+// Error points to the invalid field of a configuration file
+type Error struct {
+	Path   string
+	Field  string
+	Line   int
+	Column int
+	Err    error
+}
+
+func (e *Error) Error() string {
+
+	pos := e.Path
+	if e.Line > 0 {
+		pos = fmt.Sprintf("%s:%d:%d", e.Path, e.Line, e.Column)
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%s: %v", pos, e.Err)
+	}
+
+	return fmt.Sprintf("%s: field %q: %v", pos, e.Field, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// field is a setting as read from the file, before validation
+type field struct {
+	name   string
+	line   int
+	column int
+	value  any
+}
+
+// Load reads and validates a YAML or TOML configuration file, the format
+// is chosen by the file extension
+func Load(path string, schema Schema) (*File, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []field
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		fields, err = parseYAML(path, data)
+	case ".toml":
+		fields, err = parseTOML(path, data)
+	default:
+		return nil, fmt.Errorf("%s: unsupported configuration format %q, use .yaml or .toml", path, ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f := &File{Path: path, Values: make(map[string][]string, len(fields))}
+	for _, fl := range fields {
+		fail := func(format string, args ...any) error {
+			return &Error{Path: path, Field: fl.name, Line: fl.line, Column: fl.column, Err: fmt.Errorf(format, args...)}
+		}
+
+		setting, ok := schema[fl.name]
+		if !ok {
+			return nil, fail("unknown setting")
+		}
+		if _, ok := f.Values[fl.name]; ok {
+			return nil, fail("duplicate setting")
+		}
+		values, err := convert(setting.Kind, fl.value)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		f.Values[fl.name] = values
+	}
+
+	return f, nil
+}
+
+// Changed returns the sorted names of the settings that differ from
+// the previous file
+func (f *File) Changed(prev *File) []string {
+
+	var changed []string
+	for name, values := range f.Values {
+		if !slices.Equal(values, prev.Values[name]) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range prev.Values {
+		if _, ok := f.Values[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	slices.Sort(changed)
+
+	return changed
+}
+
+// convert checks the value against the kind and returns its command line
+// representation
+func convert(kind Kind, value any) ([]string, error) {
+
+	switch kind {
+	case Bool:
+		if b, ok := value.(bool); ok {
+			return []string{fmt.Sprint(b)}, nil
+		}
+	case Int:
+		switch v := value.(type) {
+		case int, int64:
+			return []string{fmt.Sprint(v)}, nil
+		}
+	case Float:
+		switch v := value.(type) {
+		case int, int64, float64:
+			return []string{fmt.Sprint(v)}, nil
+		}
+	case Duration:
+		if s, ok := value.(string); ok {
+			if _, err := time.ParseDuration(s); err != nil {
+				return nil, fmt.Errorf("invalid duration %q", s)
+			}
+			return []string{s}, nil
+		}
+	case List:
+		items, ok := value.([]any)
+		if !ok {
+			items = []any{value}
+		}
+		values := make([]string, 0, len(items))
+		for _, item := range items {
+			s, ok := scalar(item)
+			if !ok {
+				return nil, fmt.Errorf("expected a list of strings, got %s", typeName(item))
+			}
+			values = append(values, s)
+		}
+		return values, nil
+	default:
+		if s, ok := scalar(value); ok {
+			return []string{s}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("expected a %s, got %s", kind, typeName(value))
+}
+
+// scalar returns the string representation of strings and numbers
+func scalar(value any) (string, bool) {
+
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int, int64, float64:
+		return fmt.Sprint(v), true
+	}
+
+	return "", false
+}
+
+// typeName describes the type of a decoded value for error messages
+func typeName(value any) string {
+
+	switch value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case bool:
+		return "bool"
+	case int, int64:
+		return "int"
+	case float64:
+		return "float"
+	case []any:
+		return "list"
+	case map[string]any:
+		return "table"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,67 @@
+package config
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+	"github.com/pelletier/go-toml/v2/unstable"
+)
+
+// parseTOML reads the top level keys of a TOML document
+// the AST provides the positions, the decoder the values
+func parseTOML(path string, data []byte) ([]field, error) {
+
+	values := map[string]any{}
+	if err := toml.Unmarshal(data, &values); err != nil {
+		var derr *toml.DecodeError
+		if errors.As(err, &derr) {
+			line, column := derr.Position()
+			return nil, &Error{Path: path, Line: line, Column: column, Err: err}
+		}
+		return nil, &Error{Path: path, Err: err}
+	}
+
+	var (
+		p      unstable.Parser
+		fields []field
+	)
+	p.Reset(data)
+	for p.NextExpression() {
+		expr := p.Expression()
+		switch expr.Kind {
+		case unstable.KeyValue:
+		case unstable.Table, unstable.ArrayTable:
+			pos := p.Shape(expr.Raw).Start
+			return nil, &Error{Path: path, Line: pos.Line, Column: pos.Column, Err: errors.New("tables are not supported, settings must be top level keys")}
+		default:
+			continue
+		}
+
+		var (
+			parts []string
+			raw   unstable.Range
+		)
+		key := expr.Key()
+		for key.Next() {
+			if len(parts) == 0 {
+				raw = key.Node().Raw
+			}
+			parts = append(parts, string(key.Node().Data))
+		}
+		name := strings.Join(parts, ".")
+		pos := p.Shape(raw).Start
+
+		fields = append(fields, field{
+			name:   name,
+			line:   pos.Line,
+			column: pos.Column,
+			value:  values[name],
+		})
+	}
+	if err := p.Error(); err != nil {
+		return nil, &Error{Path: path, Err: err}
+	}
+
+	return fields, nil
+}
@@ -0,0 +1,113 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// debounce is the time to wait for further file events before reloading
+const debounce = time.Second
+
+var (
+	logger = log.With().Str("service", "config").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// Watcher reloads the configuration file whenever it changes and passes
+// valid files on to the apply function
+type Watcher struct {
+	path   string
+	schema Schema
+	apply  func(*File) error
+
+	mu sync.Mutex
+}
+
+// NewWatcher creates a new configuration file watcher
+func NewWatcher(path string, schema Schema, apply func(*File) error) *Watcher {
+
+	return &Watcher{
+		path:   path,
+		schema: schema,
+		apply:  apply,
+	}
+}
+
+// Serve implements the suture service
+func (w *Watcher) Serve(ctx context.Context) error {
+
+	logger.Info().Msgf("watching %s", w.path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch the directory to see atomic replacements and symlink swaps
+	dir := filepath.Dir(w.path)
+	if err := watcher.Add(dir); err != nil {
+		return fmt.Errorf("could not watch %s: %w", dir, err)
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			logger.Trace().Msgf("file event: %s", event)
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warn().Err(err).Msg("file watcher")
+		case <-timer.C:
+			if err := w.reload(); err != nil {
+				logger.Error().Err(err).Msg("keeping current settings")
+			}
+		}
+	}
+}
+
+// reload loads the file and applies it, an invalid file is rejected as
+// a whole and the current configuration stays in effect
+func (w *Watcher) reload() error {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	f, err := Load(w.path, w.schema)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	if err := w.apply(f); err != nil {
+		return fmt.Errorf("could not apply configuration: %w", err)
+	}
+
+	return nil
+}
+
+// Reload re-reads the configuration file
+func (w *Watcher) Reload(ctx context.Context) error {
+	return w.reload()
+}
+
+func (w *Watcher) String() string {
+	return "configuration " + w.path
+}
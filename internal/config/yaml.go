@@ -0,0 +1,43 @@
+package config
+
+import (
+	"errors"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAML reads the top level mapping of a YAML document
+func parseYAML(path string, data []byte) ([]field, error) {
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, &Error{Path: path, Err: err}
+	}
+
+	// an empty document has no content
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &Error{Path: path, Line: root.Line, Column: root.Column, Err: errors.New("expected a mapping of settings")}
+	}
+
+	fields := make([]field, 0, len(root.Content)/2)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], root.Content[i+1]
+
+		var value any
+		if err := node.Decode(&value); err != nil {
+			return nil, &Error{Path: path, Field: key.Value, Line: node.Line, Column: node.Column, Err: err}
+		}
+		fields = append(fields, field{
+			name:   key.Value,
+			line:   key.Line,
+			column: key.Column,
+			value:  value,
+		})
+	}
+
+	return fields, nil
+}
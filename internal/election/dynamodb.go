@@ -0,0 +1,103 @@
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// DynamoDB elects the holder of an item in a DynamoDB table, using
+// conditional writes to take over expired leases. The table needs a
+// string partition key named "id".
+type DynamoDB struct {
+	svc      *dynamodb.DynamoDB
+	table    string
+	name     string
+	identity string
+}
+
+// NewDynamoDB creates a new DynamoDB elector, credentials are taken from
+// environment
+func NewDynamoDB(table, region, name, identity string) (*DynamoDB, error) {
+
+	if table == "" {
+		return nil, errors.New("dynamodb leader election requires a table")
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(region)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &DynamoDB{
+		svc:      dynamodb.New(sess),
+		table:    table,
+		name:     name,
+		identity: identity,
+	}, nil
+}
+
+// TryAcquire writes the lease item if it does not exist, is held by this
+// replica or has expired
+func (d *DynamoDB) TryAcquire(ctx context.Context) (bool, error) {
+
+	now := time.Now()
+
+	_, err := d.svc.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"id":      {S: aws.String(d.name)},
+			"holder":  {S: aws.String(d.identity)},
+			"expires": {N: aws.String(strconv.FormatInt(now.Add(LeaseDuration).Unix(), 10))},
+		},
+		ConditionExpression: aws.String("attribute_not_exists(id) OR holder = :me OR expires < :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me":  {S: aws.String(d.identity)},
+			":now": {N: aws.String(strconv.FormatInt(now.Unix(), 10))},
+		},
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not acquire dynamodb lease: %w", err)
+	}
+
+	return true, nil
+}
+
+// Release deletes the lease item if it is held by this replica
+func (d *DynamoDB) Release(ctx context.Context) error {
+
+	_, err := d.svc.DeleteItemWithContext(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(d.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(d.name)},
+		},
+		ConditionExpression: aws.String("holder = :me"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":me": {S: aws.String(d.identity)},
+		},
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return fmt.Errorf("could not release dynamodb lease: %w", err)
+	}
+
+	return nil
+}
+
+func (d *DynamoDB) String() string {
+	return fmt.Sprintf("dynamodb://%s/%s", d.table, d.name)
+}
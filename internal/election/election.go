@@ -0,0 +1,40 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// LeaseDuration is how long a leadership lease is valid without renewal
+const LeaseDuration = 60 * time.Second
+
+// RenewInterval is how often the leader renews its lease and followers
+// try to acquire it
+const RenewInterval = LeaseDuration / 3
+
+// Elector decides which replica is allowed to issue certificates
+type Elector interface {
+	// TryAcquire acquires or renews the leadership lease and reports
+	// whether this replica is the leader
+	TryAcquire(ctx context.Context) (bool, error)
+	// Release gives up the leadership lease if it is held
+	Release(ctx context.Context) error
+	String() string
+}
+
+// Identity returns a default identity for this replica, the pod name
+// in Kubernetes or the hostname otherwise
+func Identity() string {
+
+	if name := os.Getenv("POD_NAME"); name != "" {
+		return name
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return fmt.Sprintf("%s-%d", host, os.Getpid())
+}
@@ -0,0 +1,28 @@
+//go:build !unix
+
+package election
+
+import (
+	"context"
+	"errors"
+)
+
+// File is not supported on this platform
+type File struct{}
+
+// NewFile returns an error as file locks are not supported on this platform
+func NewFile(path string) (*File, error) {
+	return nil, errors.New("file lock leader election is not supported on this platform")
+}
+
+func (f *File) TryAcquire(ctx context.Context) (bool, error) {
+	return false, errors.ErrUnsupported
+}
+
+func (f *File) Release(ctx context.Context) error {
+	return nil
+}
+
+func (f *File) String() string {
+	return "file://"
+}
@@ -0,0 +1,77 @@
+//go:build unix
+
+package election
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// File elects the replica holding an exclusive lock on a file, which is
+// only useful for replicas sharing a filesystem that supports flock
+type File struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+// NewFile creates a new file lock elector
+func NewFile(path string) (*File, error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+
+	return &File{path: path}, nil
+}
+
+// TryAcquire tries to take the lock without blocking
+func (f *File) TryAcquire(ctx context.Context) (bool, error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the lock is held for as long as the file stays open
+	if f.file != nil {
+		return true, nil
+	}
+
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return false, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return false, nil
+		}
+		return false, fmt.Errorf("could not lock %s: %w", f.path, err)
+	}
+	f.file = file
+
+	return true, nil
+}
+
+// Release unlocks the file
+func (f *File) Release(ctx context.Context) error {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
+
+func (f *File) String() string {
+	return fmt.Sprintf("file://%s", f.path)
+}
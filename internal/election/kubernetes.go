@@ -0,0 +1,132 @@
+package election
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/kube"
+)
+
+// microTime is the timestamp format of Kubernetes MicroTime fields
+const microTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// lease is the subset of a coordination.k8s.io/v1 Lease used for election
+type lease struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   kube.ObjectMeta `json:"metadata"`
+	Spec       leaseSpec       `json:"spec"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions,omitempty"`
+}
+
+// Kubernetes elects the holder of a Kubernetes Lease
+type Kubernetes struct {
+	client   *kube.Client
+	name     string
+	identity string
+}
+
+// NewKubernetes creates a new Kubernetes Lease elector
+func NewKubernetes(client *kube.Client, name, identity string) *Kubernetes {
+	return &Kubernetes{client: client, name: name, identity: identity}
+}
+
+// TryAcquire creates, renews or takes over the lease if it is expired
+// concurrent updates are rejected by the API server through the
+// resource version
+func (k *Kubernetes) TryAcquire(ctx context.Context) (bool, error) {
+
+	now := time.Now().UTC()
+
+	l := &lease{}
+	err := k.client.Do(ctx, http.MethodGet, k.path(), nil, l)
+	if kube.IsNotFound(err) {
+		l = &lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   kube.ObjectMeta{Name: k.name, Namespace: k.client.Namespace()},
+			Spec: leaseSpec{
+				HolderIdentity:       k.identity,
+				LeaseDurationSeconds: int(LeaseDuration.Seconds()),
+				AcquireTime:          now.Format(microTime),
+				RenewTime:            now.Format(microTime),
+			},
+		}
+		err = k.client.Do(ctx, http.MethodPost, k.collection(), l, nil)
+		if kube.IsConflict(err) {
+			return false, nil
+		}
+		return err == nil, err
+	} else if err != nil {
+		return false, err
+	}
+
+	if l.Spec.HolderIdentity != k.identity {
+		if !expired(l.Spec, now) {
+			return false, nil
+		}
+		l.Spec.HolderIdentity = k.identity
+		l.Spec.AcquireTime = now.Format(microTime)
+		l.Spec.LeaseTransitions++
+	}
+	l.Spec.LeaseDurationSeconds = int(LeaseDuration.Seconds())
+	l.Spec.RenewTime = now.Format(microTime)
+
+	err = k.client.Do(ctx, http.MethodPut, k.path(), l, nil)
+	if kube.IsConflict(err) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// Release clears the holder of the lease if it is held by this replica
+func (k *Kubernetes) Release(ctx context.Context) error {
+
+	l := &lease{}
+	if err := k.client.Do(ctx, http.MethodGet, k.path(), nil, l); err != nil {
+		return err
+	}
+	if l.Spec.HolderIdentity != k.identity {
+		return nil
+	}
+	l.Spec.HolderIdentity = ""
+	l.Spec.RenewTime = ""
+
+	return k.client.Do(ctx, http.MethodPut, k.path(), l, nil)
+}
+
+func (k *Kubernetes) String() string {
+	return fmt.Sprintf("lease://%s/%s", k.client.Namespace(), k.name)
+}
+
+func (k *Kubernetes) collection() string {
+	return fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", k.client.Namespace())
+}
+
+func (k *Kubernetes) path() string {
+	return fmt.Sprintf("%s/%s", k.collection(), k.name)
+}
+
+// expired reports whether the lease has not been renewed in time
+func expired(spec leaseSpec, now time.Time) bool {
+
+	if spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(microTime, spec.RenewTime)
+	if err != nil {
+		return true
+	}
+
+	return now.After(renewed.Add(time.Duration(spec.LeaseDurationSeconds) * time.Second))
+}
@@ -0,0 +1,287 @@
+package issuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+const (
+	// renewFraction is the share of the certificate lifetime after which
+	// the certificate is renewed
+	renewFraction = 2.0 / 3.0
+
+	// minRetryDelay and maxRetryDelay bound the backoff between failed
+	// issuance attempts
+	minRetryDelay = time.Minute
+	maxRetryDelay = time.Hour
+)
+
+// Issuer requests a server certificate from an external CA
+type Issuer interface {
+	// Sign sends the PEM encoded CSR to the CA and returns the PEM encoded
+	// certificate chain, starting with the server certificate
+	Sign(ctx context.Context, csr []byte, names []string) ([]byte, error)
+	String() string
+}
+
+// Config holds the settings of the issuer service
+type Config struct {
+	// Names are the DNS names and IP addresses of the server certificate
+	Names   []string
+	Storage storage.Storage
+	// Sealer encrypts the private key at rest, nil stores it in plaintext
+	Sealer seal.Sealer
+	Issuer Issuer
+	// Roots are the trusted roots of the CA, issued certificates must
+	// chain to them
+	Roots *x509.CertPool
+}
+
+// Service issues and rotates the server certificate with an Issuer
+type Service struct {
+	names     []string
+	storage   storage.Storage
+	sealer    seal.Sealer
+	issuer    Issuer
+	roots     *x509.CertPool
+	certStore *certstore.Store
+}
+
+var (
+	logger = log.With().Str("service", "issuer").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// New creates a new issuer service
+func New(cfg Config, certStore *certstore.Store) *Service {
+
+	return &Service{
+		names:     cfg.Names,
+		storage:   cfg.Storage,
+		sealer:    cfg.Sealer,
+		issuer:    cfg.Issuer,
+		roots:     cfg.Roots,
+		certStore: certStore,
+	}
+}
+
+// Serve implements the suture service
+// It reuses a valid stored certificate and renews it after two thirds of
+// its lifetime
+func (s *Service) Serve(ctx context.Context) error {
+
+	logger.Info().Msgf("starting with %s", s.issuer)
+
+	renewAt := time.Now()
+	if leaf, err := s.current(ctx); err != nil {
+		logger.Info().Msgf("requesting new certificate: %v", err)
+	} else {
+		renewAt = certstore.RenewalTime(leaf, renewFraction)
+	}
+
+	timer := time.NewTimer(time.Until(renewAt))
+	defer timer.Stop()
+
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			leaf, err := s.issue(ctx)
+			if err != nil {
+				failures++
+				delay := maxRetryDelay
+				if failures < 8 {
+					delay = min(minRetryDelay<<(failures-1), maxRetryDelay)
+				}
+				logger.Error().Err(err).Msgf("could not request certificate, retrying in %s", delay)
+				timer.Reset(delay)
+				continue
+			}
+			failures = 0
+			renewAt = certstore.RenewalTime(leaf, renewFraction)
+			timer.Reset(time.Until(renewAt))
+			logger.Info().Msgf("next certificate renewal at: %s", renewAt.Local())
+		}
+	}
+}
+
+// current returns the stored certificate if it covers the configured
+// names and is not due for renewal, and passes it on to the kms server
+func (s *Service) current(ctx context.Context) (*x509.Certificate, error) {
+
+	crt, err := s.storage.Get(ctx, storage.CertKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := certstore.ParseLeaf(crt)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Equal(certstore.CertNames(leaf), certstore.SortedNames(s.names)) {
+		return nil, fmt.Errorf("certificate names %v do not match configured names", certstore.CertNames(leaf))
+	}
+	if time.Now().After(certstore.RenewalTime(leaf, renewFraction)) {
+		return nil, errors.New("certificate is due for renewal")
+	}
+
+	data, err := s.storage.Get(ctx, storage.KeyKey)
+	if err != nil {
+		return nil, err
+	}
+	pk, _, err := seal.Decode(ctx, s.sealer, data)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal private key: %w", err)
+	}
+	bundle, err := s.validate(crt, pk)
+	if err != nil {
+		return nil, err
+	}
+	s.certStore.Set(bundle)
+
+	return leaf, nil
+}
+
+// issue creates a new private key and CSR, has it signed by the issuer,
+// writes the result to storage and passes it on to the kms server
+func (s *Service) issue(ctx context.Context) (*x509.Certificate, error) {
+
+	logger.Debug().Msgf("requesting certificate for %s", s.names)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.CertificateRequest{}
+	for _, name := range s.names {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	template.Subject = pkix.Name{CommonName: s.names[0]}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, key)
+	if err != nil {
+		return nil, err
+	}
+	csr := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})
+
+	crt, err := s.issuer.Sign(ctx, csr, s.names)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := certstore.ParseLeaf(crt)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	pk := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+
+	// validate the new certificate before it replaces the stored and the
+	// live one
+	bundle, err := s.validate(crt, pk)
+	if err != nil {
+		return nil, fmt.Errorf("rejected new certificate: %w", err)
+	}
+
+	sealed, err := seal.Encode(ctx, s.sealer, pk)
+	if err != nil {
+		return nil, fmt.Errorf("could not seal private key: %w", err)
+	}
+	if err := storage.PutAll(ctx, s.storage,
+		storage.Object{Name: storage.KeyKey, Data: sealed},
+		storage.Object{Name: storage.CertKey, Data: crt},
+	); err != nil {
+		return nil, err
+	}
+
+	s.certStore.Set(bundle)
+	logger.Info().Msgf("successfully obtained certificate for: %s", s.names)
+
+	return leaf, nil
+}
+
+// validate parses the certificate and private key and checks them like
+// any other certificate source, the chain must build to the configured
+// roots of the CA
+func (s *Service) validate(crt, pk []byte) (*certstore.Bundle, error) {
+
+	if s.roots == nil {
+		return nil, errors.New("no trust root configured for the issuing CA")
+	}
+
+	bundle, err := certstore.NewBundle(crt, pk, "issuer")
+	if err != nil {
+		return nil, err
+	}
+	if err := certstore.Validate(bundle, certstore.ValidateOptions{Names: s.names, Roots: s.roots}); err != nil {
+		return nil, err
+	}
+
+	return bundle, nil
+}
+
+// LoadRoots reads the trusted roots of the CA from a PEM file
+func LoadRoots(file string) (*x509.CertPool, error) {
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+
+	return roots, nil
+}
+
+// httpClient returns an HTTP client trusting the roots in caFile in
+// addition to the system roots
+func httpClient(caFile string) (*http.Client, error) {
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}, nil
+}
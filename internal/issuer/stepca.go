@@ -0,0 +1,207 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// tokenLifetime is the validity of the one-time token sent to step-ca
+const tokenLifetime = 5 * time.Minute
+
+// StepCAConfig holds the settings of the step-ca issuer
+type StepCAConfig struct {
+	URL string
+	// Root is a PEM file with the root certificate of the CA
+	Root string
+	// Provisioner is the name of the JWK provisioner
+	Provisioner string
+	// KeyFile holds the provisioner private key as JWK, or as JWE
+	// encrypted with the password in PasswordFile
+	KeyFile      string
+	PasswordFile string
+	// TTL requests a certificate lifetime, zero uses the provisioner default
+	TTL time.Duration
+}
+
+// StepCA signs certificates with a smallstep CA using a JWK provisioner
+type StepCA struct {
+	cfg    StepCAConfig
+	key    *jose.JSONWebKey
+	client *http.Client
+}
+
+// NewStepCA creates a new step-ca issuer
+func NewStepCA(cfg StepCAConfig) (*StepCA, error) {
+
+	if cfg.URL == "" || cfg.Provisioner == "" || cfg.KeyFile == "" {
+		return nil, errors.New("step-ca issuer requires a url, a provisioner and a provisioner key")
+	}
+
+	key, err := loadProvisionerKey(cfg.KeyFile, cfg.PasswordFile)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := httpClient(cfg.Root)
+	if err != nil {
+		return nil, err
+	}
+
+	return &StepCA{cfg: cfg, key: key, client: client}, nil
+}
+
+// Sign sends the CSR with a one-time token to the sign endpoint of the CA
+func (s *StepCA) Sign(ctx context.Context, csr []byte, names []string) ([]byte, error) {
+
+	url := strings.TrimSuffix(s.cfg.URL, "/") + "/1.0/sign"
+
+	ott, err := s.token(url, names)
+	if err != nil {
+		return nil, err
+	}
+
+	body := map[string]string{
+		"csr": string(csr),
+		"ott": ott,
+	}
+	if s.cfg.TTL > 0 {
+		body["notAfter"] = s.cfg.TTL.String()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach step-ca: %w", err)
+	}
+	defer resp.Body.Close()
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("step-ca sign failed: %s %s", resp.Status, strings.TrimSpace(string(raw)))
+	}
+
+	result := struct {
+		Crt       string   `json:"crt"`
+		CA        string   `json:"ca"`
+		CertChain []string `json:"certChain"`
+	}{}
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("could not parse step-ca response: %w", err)
+	}
+
+	chain := result.CertChain
+	if len(chain) == 0 {
+		chain = []string{result.Crt, result.CA}
+	}
+	for i := range chain {
+		chain[i] = strings.TrimSpace(chain[i])
+	}
+
+	return []byte(strings.Join(chain, "\n") + "\n"), nil
+}
+
+func (s *StepCA) String() string {
+	return fmt.Sprintf("step-ca %s (provisioner %s)", s.cfg.URL, s.cfg.Provisioner)
+}
+
+// token creates the one-time token authorizing the certificate request
+func (s *StepCA) token(audience string, names []string) (string, error) {
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(s.key.Algorithm), Key: s.key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", s.key.KeyID),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.Claims{
+		ID:        hex.EncodeToString(id),
+		Issuer:    s.cfg.Provisioner,
+		Subject:   names[0],
+		Audience:  jwt.Audience{audience},
+		IssuedAt:  jwt.NewNumericDate(now),
+		NotBefore: jwt.NewNumericDate(now),
+		Expiry:    jwt.NewNumericDate(now.Add(tokenLifetime)),
+	}
+	extra := struct {
+		SANs []string `json:"sans"`
+	}{SANs: names}
+
+	return jwt.Signed(signer).Claims(claims).Claims(extra).Serialize()
+}
+
+// loadProvisionerKey reads the JWK provisioner key, decrypting it with the
+// password if it is stored as JWE like in the step-ca configuration
+func loadProvisionerKey(keyFile, passwordFile string) (*jose.JSONWebKey, error) {
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &jose.JSONWebKey{}
+	if err := key.UnmarshalJSON(data); err != nil {
+		if passwordFile == "" {
+			return nil, fmt.Errorf("could not parse provisioner key: %w", err)
+		}
+		password, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := jose.ParseEncrypted(string(data),
+			[]jose.KeyAlgorithm{jose.PBES2_HS256_A128KW, jose.PBES2_HS384_A192KW, jose.PBES2_HS512_A256KW},
+			[]jose.ContentEncryption{jose.A128GCM, jose.A192GCM, jose.A256GCM, jose.A128CBC_HS256, jose.A256CBC_HS512},
+		)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse encrypted provisioner key: %w", err)
+		}
+		plain, err := enc.Decrypt(bytes.TrimSpace(password))
+		if err != nil {
+			return nil, fmt.Errorf("could not decrypt provisioner key: %w", err)
+		}
+		if err := key.UnmarshalJSON(plain); err != nil {
+			return nil, fmt.Errorf("could not parse provisioner key: %w", err)
+		}
+	}
+
+	if key.IsPublic() {
+		return nil, errors.New("provisioner key is not a private key")
+	}
+	if key.Algorithm == "" {
+		key.Algorithm = string(jose.ES256)
+	}
+
+	return key, nil
+}
@@ -0,0 +1,134 @@
+package issuer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// VaultConfig holds the settings of the Vault PKI issuer
+type VaultConfig struct {
+	Address   string
+	Token     string
+	Namespace string
+	// Mount is the path of the PKI secrets engine
+	Mount string
+	// Role is the PKI role used to sign the certificate
+	Role string
+	// TTL requests a certificate lifetime, zero uses the role default
+	TTL time.Duration
+	// CACert is a PEM file with the roots to trust for the Vault server
+	CACert string
+}
+
+// Vault signs certificates with a HashiCorp Vault PKI role
+type Vault struct {
+	cfg    VaultConfig
+	client *http.Client
+}
+
+// NewVault creates a new Vault PKI issuer
+func NewVault(cfg VaultConfig) (*Vault, error) {
+
+	if cfg.Address == "" || cfg.Role == "" {
+		return nil, errors.New("vault issuer requires an address and a role")
+	}
+	if cfg.Mount == "" {
+		cfg.Mount = "pki"
+	}
+
+	client, err := httpClient(cfg.CACert)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Vault{cfg: cfg, client: client}, nil
+}
+
+// Sign sends the CSR to the sign endpoint of the PKI role
+func (v *Vault) Sign(ctx context.Context, csr []byte, names []string) ([]byte, error) {
+
+	var dns, ips []string
+	for _, name := range names {
+		if net.ParseIP(name) != nil {
+			ips = append(ips, name)
+		} else {
+			dns = append(dns, name)
+		}
+	}
+
+	body := map[string]string{
+		"csr":         string(csr),
+		"common_name": names[0],
+		"alt_names":   strings.Join(dns, ","),
+		"ip_sans":     strings.Join(ips, ","),
+		"format":      "pem",
+	}
+	if v.cfg.TTL > 0 {
+		body["ttl"] = v.cfg.TTL.String()
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+
+	url := fmt.Sprintf("%s/v1/%s/sign/%s",
+		strings.TrimSuffix(v.cfg.Address, "/"), strings.Trim(v.cfg.Mount, "/"), v.cfg.Role)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", v.cfg.Token)
+	if v.cfg.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.cfg.Namespace)
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not reach vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	result := struct {
+		Errors []string `json:"errors"`
+		Data   struct {
+			Certificate string   `json:"certificate"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}{}
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, &result); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, fmt.Errorf("could not parse vault response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("vault sign failed: %s %s", resp.Status, strings.Join(result.Errors, "; "))
+	}
+
+	// build the chain from the certificate and its intermediates
+	chain := []string{strings.TrimSpace(result.Data.Certificate)}
+	if len(result.Data.CAChain) > 0 {
+		for _, c := range result.Data.CAChain {
+			chain = append(chain, strings.TrimSpace(c))
+		}
+	} else if result.Data.IssuingCA != "" {
+		chain = append(chain, strings.TrimSpace(result.Data.IssuingCA))
+	}
+
+	return []byte(strings.Join(chain, "\n") + "\n"), nil
+}
+
+func (v *Vault) String() string {
+	return fmt.Sprintf("vault %s/v1/%s (role %s)", v.cfg.Address, v.cfg.Mount, v.cfg.Role)
+}
@@ -0,0 +1,242 @@
+package issuer
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// fakeVault serves the sign endpoint of a Vault PKI role with a test CA
+type fakeVault struct {
+	t      *testing.T
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	// names overrides the names of the signed certificate
+	names []string
+	// chain selects how the CA is returned: ca_chain, issuing_ca or none
+	chain string
+	// status is returned instead of a certificate if set
+	status int
+}
+
+func newFakeVault(t *testing.T) *fakeVault {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &fakeVault{t: t, caCert: cert, caKey: key, chain: "ca_chain"}
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != http.MethodPost || r.URL.Path != "/v1/pki-int/sign/kms" {
+		http.Error(w, `{"errors":["unsupported path"]}`, http.StatusNotFound)
+		return
+	}
+	if r.Header.Get("X-Vault-Token") != "s.token" || r.Header.Get("X-Vault-Namespace") != "ops" {
+		http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+	if f.status != 0 {
+		http.Error(w, `{"errors":["role not allowed"]}`, f.status)
+		return
+	}
+
+	var body map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, `{"errors":["invalid body"]}`, http.StatusBadRequest)
+		return
+	}
+	block, _ := pem.Decode([]byte(body["csr"]))
+	if block == nil {
+		http.Error(w, `{"errors":["missing csr"]}`, http.StatusBadRequest)
+		return
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		http.Error(w, `{"errors":["invalid csr"]}`, http.StatusBadRequest)
+		return
+	}
+
+	dns := strings.Split(body["alt_names"], ",")
+	if f.names != nil {
+		dns = f.names
+	}
+	var ips []net.IP
+	for _, ip := range strings.Split(body["ip_sans"], ",") {
+		ips = append(ips, net.ParseIP(ip))
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: body["common_name"]},
+		DNSNames:     dns,
+		IPAddresses:  ips,
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(12 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.caCert, csr.PublicKey, f.caKey)
+	if err != nil {
+		f.t.Error(err)
+		http.Error(w, `{"errors":["could not sign"]}`, http.StatusInternalServerError)
+		return
+	}
+
+	ca := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: f.caCert.Raw}))
+	data := map[string]any{
+		"certificate": string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+	switch f.chain {
+	case "ca_chain":
+		data["ca_chain"] = []string{ca}
+	case "issuing_ca":
+		data["issuing_ca"] = ca
+	}
+	json.NewEncoder(w).Encode(map[string]any{"data": data})
+}
+
+func TestVault(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		setup func(f *fakeVault)
+		// roots returns the trusted roots, nil trusts the fake CA
+		roots   func(t *testing.T) *x509.CertPool
+		wantErr string
+		// wantChain is the number of certificates served
+		wantChain int
+	}{
+		{name: "ca chain", wantChain: 2},
+		{name: "issuing ca", setup: func(f *fakeVault) { f.chain = "issuing_ca" }, wantChain: 2},
+		{name: "leaf only", setup: func(f *fakeVault) { f.chain = "" }, wantChain: 1},
+		{
+			name:    "vault error",
+			setup:   func(f *fakeVault) { f.status = http.StatusBadRequest },
+			wantErr: "role not allowed",
+		},
+		{
+			name: "untrusted ca",
+			roots: func(t *testing.T) *x509.CertPool {
+				roots := x509.NewCertPool()
+				roots.AddCert(newFakeVault(t).caCert)
+				return roots
+			},
+			wantErr: "unknown authority",
+		},
+		{
+			name:    "no trust root",
+			roots:   func(t *testing.T) *x509.CertPool { return nil },
+			wantErr: "no trust root",
+		},
+		{
+			name:    "names not covered",
+			setup:   func(f *fakeVault) { f.names = []string{"other.example.com"} },
+			wantErr: "does not cover kms.example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			ctx := context.Background()
+			fake := newFakeVault(t)
+			if tt.setup != nil {
+				tt.setup(fake)
+			}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+
+			vault, err := NewVault(VaultConfig{
+				Address:   server.URL + "/",
+				Token:     "s.token",
+				Namespace: "ops",
+				Mount:     "/pki-int/",
+				Role:      "kms",
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			roots := x509.NewCertPool()
+			roots.AddCert(fake.caCert)
+			if tt.roots != nil {
+				roots = tt.roots(t)
+			}
+			store := storage.NewLocal(t.TempDir())
+			certStore := certstore.New()
+			s := New(Config{
+				Names:   []string{"kms.example.com", "192.0.2.1"},
+				Storage: store,
+				Issuer:  vault,
+				Roots:   roots,
+			}, certStore)
+
+			_, err = s.issue(ctx)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got %v, want an error containing %q", err, tt.wantErr)
+				}
+				if certStore.Current() != nil {
+					t.Fatal("rejected certificate is served")
+				}
+				if _, err := store.Get(ctx, storage.CertKey); err == nil {
+					t.Fatal("rejected certificate is stored")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			served := certStore.Current()
+			if served == nil || len(served.Certificate.Certificate) != tt.wantChain {
+				t.Fatalf("got %v, want a served chain of %d certificates", served, tt.wantChain)
+			}
+
+			// the stored certificate is picked up again on the next start
+			restarted := New(Config{
+				Names:   []string{"192.0.2.1", "kms.example.com"},
+				Storage: store,
+				Issuer:  vault,
+				Roots:   roots,
+			}, certstore.New())
+			if _, err := restarted.current(ctx); err != nil {
+				t.Fatalf("stored certificate not reused: %v", err)
+			}
+		})
+	}
+}
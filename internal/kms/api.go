@@ -2,17 +2,36 @@ package kms
 
 import (
 	"context"
+	"errors"
 
 	"github.com/rs/zerolog/log"
 	"github.com/siderolabs/kms-client/api/kms"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/nodes"
+	"github.openresearch.com/talos-kms-proxy/internal/policy"
 )
 
 // Seal encrypts the incoming data
-func (srv *Server) Seal(ctx context.Context, req *kms.Request) (*kms.Response, error) {
+func (srv *Server) Seal(ctx context.Context, req *kms.Request) (resp *kms.Response, err error) {
 
-	log.Info().Msgf("Sealing fde key for node %s", req.NodeUuid)
+	backend, tenant, err := srv.authorize(ctx, req.NodeUuid)
+	defer func() { srv.record(ctx, audit.Seal, tenant, req.NodeUuid, err) }()
+	if err != nil {
+		return nil, err
+	}
 
-	encdata, err := srv.awscli.EncryptData(string(req.Data), ctx)
+	event := log.Info()
+	if tenant != "" {
+		event = event.Str("tenant", tenant)
+	}
+	event.Msgf("Sealing fde key for node %s", req.NodeUuid)
+
+	encdata, err := backend.EncryptData(string(req.Data), ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -23,11 +42,21 @@ func (srv *Server) Seal(ctx context.Context, req *kms.Request) (*kms.Response, e
 }
 
 // Unseal decrypts the incoming data
-func (srv *Server) Unseal(ctx context.Context, req *kms.Request) (*kms.Response, error) {
+func (srv *Server) Unseal(ctx context.Context, req *kms.Request) (resp *kms.Response, err error) {
 
-	log.Info().Msgf("Unsealing fde key for node %s", req.NodeUuid)
+	backend, tenant, err := srv.authorize(ctx, req.NodeUuid)
+	defer func() { srv.record(ctx, audit.Unseal, tenant, req.NodeUuid, err) }()
+	if err != nil {
+		return nil, err
+	}
 
-	data, err := srv.awscli.DecryptData(string(req.Data), ctx)
+	event := log.Info()
+	if tenant != "" {
+		event = event.Str("tenant", tenant)
+	}
+	event.Msgf("Unsealing fde key for node %s", req.NodeUuid)
+
+	data, err := backend.DecryptData(string(req.Data), ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -36,3 +65,66 @@ func (srv *Server) Unseal(ctx context.Context, req *kms.Request) (*kms.Response,
 		Data: data.Plaintext,
 	}, nil
 }
+
+// authorize returns the KMS client of the tenant and the tenant name if
+// the node policy and the node registry allow the node to seal and unseal
+func (srv *Server) authorize(ctx context.Context, node string) (*oraws.AWS, string, error) {
+
+	backend, tenant, err := srv.backend(ctx)
+	if err != nil {
+		return nil, tenant, err
+	}
+
+	// the policy is checked first, so that rejected nodes are neither
+	// registered nor cause writes to the storage
+	if srv.policy != nil {
+		err := srv.policy.Check(tenant, node, remoteAddr(ctx))
+		switch {
+		case errors.Is(err, policy.ErrRateLimited):
+			log.Warn().Msgf("rejected request of node %s: %v", node, err)
+			return nil, tenant, status.Error(codes.ResourceExhausted, err.Error())
+		case err != nil:
+			log.Warn().Msgf("rejected request of node %s: %v", node, err)
+			return nil, tenant, status.Error(codes.PermissionDenied, err.Error())
+		}
+	}
+	if srv.nodes == nil {
+		return backend, tenant, nil
+	}
+
+	err = srv.nodes.Check(ctx, tenant, node, remoteAddr(ctx))
+	switch {
+	case errors.Is(err, nodes.ErrPending), errors.Is(err, nodes.ErrRevoked):
+		log.Warn().Msgf("rejected request of node %s: %v", node, err)
+		return nil, tenant, status.Error(codes.PermissionDenied, err.Error())
+	case err != nil:
+		return nil, tenant, status.Error(codes.Unavailable, err.Error())
+	}
+
+	return backend, tenant, nil
+}
+
+// record adds the request to the audit log
+func (srv *Server) record(ctx context.Context, typ, tenant, node string, err error) {
+
+	if srv.events == nil {
+		return
+	}
+
+	e := audit.Event{Type: typ, Tenant: tenant, Node: node, Peer: remoteAddr(ctx)}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	srv.events.Record(e)
+}
+
+// remoteAddr returns the address of the client of the request
+func remoteAddr(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+
+	return p.Addr.String()
+}
@@ -0,0 +1,62 @@
+package kms
+
+import (
+	"sort"
+
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+)
+
+// Backend is the result of a health check of a KMS key
+type Backend struct {
+	// Tenant is the server name of the tenant, empty for the default key
+	Tenant string
+	KeyID  string
+	Err    error
+}
+
+// CheckBackends checks that the default KMS key and the keys of the
+// tenants exist, keys shared by several tenants are checked once
+func (srv *Server) CheckBackends() []Backend {
+
+	backends := []Backend{{KeyID: srv.awscli.KeyID, Err: srv.awscli.CheckKeyExists()}}
+
+	checked := map[*oraws.AWS]bool{srv.awscli: true}
+	tenants := *srv.tenants.Load()
+	names := make([]string, 0, len(tenants))
+	for name := range tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		tenant := tenants[name]
+		if checked[tenant] {
+			continue
+		}
+		checked[tenant] = true
+		backends = append(backends, Backend{Tenant: name, KeyID: tenant.KeyID, Err: tenant.CheckKeyExists()})
+	}
+
+	return backends
+}
+
+// Groups returns the certificate groups served by the server
+func (srv *Server) Groups() []CertGroup {
+	return srv.groups
+}
+
+// SetLockdown enables or disables lockdown mode, which rejects all seal
+// and unseal requests
+func (srv *Server) SetLockdown(enabled bool) {
+
+	srv.lockdown.Store(enabled)
+	if enabled {
+		logger.Warn().Msg("lockdown mode enabled, rejecting all requests")
+		return
+	}
+	logger.Info().Msg("lockdown mode disabled")
+}
+
+// Lockdown reports whether lockdown mode is enabled
+func (srv *Server) Lockdown() bool {
+	return srv.lockdown.Load()
+}
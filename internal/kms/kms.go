@@ -1,20 +1,25 @@
 package kms
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"os"
+	"sync/atomic"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	awskms "github.com/aws/aws-sdk-go/service/kms"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/siderolabs/kms-client/api/kms"
+	"github.openresearch.com/talos-kms-proxy/internal/audit"
 	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+	"github.openresearch.com/talos-kms-proxy/internal/nodes"
+	"github.openresearch.com/talos-kms-proxy/internal/policy"
+	"github.openresearch.com/talos-kms-proxy/internal/seal"
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
 	"golang.org/x/sync/errgroup"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -25,11 +30,29 @@ import (
 type Server struct {
 	kms.UnimplementedKMSServiceServer
 
-	awscli       *oraws.AWS
-	certsChannel chan map[string][]byte
-	certs        map[string][]byte
-	workdir      string
-	endpoint     string
+	awscli   *oraws.AWS
+	tenants  atomic.Pointer[map[string]*oraws.AWS]
+	sealer   seal.Sealer
+	groups   []CertGroup
+	router   *certstore.Router
+	endpoint string
+	lockdown atomic.Bool
+	// listeners are the additional listeners of tenants
+	listeners []tenantListen
+	nodes     *nodes.Registry
+	policy    *policy.Enforcer
+	events    *audit.Log
+}
+
+// CertGroup is the certificate store of a group of server names and the
+// storage its certificates are loaded from at startup
+// Storage may be nil if certificates are only provided via the store,
+// Rollbacker may be nil if the source keeps no previous certificate.
+type CertGroup struct {
+	Name       string
+	Store      *certstore.Store
+	Storage    storage.Storage
+	Rollbacker Rollbacker
 }
 
 var (
@@ -37,102 +60,198 @@ var (
 )
 
 // NewServer initializes new server
-func NewServer(endpoint, workdir string, certsChannel chan map[string][]byte) (*Server, error) {
-
-	// load the AWS KMS keyID from env
-	keyID := os.Getenv("AWS_KMS_KEY_ID")
+// the certificate is selected from the groups by the SNI server name,
+// the first group is the default
+// tenants maps SNI server names to their KMS clients, if set requests for
+// other names are rejected
+// sealer decrypts the private key if it is encrypted at rest, it may be nil
+// registry authorizes the nodes, enforcer restricts them by the node
+// policy and events records their requests, all three may be nil
+func NewServer(endpoint string, awscli *oraws.AWS, tenants map[string]*oraws.AWS, sealer seal.Sealer, groups []CertGroup,
+	registry *nodes.Registry, enforcer *policy.Enforcer, events *audit.Log) (*Server, error) {
+
+	if len(groups) == 0 {
+		return nil, errors.New("no certificate groups configured")
+	}
 
-	// create aws client session, credentials are taken from environment
-	sess, err := session.NewSession(&aws.Config{Region: aws.String("eu-west-1")})
-	if err != nil {
-		return nil, err
+	stores := make([]*certstore.Store, 0, len(groups))
+	for _, g := range groups {
+		stores = append(stores, g.Store)
 	}
 
-	// Create AWS KMS service client
-	svc := awskms.New(sess)
+	srv := &Server{
+		awscli:   awscli,
+		sealer:   sealer,
+		groups:   groups,
+		router:   certstore.NewRouter(stores...),
+		endpoint: endpoint,
+		nodes:    registry,
+		policy:   enforcer,
+		events:   events,
+	}
+	srv.SetTenants(tenants)
 
-	// create new OpenResearch KMS AWS helper
-	awscli := oraws.NewAWS(svc)
+	return srv, nil
+}
 
-	// and assign AWS KMS keyID to use and check for validity
-	awscli.KeyID = keyID
-	if err := awscli.CheckKeyExists(); err != nil {
-		return nil, err
-	}
+// ListenTenant adds a listener whose requests are served by the tenant
+// regardless of the SNI server name, it must be called before Serve
+func (srv *Server) ListenTenant(address, tenant string) {
+	srv.listeners = append(srv.listeners, tenantListen{address: address, tenant: tenant})
+}
 
-	return &Server{
-		awscli:       awscli,
-		certsChannel: certsChannel,
-		endpoint:     endpoint,
-		workdir:      workdir,
-	}, nil
+// SetTenants replaces the tenants, requests in flight keep using the
+// previous mapping
+func (srv *Server) SetTenants(tenants map[string]*oraws.AWS) {
+	srv.tenants.Store(&tenants)
 }
 
 // Serve implements the suture service
-// It starts the grpc listener and then waits for events
-// from the certsChannel to load new certificates
+// It starts the grpc listener and then logs the certificate rotations
 func (srv *Server) Serve(ctx context.Context) error {
 
 	logger.Info().Msg("starting")
 
-	// try to load existing certificates
-	if err := srv.loadCerts(); err != nil {
-		return fmt.Errorf("could not load existing certs: %w", err)
+	eg, ctx := errgroup.WithContext(ctx)
+	for _, g := range srv.groups {
+		updates, cancel := g.Store.Subscribe()
+		defer cancel()
+
+		// try to load existing certificates
+		if err := srv.loadCerts(ctx, g); err != nil {
+			return fmt.Errorf("could not load existing certs: %w", err)
+		}
+
+		eg.Go(func() error {
+			srv.logRotations(ctx, g, updates)
+			return nil
+		})
 	}
 
 	// we start the grpc service listener here
-	// note that it will not start serving requests until the certificates
-	// from the ACME service are created and sent via the certsChannel (see below)
+	// note that it will not complete TLS handshakes until a certificate
+	// is available in the certificate store
 	go srv.grpcListen(ctx)
 
-	// reload certificates
+	return eg.Wait()
+}
+
+// logRotations logs the certificate rotations of a group
+func (srv *Server) logRotations(ctx context.Context, g CertGroup, updates <-chan *certstore.Bundle) {
+
 	for {
 		select {
 		case <-ctx.Done():
-			return nil
-		case srv.certs = <-srv.certsChannel:
-			logger.Info().Msgf("certificates rotated by acme client")
+			return
+		case b := <-updates:
+			if g.Name != "" {
+				logger.Info().Msgf("certificates of group %s rotated by %s, valid until %s",
+					g.Name, b.Source, b.Leaf.NotAfter.Local())
+				continue
+			}
+			logger.Info().Msgf("certificates rotated by %s, valid until %s",
+				b.Source, b.Leaf.NotAfter.Local())
 		}
 	}
 }
 
-// loadCerts tries to load existing certs from filesystem
-// if successfull it stores the certificates into Server.certs
-func (srv *Server) loadCerts() error {
+// loadCerts tries to load existing certs from storage
+// if successfull and no newer certificate is available yet it stores
+// them into the certificate store
+func (srv *Server) loadCerts(ctx context.Context, g CertGroup) error {
+
+	bundle, err := srv.readCerts(ctx, g)
+	if err != nil || bundle == nil {
+		return err
+	}
+	g.Store.Init(bundle)
 
-	certs := make(map[string][]byte)
+	logger.Debug().Msgf("successfully loaded certs from %s", g.Storage)
+
+	return nil
+}
+
+// readCerts reads the certificate of a group from storage
+// it returns nil if the group has no storage or no certificate yet
+func (srv *Server) readCerts(ctx context.Context, g CertGroup) (*certstore.Bundle, error) {
+
+	// certificates are only provided via the certificate store
+	if g.Storage == nil {
+		return nil, nil
+	}
 
 	// try to read cert.pem
-	crt, err := os.ReadFile(fmt.Sprintf("%s/certs/cert.pem", srv.workdir))
+	crt, err := g.Storage.Get(ctx, storage.CertKey)
 	if errors.Is(err, os.ErrNotExist) {
-		return nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
 	}
-	certs["certificate"] = crt
 
-	// try to read keu.pem
-	pk, err := os.ReadFile(fmt.Sprintf("%s/certs/key.pem", srv.workdir))
+	// try to read key.pem
+	pk, err := g.Storage.Get(ctx, storage.KeyKey)
 	if errors.Is(err, os.ErrNotExist) {
-		return nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, _, err := seal.Decode(ctx, srv.sealer, pk)
+	if err != nil {
+		return nil, fmt.Errorf("could not unseal private key: %w", err)
 	}
-	certs["privatekey"] = pk
 
-	// assign existing certs to our server instance
-	srv.certs = certs
+	return certstore.NewBundle(crt, key, "storage")
+}
 
-	logger.Debug().Msgf("successfully loaded certs from %s/certs", srv.workdir)
+// Reload re-reads the certificates from storage and checks that the
+// KMS keys still exist
+func (srv *Server) Reload(ctx context.Context) error {
+
+	var errs []error
+	for _, g := range srv.groups {
+		if err := srv.reloadCerts(ctx, g); err != nil {
+			if g.Name != "" {
+				err = fmt.Errorf("group %s: %w", g.Name, err)
+			}
+			errs = append(errs, err)
+		}
+	}
 
-	return nil
+	for _, b := range srv.CheckBackends() {
+		if b.Err != nil {
+			errs = append(errs, fmt.Errorf("kms key %s: %w", b.KeyID, b.Err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-// getCerts parses the latest available certificates
-// and returns them in *tls.Certificate format
-func (srv *Server) getCerts(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+// reloadCerts replaces the certificate of a group if the stored one differs
+func (srv *Server) reloadCerts(ctx context.Context, g CertGroup) error {
 
-	cert, err := tls.X509KeyPair(srv.certs["certificate"], srv.certs["privatekey"])
-	if err != nil {
-		return nil, err
+	bundle, err := srv.readCerts(ctx, g)
+	if err != nil || bundle == nil {
+		return err
 	}
-	return &cert, nil
+	if current := g.Store.Current(); current != nil && bytes.Equal(current.CertPEM, bundle.CertPEM) {
+		return nil
+	}
+	if err := certstore.Validate(bundle, certstore.ValidateOptions{SkipChain: true}); err != nil {
+		return err
+	}
+	g.Store.Set(bundle)
+
+	return nil
+}
+
+func (srv *Server) String() string {
+	return "kms"
+}
+
+// getCerts returns the current pre-parsed certificate for the requested
+// server name
+func (srv *Server) getCerts(h *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return srv.router.GetCertificate(h)
 }
 
 // grpcListen starts a goroutine that handles the GRPC calls for the KMS service
@@ -154,18 +273,29 @@ func (srv *Server) grpcListen(ctx context.Context) {
 	// register reflection
 	reflection.Register(s)
 
-	// start a tcp listener
+	// start a tcp listener and the listeners of the tenants
 	lis, err := net.Listen("tcp", srv.endpoint)
 	if err != nil {
 		logger.Fatal().Err(err).Msg("")
 	}
+	listeners := []net.Listener{lis}
+	for _, l := range srv.listeners {
+		lis, err := net.Listen("tcp", l.address)
+		if err != nil {
+			logger.Fatal().Err(err).Msg("")
+		}
+		listeners = append(listeners, &tenantListener{Listener: lis, tenant: l.tenant})
+		logger.Info().Msgf("serving tenant %s on %s", l.tenant, l.address)
+	}
 
 	// start serving the KMS grpc service
 	// and handle errors with an error group
 	eg, ctx := errgroup.WithContext(ctx)
-	eg.Go(func() error {
-		return s.Serve(lis)
-	})
+	for _, lis := range listeners {
+		eg.Go(func() error {
+			return s.Serve(lis)
+		})
+	}
 	eg.Go(func() error {
 		<-ctx.Done()
 		s.Stop()
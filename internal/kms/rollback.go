@@ -0,0 +1,58 @@
+package kms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+)
+
+// ErrUnknownGroup is returned by Rollback for groups that are not served
+var ErrUnknownGroup = errors.New("unknown certificate group")
+
+// Rollbacker is implemented by certificate sources that keep the previous
+// certificate in storage. They swap it with the current certificate
+// themselves, so that their own state follows the rollback and only the
+// leader writes to the storage.
+type Rollbacker interface {
+	Rollback(ctx context.Context) (*certstore.Bundle, error)
+}
+
+// Rollback replaces the certificate of a group with the one it replaced
+// If the source of the group keeps the previous certificate in storage,
+// the rollback is done by the source and survives reloads and restarts.
+// Otherwise only the served certificate is rolled back until the next
+// renewal or reload. The previous certificate must still pass validation.
+func (srv *Server) Rollback(ctx context.Context, group string) (*certstore.Bundle, error) {
+
+	for _, g := range srv.groups {
+		if g.Name != group {
+			continue
+		}
+		if g.Rollbacker != nil {
+			return g.Rollbacker.Rollback(ctx)
+		}
+		return rollbackStore(g)
+	}
+
+	return nil, fmt.Errorf("%w %q", ErrUnknownGroup, group)
+}
+
+// rollbackStore serves the certificate replaced by the last update of the
+// certificate store
+func rollbackStore(g CertGroup) (*certstore.Bundle, error) {
+
+	prev := g.Store.Previous()
+	if prev == nil {
+		return nil, errors.New("no previous certificate to roll back to")
+	}
+	if err := certstore.Validate(prev, certstore.ValidateOptions{SkipChain: true}); err != nil {
+		return nil, fmt.Errorf("previous certificate: %w", err)
+	}
+	if err := g.Store.Rollback(); err != nil {
+		return nil, err
+	}
+
+	return prev, nil
+}
@@ -0,0 +1,107 @@
+package kms
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	oraws "github.openresearch.com/talos-kms-proxy/internal/aws"
+)
+
+// tenantListen is an additional listener of a tenant
+type tenantListen struct {
+	address string
+	tenant  string
+}
+
+// backend returns the KMS client of the tenant the request was sent to
+// and the tenant name. Tenants are identified by the listener the request
+// was received on, or otherwise by the TLS SNI server name. Without
+// configured tenants all requests use the default key. All requests are
+// rejected in lockdown mode.
+func (srv *Server) backend(ctx context.Context) (*oraws.AWS, string, error) {
+
+	if srv.lockdown.Load() {
+		return nil, "", status.Error(codes.Unavailable, "the kms proxy is in lockdown mode")
+	}
+
+	tenants := *srv.tenants.Load()
+	name, ok := listenerTenant(ctx)
+	if !ok {
+		if len(tenants) == 0 {
+			return srv.awscli, "", nil
+		}
+		name = serverName(ctx)
+	}
+	if tenant, ok := tenants[name]; ok {
+		return tenant, name, nil
+	}
+
+	return nil, "", status.Errorf(codes.PermissionDenied, "unknown tenant %q", name)
+}
+
+// serverName returns the SNI server name of the TLS connection of the request
+func serverName(ctx context.Context) string {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok {
+		return ""
+	}
+
+	return strings.ToLower(info.State.ServerName)
+}
+
+// listenerTenant returns the tenant of the listener the request was
+// received on, if it was received on the listener of a tenant
+func listenerTenant(ctx context.Context) (string, bool) {
+
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", false
+	}
+	addr, ok := p.LocalAddr.(tenantAddr)
+
+	return addr.tenant, ok
+}
+
+// tenantListener accepts the connections of the listener of a tenant
+type tenantListener struct {
+	net.Listener
+	tenant string
+}
+
+func (l *tenantListener) Accept() (net.Conn, error) {
+
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tenantConn{Conn: conn, tenant: l.tenant}, nil
+}
+
+// tenantConn tags its local address with the tenant, grpc passes the
+// local address of the connection on to the requests
+type tenantConn struct {
+	net.Conn
+	tenant string
+}
+
+func (c *tenantConn) LocalAddr() net.Addr {
+	return tenantAddr{Addr: c.Conn.LocalAddr(), tenant: c.tenant}
+}
+
+// tenantAddr is the local address of a connection to a tenant listener
+type tenantAddr struct {
+	net.Addr
+	tenant string
+}
@@ -0,0 +1,173 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// default locations of the in-cluster service account files
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+	tokenFile         = serviceAccountDir + "/token"
+	caFile            = serviceAccountDir + "/ca.crt"
+	namespaceFile     = serviceAccountDir + "/namespace"
+)
+
+// Config holds the connection settings of the Kubernetes API client
+// empty fields are taken from the in-cluster service account
+type Config struct {
+	Host      string
+	TokenFile string
+	CAFile    string
+	Namespace string
+}
+
+// Client is a minimal Kubernetes API client, just enough for reading and
+// writing Secrets and Leases without pulling in client-go
+type Client struct {
+	host      string
+	tokenFile string
+	namespace string
+	http      *http.Client
+}
+
+// Error is returned for non 2xx responses of the API server
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("kubernetes api: %d %s", e.Code, e.Message)
+}
+
+// IsNotFound reports whether err is a 404 API error
+func IsNotFound(err error) bool {
+	var kerr *Error
+	return errors.As(err, &kerr) && kerr.Code == http.StatusNotFound
+}
+
+// IsConflict reports whether err is a 409 API error
+func IsConflict(err error) bool {
+	var kerr *Error
+	return errors.As(err, &kerr) && kerr.Code == http.StatusConflict
+}
+
+// NewClient creates a new Kubernetes API client
+func NewClient(cfg Config) (*Client, error) {
+
+	if cfg.Host == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, errors.New("not running in a kubernetes cluster and no api server configured")
+		}
+		cfg.Host = "https://" + net.JoinHostPort(host, port)
+	}
+	if cfg.TokenFile == "" {
+		cfg.TokenFile = tokenFile
+	}
+	if cfg.Namespace == "" {
+		ns, err := os.ReadFile(namespaceFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read namespace: %w", err)
+		}
+		cfg.Namespace = strings.TrimSpace(string(ns))
+	}
+
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	ca := cfg.CAFile
+	if ca == "" {
+		ca = caFile
+	}
+	if pem, err := os.ReadFile(ca); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		tlsConfig.RootCAs = pool
+	} else if cfg.CAFile != "" {
+		return nil, fmt.Errorf("could not read kubernetes ca: %w", err)
+	}
+
+	return &Client{
+		host:      strings.TrimSuffix(cfg.Host, "/"),
+		tokenFile: cfg.TokenFile,
+		namespace: cfg.Namespace,
+		http: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}, nil
+}
+
+// Namespace returns the namespace the client operates in
+func (c *Client) Namespace() string {
+	return c.namespace
+}
+
+// Do sends a JSON request to the API server and decodes the response into out
+func (c *Client) Do(ctx context.Context, method, path string, in, out any) error {
+
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.host+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	// the token is read on every request as projected tokens are rotated
+	if token, err := os.ReadFile(c.tokenFile); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		status := struct {
+			Message string `json:"message"`
+		}{}
+		_ = json.Unmarshal(data, &status)
+		return &Error{Code: resp.StatusCode, Message: status.Message}
+	}
+
+	if out != nil {
+		return json.Unmarshal(data, out)
+	}
+
+	return nil
+}
+
+// ObjectMeta holds the metadata fields used by this client
+type ObjectMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
@@ -0,0 +1,333 @@
+package nodes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+// Status is the approval state of a node
+type Status string
+
+const (
+	// Pending nodes wait for an operator to approve them
+	Pending Status = "pending"
+	// Approved nodes may seal and unseal
+	Approved Status = "approved"
+	// Revoked nodes are rejected until they are unrevoked
+	Revoked Status = "revoked"
+)
+
+var (
+	// ErrPending is returned by Check for nodes waiting for approval
+	ErrPending = errors.New("node is pending approval")
+	// ErrRevoked is returned by Check and Approve for revoked nodes
+	ErrRevoked = errors.New("node is revoked")
+	// ErrNotRevoked is returned by Unrevoke for nodes that are not revoked
+	ErrNotRevoked = errors.New("node is not revoked")
+)
+
+// Node is a Talos node known to the proxy
+type Node struct {
+	UUID string `json:"uuid"`
+	// Tenant is the server name of the tenant, empty for the default key
+	Tenant    string    `json:"tenant,omitempty"`
+	Status    Status    `json:"status"`
+	FirstSeen time.Time `json:"firstSeen,omitempty"`
+	LastSeen  time.Time `json:"lastSeen,omitempty"`
+	// Address is the remote address of the last request
+	Address string `json:"address,omitempty"`
+}
+
+// key identifies a node, the same node UUID may appear in several tenants
+type key struct {
+	tenant string
+	uuid   string
+}
+
+// Registry keeps track of the nodes sending seal and unseal requests
+// New nodes are approved on first use, or wait for an operator if
+// approval is required. Every tenant has its own registry in the storage,
+// which is written whenever a node is added or changes its status. Last
+// seen times are kept in memory and written along with the next change.
+type Registry struct {
+	storage         storage.Storage
+	requireApproval atomic.Bool
+
+	mu sync.Mutex
+	// tenants are loaded by Load in addition to the default key
+	tenants []string
+	nodes   map[key]*Node
+}
+
+// file is the format of the persisted registry
+type file struct {
+	Nodes []*Node `json:"nodes"`
+}
+
+var (
+	logger = log.With().Str("service", "nodes").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// New creates a node registry persisted in storage
+func New(s storage.Storage, requireApproval bool) *Registry {
+
+	r := &Registry{storage: s, nodes: map[key]*Node{}}
+	r.requireApproval.Store(requireApproval)
+
+	return r
+}
+
+// SetRequireApproval changes whether new nodes must be approved, nodes
+// already known keep their status
+func (r *Registry) SetRequireApproval(required bool) {
+	r.requireApproval.Store(required)
+}
+
+// SetTenants sets the tenants whose registries are read by Load, the
+// registries of other tenants are read on the first request
+func (r *Registry) SetTenants(tenants []string) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.tenants = tenants
+}
+
+// Load reads the registries of the default key and all tenants from storage
+func (r *Registry) Load(ctx context.Context) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, tenant := range append([]string{""}, r.tenants...) {
+		if err := r.load(ctx, tenant); err != nil {
+			if tenant != "" {
+				err = fmt.Errorf("tenant %s: %w", tenant, err)
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Reload re-reads the registry from storage, e.g. to pick up changes made
+// through another replica sharing the storage
+func (r *Registry) Reload(ctx context.Context) error {
+	return r.Load(ctx)
+}
+
+func (r *Registry) String() string {
+	return "node registry"
+}
+
+// Check registers the node on its first request and returns an error if
+// it may not seal or unseal
+func (r *Registry) Check(ctx context.Context, tenant, uuid, address string) error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if n, ok := r.nodes[key{tenant, uuid}]; ok {
+		n.LastSeen, n.Address = now, address
+		return n.Status.err()
+	}
+
+	// another replica sharing the storage may know the node already
+	if err := r.load(ctx, tenant); err != nil {
+		return fmt.Errorf("could not read node registry: %w", err)
+	}
+	if n, ok := r.nodes[key{tenant, uuid}]; ok {
+		n.LastSeen, n.Address = now, address
+		return n.Status.err()
+	}
+
+	requireApproval := r.requireApproval.Load()
+	status := Approved
+	if requireApproval {
+		status = Pending
+	}
+	n := &Node{UUID: uuid, Tenant: tenant, Status: status, FirstSeen: now, LastSeen: now, Address: address}
+	if err := r.update(ctx, n); err != nil {
+		if requireApproval {
+			return fmt.Errorf("could not register node: %w", err)
+		}
+		// a storage outage must not keep nodes from booting if they are
+		// approved on first use anyway
+		logger.Warn().Err(err).Msgf("could not persist new node %s", uuid)
+		r.nodes[key{tenant, uuid}] = n
+	}
+	logger.Info().Msgf("registered new node %s as %s", uuid, status)
+
+	return status.err()
+}
+
+// List returns the known nodes sorted by tenant and UUID
+func (r *Registry) List() []Node {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	list := make([]Node, 0, len(r.nodes))
+	for _, n := range r.nodes {
+		list = append(list, *n)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Tenant != list[j].Tenant {
+			return list[i].Tenant < list[j].Tenant
+		}
+		return list[i].UUID < list[j].UUID
+	})
+
+	return list
+}
+
+// Approve allows a pending or unknown node to seal and unseal
+// Revoked nodes must be unrevoked instead.
+func (r *Registry) Approve(ctx context.Context, tenant, uuid string) (Node, error) {
+
+	return r.setStatus(ctx, tenant, uuid, func(current Status) (Status, error) {
+		if current == Revoked {
+			return "", fmt.Errorf("%w, unrevoke it instead", ErrRevoked)
+		}
+		return Approved, nil
+	})
+}
+
+// Revoke rejects all further requests of the node, unknown nodes are
+// added as revoked before their first request
+func (r *Registry) Revoke(ctx context.Context, tenant, uuid string) (Node, error) {
+
+	return r.setStatus(ctx, tenant, uuid, func(Status) (Status, error) {
+		return Revoked, nil
+	})
+}
+
+// Unrevoke approves a revoked node again
+func (r *Registry) Unrevoke(ctx context.Context, tenant, uuid string) (Node, error) {
+
+	return r.setStatus(ctx, tenant, uuid, func(current Status) (Status, error) {
+		if current != Revoked {
+			return "", ErrNotRevoked
+		}
+		return Approved, nil
+	})
+}
+
+// setStatus changes the status of a node and persists the registry
+func (r *Registry) setStatus(ctx context.Context, tenant, uuid string, next func(Status) (Status, error)) (Node, error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// apply the change to the latest stored version, another replica may
+	// have changed it meanwhile
+	if err := r.load(ctx, tenant); err != nil {
+		return Node{}, err
+	}
+
+	n := &Node{UUID: uuid, Tenant: tenant}
+	if current, ok := r.nodes[key{tenant, uuid}]; ok {
+		copied := *current
+		n = &copied
+	}
+	status, err := next(n.Status)
+	if err != nil {
+		return Node{}, err
+	}
+	n.Status = status
+	if err := r.update(ctx, n); err != nil {
+		return Node{}, err
+	}
+	logger.Info().Msgf("node %s is %s", uuid, status)
+
+	return *n, nil
+}
+
+// load replaces the in-memory nodes of the tenant with the stored ones,
+// keeping the newer last seen times of this replica
+func (r *Registry) load(ctx context.Context, tenant string) error {
+
+	data, err := storage.ForTenant(r.storage, tenant).Get(ctx, storage.NodesKey)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var f file
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("invalid node registry: %w", err)
+	}
+
+	nodes := make(map[key]*Node, len(f.Nodes))
+	for _, n := range f.Nodes {
+		// a registry only holds the nodes of its own tenant
+		if n.Tenant != tenant {
+			continue
+		}
+		k := key{n.Tenant, n.UUID}
+		if current, ok := r.nodes[k]; ok && current.LastSeen.After(n.LastSeen) {
+			n.LastSeen, n.Address = current.LastSeen, current.Address
+		}
+		nodes[k] = n
+	}
+	for k, n := range r.nodes {
+		if k.tenant != tenant {
+			nodes[k] = n
+		}
+	}
+	r.nodes = nodes
+
+	return nil
+}
+
+// update stores the node and writes the registry of its tenant, the
+// in-memory registry is only changed if the write succeeds
+func (r *Registry) update(ctx context.Context, n *Node) error {
+
+	f := file{Nodes: []*Node{n}}
+	for k, current := range r.nodes {
+		if k.tenant == n.Tenant && k.uuid != n.UUID {
+			f.Nodes = append(f.Nodes, current)
+		}
+	}
+	sort.Slice(f.Nodes, func(i, j int) bool { return f.Nodes[i].UUID < f.Nodes[j].UUID })
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := storage.ForTenant(r.storage, n.Tenant).Put(ctx, storage.NodesKey, data); err != nil {
+		return err
+	}
+	r.nodes[key{n.Tenant, n.UUID}] = n
+
+	return nil
+}
+
+// err returns the error of requests by nodes with the status
+func (s Status) err() error {
+
+	switch s {
+	case Pending:
+		return ErrPending
+	case Revoked:
+		return ErrRevoked
+	}
+
+	return nil
+}
@@ -0,0 +1,167 @@
+package nodes
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.openresearch.com/talos-kms-proxy/internal/storage"
+)
+
+func TestRegistry(t *testing.T) {
+
+	ctx := context.Background()
+
+	tests := []struct {
+		name            string
+		requireApproval bool
+		// change is applied to the node after its first request
+		change  func(r *Registry) error
+		wantErr error
+	}{
+		{
+			name: "approved on first use",
+		},
+		{
+			name:            "pending until approved",
+			requireApproval: true,
+			wantErr:         ErrPending,
+		},
+		{
+			name:            "approved",
+			requireApproval: true,
+			change: func(r *Registry) error {
+				_, err := r.Approve(ctx, "", "node-a")
+				return err
+			},
+		},
+		{
+			name: "revoked",
+			change: func(r *Registry) error {
+				_, err := r.Revoke(ctx, "", "node-a")
+				return err
+			},
+			wantErr: ErrRevoked,
+		},
+		{
+			name: "unrevoked",
+			change: func(r *Registry) error {
+				if _, err := r.Revoke(ctx, "", "node-a"); err != nil {
+					return err
+				}
+				_, err := r.Unrevoke(ctx, "", "node-a")
+				return err
+			},
+		},
+		{
+			name: "revocation of another tenant",
+			change: func(r *Registry) error {
+				_, err := r.Revoke(ctx, "cluster-b.example.com", "node-a")
+				return err
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			store := storage.NewLocal(t.TempDir())
+			r := New(store, tt.requireApproval)
+			if err := r.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			first := r.Check(ctx, "", "node-a", "192.0.2.1:1234")
+			if tt.requireApproval && !errors.Is(first, ErrPending) {
+				t.Fatalf("first request: got %v, want ErrPending", first)
+			} else if !tt.requireApproval && first != nil {
+				t.Fatalf("first request: %v", first)
+			}
+
+			if tt.change != nil {
+				if err := tt.change(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := r.Check(ctx, "", "node-a", "192.0.2.1:1234"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+
+			// a second replica sharing the storage sees the same status
+			other := New(store, false)
+			if err := other.Load(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if err := other.Check(ctx, "", "node-a", "192.0.2.2:1234"); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("second replica: got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRegistryTransitions(t *testing.T) {
+
+	ctx := context.Background()
+	r := New(storage.NewLocal(t.TempDir()), false)
+
+	if _, err := r.Unrevoke(ctx, "", "node-a"); !errors.Is(err, ErrNotRevoked) {
+		t.Fatalf("unrevoke of an unknown node: got %v, want ErrNotRevoked", err)
+	}
+
+	// nodes can be revoked before their first request
+	n, err := r.Revoke(ctx, "", "node-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Status != Revoked || !n.FirstSeen.IsZero() {
+		t.Fatalf("got %+v, want a revoked node never seen", n)
+	}
+	if _, err := r.Approve(ctx, "", "node-a"); !errors.Is(err, ErrRevoked) {
+		t.Fatalf("approve of a revoked node: got %v, want ErrRevoked", err)
+	}
+
+	list := r.List()
+	if len(list) != 1 || list[0].UUID != "node-a" || list[0].Status != Revoked {
+		t.Fatalf("got %+v, want the revoked node", list)
+	}
+}
+
+func TestTenantRegistries(t *testing.T) {
+
+	ctx := context.Background()
+	store := storage.NewLocal(t.TempDir())
+	r := New(store, false)
+
+	if err := r.Check(ctx, "", "node-a", "192.0.2.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Revoke(ctx, "cluster-b.example.com", "node-a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// every tenant has its own registry in the storage
+	tenant := storage.ForTenant(store, "cluster-b.example.com")
+	for _, s := range []storage.Storage{store, tenant} {
+		data, err := s.Get(ctx, storage.NodesKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := strings.Count(string(data), `"uuid"`); n != 1 {
+			t.Fatalf("%s holds %d nodes, want 1", s, n)
+		}
+	}
+
+	// the registries of the tenants are read at startup
+	other := New(store, false)
+	other.SetTenants([]string{"cluster-b.example.com"})
+	if err := other.Load(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if list := other.List(); len(list) != 2 || list[1].Tenant != "cluster-b.example.com" || list[1].Status != Revoked {
+		t.Fatalf("got %+v, want the nodes of both registries", list)
+	}
+	if err := other.Check(ctx, "", "node-a", "192.0.2.2:1234"); err != nil {
+		t.Fatalf("default key: %v", err)
+	}
+}
@@ -0,0 +1,212 @@
+package ocsp
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/crypto/ocsp"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+)
+
+const (
+	// retryDelay is the time to wait after a failed OCSP request
+	retryDelay = 10 * time.Minute
+
+	// defaultRefresh is used when the responder does not set NextUpdate
+	defaultRefresh = 12 * time.Hour
+
+	// maxResponseSize limits the size of an OCSP response
+	maxResponseSize = 1 << 20
+)
+
+var (
+	logger = log.With().Str("service", "ocsp").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// Stapler fetches OCSP responses for the current server certificate and
+// staples them to the certificate in the store
+type Stapler struct {
+	certStore *certstore.Store
+	client    *http.Client
+	enabled   atomic.Bool
+	toggled   chan struct{}
+}
+
+// New creates a new OCSP stapling service, stapling can be enabled and
+// disabled while it runs
+func New(certStore *certstore.Store, enabled bool) *Stapler {
+
+	s := &Stapler{
+		certStore: certStore,
+		client:    &http.Client{Timeout: 30 * time.Second},
+		toggled:   make(chan struct{}, 1),
+	}
+	s.enabled.Store(enabled)
+
+	return s
+}
+
+// SetEnabled enables or disables stapling, disabling removes the staple
+// of the current certificate
+func (s *Stapler) SetEnabled(enabled bool) {
+
+	if s.enabled.Swap(enabled) == enabled {
+		return
+	}
+	select {
+	case s.toggled <- struct{}{}:
+	default:
+	}
+}
+
+// Serve implements the suture service
+// It staples every new certificate and refreshes the staple before the
+// OCSP response expires
+func (s *Stapler) Serve(ctx context.Context) error {
+
+	logger.Info().Msg("starting")
+
+	updates, cancel := s.certStore.Subscribe()
+	defer cancel()
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	current := s.certStore.Current()
+	if current == nil || !s.enabled.Load() {
+		timer.Stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case b := <-updates:
+			current = b
+			if s.enabled.Load() {
+				timer.Reset(0)
+			}
+		case <-s.toggled:
+			if s.enabled.Load() {
+				logger.Info().Msg("OCSP stapling enabled")
+				timer.Reset(0)
+				continue
+			}
+			logger.Info().Msg("OCSP stapling disabled")
+			timer.Stop()
+			if current != nil && current.Certificate.OCSPStaple != nil {
+				if unstapled := s.certStore.Staple(current, nil); unstapled != nil {
+					current = unstapled
+				}
+			}
+		case <-timer.C:
+			if current == nil || !s.enabled.Load() {
+				continue
+			}
+			next, err := s.staple(ctx, current)
+			switch {
+			case errors.Is(err, errNoResponder):
+				logger.Debug().Msg("certificate has no OCSP responder, not stapling")
+				continue
+			case err != nil:
+				logger.Warn().Err(err).Msgf("could not staple OCSP response, retrying in %s", retryDelay)
+				timer.Reset(retryDelay)
+				continue
+			}
+			if next == nil {
+				// the certificate has been replaced, wait for the update
+				continue
+			}
+			current = next
+			refresh := refreshTime(current)
+			timer.Reset(time.Until(refresh))
+			logger.Info().Msgf("stapled OCSP response, next refresh at %s", refresh.Local())
+		}
+	}
+}
+
+// errNoResponder is returned for certificates without OCSP server
+var errNoResponder = errors.New("no OCSP responder")
+
+// staple fetches an OCSP response for the bundle and attaches it
+// it returns the stapled bundle, or nil if the bundle is no longer current
+func (s *Stapler) staple(ctx context.Context, b *certstore.Bundle) (*certstore.Bundle, error) {
+
+	leaf := b.Leaf
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errNoResponder
+	}
+	if len(b.Certificate.Certificate) < 2 {
+		return nil, errors.New("certificate chain does not contain the issuer")
+	}
+	issuer, err := x509.ParseCertificate(b.Certificate.Certificate[1])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse issuer: %w", err)
+	}
+
+	req, err := ocsp.CreateRequest(leaf, issuer, &ocsp.RequestOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := s.fetch(ctx, leaf.OCSPServer[0], req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+	if resp.Status != ocsp.Good {
+		return nil, fmt.Errorf("OCSP responder reports certificate status %d", resp.Status)
+	}
+
+	return s.certStore.Staple(b, raw), nil
+}
+
+// fetch posts the OCSP request to the responder
+func (s *Stapler) fetch(ctx context.Context, server string, req []byte) ([]byte, error) {
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, server, bytes.NewReader(req))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", "application/ocsp-request")
+	httpReq.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := s.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", server, resp.Status)
+	}
+
+	return io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+}
+
+// refreshTime returns the time half way through the validity of the
+// stapled OCSP response
+func refreshTime(b *certstore.Bundle) time.Time {
+
+	resp, err := ocsp.ParseResponse(b.Certificate.OCSPStaple, nil)
+	if err != nil || resp.NextUpdate.IsZero() {
+		return time.Now().Add(defaultRefresh)
+	}
+
+	return resp.ThisUpdate.Add(resp.NextUpdate.Sub(resp.ThisUpdate) / 2)
+}
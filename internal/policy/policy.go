@@ -0,0 +1,326 @@
+package policy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+	"gopkg.in/yaml.v3"
+
+	"github.openresearch.com/talos-kms-proxy/internal/config"
+)
+
+var (
+	// ErrNodeNotAllowed is returned by Check for nodes missing from the
+	// allowlist of their tenant
+	ErrNodeNotAllowed = errors.New("node is not allowed by the node policy")
+	// ErrNetworkNotAllowed is returned by Check for requests from outside
+	// the networks of the tenant
+	ErrNetworkNotAllowed = errors.New("address is not allowed by the node policy")
+	// ErrRateLimited is returned by Check for nodes exceeding their rate
+	ErrRateLimited = errors.New("node exceeded its rate limit")
+)
+
+// Rule restricts the seal and unseal requests of the nodes of a tenant
+type Rule struct {
+	// Tenant is the server name of the tenant, empty for the default key
+	Tenant string `yaml:"tenant"`
+	// Nodes are the UUIDs of the nodes that may send requests, all nodes
+	// may if empty
+	Nodes []string `yaml:"nodes"`
+	// AllowlistFile is a file with further node UUIDs, one per line,
+	// relative paths are relative to the policy file
+	AllowlistFile string `yaml:"allowlist-file"`
+	// Networks are the prefixes requests may come from, all addresses
+	// may if empty
+	Networks []string `yaml:"networks"`
+	// RateLimit is the number of requests per minute of every node, zero
+	// disables the limit
+	RateLimit int `yaml:"rate-limit"`
+	// Burst is the number of requests a node may send at once, it
+	// defaults to the rate limit
+	Burst int `yaml:"burst"`
+}
+
+// file is the format of the policy file
+type file struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+// Policy is a parsed and validated policy file
+// Tenants without a rule are not restricted.
+type Policy struct {
+	Path  string
+	rules map[string]*rule
+}
+
+// rule is the parsed form of a Rule
+type rule struct {
+	// allowlist is set if only the nodes may send requests
+	allowlist bool
+	nodes     map[string]bool
+	networks  []netip.Prefix
+	limit     rate.Limit
+	burst     int
+}
+
+// Load reads and validates a YAML policy file
+func Load(path string) (*Policy, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var f file
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&f); err != nil && !errors.Is(err, io.EOF) {
+		return nil, &config.Error{Path: path, Err: err}
+	}
+
+	// the positions of the rules point the errors to the invalid field
+	var positions struct {
+		Rules []yaml.Node `yaml:"rules"`
+	}
+	yaml.Unmarshal(data, &positions)
+
+	p := &Policy{Path: path, rules: make(map[string]*rule, len(f.Rules))}
+	for i, r := range f.Rules {
+		fail := func(field string, err error) error {
+			e := &config.Error{Path: path, Field: fmt.Sprintf("rules[%d].%s", i, field), Err: err}
+			if i < len(positions.Rules) {
+				e.Line, e.Column = positions.Rules[i].Line, positions.Rules[i].Column
+			}
+			return e
+		}
+
+		tenant := strings.ToLower(strings.TrimSpace(r.Tenant))
+		if _, ok := p.rules[tenant]; ok {
+			return nil, fail("tenant", fmt.Errorf("duplicate rule for tenant %q", tenant))
+		}
+
+		// an empty allowlist file rejects all nodes instead of allowing all
+		parsed := &rule{nodes: make(map[string]bool, len(r.Nodes)), allowlist: len(r.Nodes) > 0 || r.AllowlistFile != ""}
+		for j, node := range r.Nodes {
+			node = strings.TrimSpace(node)
+			if node == "" {
+				return nil, fail(fmt.Sprintf("nodes[%d]", j), errors.New("empty node uuid"))
+			}
+			parsed.nodes[node] = true
+		}
+		if r.AllowlistFile != "" {
+			allowlist := r.AllowlistFile
+			if !filepath.IsAbs(allowlist) {
+				allowlist = filepath.Join(filepath.Dir(path), allowlist)
+			}
+			nodes, err := readAllowlist(allowlist)
+			if err != nil {
+				return nil, fail("allowlist-file", err)
+			}
+			for _, node := range nodes {
+				parsed.nodes[node] = true
+			}
+		}
+		for j, network := range r.Networks {
+			prefix, err := parsePrefix(network)
+			if err != nil {
+				return nil, fail(fmt.Sprintf("networks[%d]", j), err)
+			}
+			parsed.networks = append(parsed.networks, prefix)
+		}
+		if r.RateLimit < 0 {
+			return nil, fail("rate-limit", errors.New("must not be negative"))
+		}
+		if r.Burst < 0 {
+			return nil, fail("burst", errors.New("must not be negative"))
+		}
+		if r.RateLimit > 0 {
+			parsed.limit = rate.Every(time.Minute / time.Duration(r.RateLimit))
+			parsed.burst = r.Burst
+			if parsed.burst == 0 {
+				parsed.burst = r.RateLimit
+			}
+		}
+
+		p.rules[tenant] = parsed
+	}
+
+	return p, nil
+}
+
+// Tenants returns the number of tenants with a rule
+func (p *Policy) Tenants() int {
+	return len(p.rules)
+}
+
+// readAllowlist reads the node UUIDs of an allowlist file, empty lines
+// and lines starting with # are skipped
+func readAllowlist(path string) ([]string, error) {
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.ContainsAny(line, " \t") {
+			return nil, fmt.Errorf("%s:%d: invalid node uuid %q", path, i+1, line)
+		}
+		nodes = append(nodes, line)
+	}
+
+	return nodes, nil
+}
+
+// parsePrefix parses a network prefix or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		return prefix.Masked(), err
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// limiterKey identifies the rate limiter of a node
+type limiterKey struct {
+	tenant string
+	node   string
+}
+
+// Enforcer checks requests against the current policy
+type Enforcer struct {
+	policy atomic.Pointer[Policy]
+
+	mu       sync.Mutex
+	limiters map[limiterKey]*rate.Limiter
+}
+
+// NewEnforcer creates an enforcer for the policy, a nil policy allows
+// all requests
+func NewEnforcer(p *Policy) *Enforcer {
+
+	e := &Enforcer{}
+	e.Set(p)
+
+	return e
+}
+
+// Set replaces the policy, the rate limits of all nodes start over
+func (e *Enforcer) Set(p *Policy) {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.policy.Store(p)
+	e.limiters = map[limiterKey]*rate.Limiter{}
+}
+
+// Check returns an error if the policy of the tenant rejects the request
+// of the node from address
+func (e *Enforcer) Check(tenant, node, address string) error {
+
+	p := e.policy.Load()
+	if p == nil {
+		return nil
+	}
+	r, ok := p.rules[tenant]
+	if !ok {
+		return nil
+	}
+
+	if r.allowlist && !r.nodes[node] {
+		return ErrNodeNotAllowed
+	}
+	if len(r.networks) > 0 && !r.allowed(address) {
+		return fmt.Errorf("%w: %s", ErrNetworkNotAllowed, address)
+	}
+	if r.limit > 0 && !e.limiter(tenant, node, r).Allow() {
+		return ErrRateLimited
+	}
+
+	return nil
+}
+
+// allowed reports whether the address is in one of the networks
+func (r *rule) allowed(address string) bool {
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return false
+	}
+	addr := addrPort.Addr().Unmap()
+	for _, prefix := range r.networks {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// limiter returns the rate limiter of the node
+func (e *Enforcer) limiter(tenant, node string, r *rule) *rate.Limiter {
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	k := limiterKey{tenant, node}
+	l, ok := e.limiters[k]
+	if !ok {
+		l = rate.NewLimiter(r.limit, r.burst)
+		e.limiters[k] = l
+	}
+
+	return l
+}
+
+// Reload re-reads the policy file and the allowlist files it refers to,
+// the current policy is kept if one of them is invalid
+func (e *Enforcer) Reload(ctx context.Context) error {
+
+	current := e.policy.Load()
+	if current == nil {
+		return nil
+	}
+	p, err := Load(current.Path)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// a configuration reload may have replaced the policy meanwhile
+	if e.policy.CompareAndSwap(current, p) {
+		e.limiters = map[limiterKey]*rate.Limiter{}
+	}
+
+	return nil
+}
+
+func (e *Enforcer) String() string {
+	return "node policy"
+}
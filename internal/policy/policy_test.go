@@ -0,0 +1,184 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPolicy = `
+rules:
+  - nodes: [node-a, node-b]
+  - tenant: KMS.Prod.Example.com
+    networks: [10.0.0.0/8, "2001:db8::1"]
+    rate-limit: 2
+`
+
+// writePolicy writes a policy file to a temporary directory
+func writePolicy(t *testing.T, content string) string {
+
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestCheck(t *testing.T) {
+
+	p, err := Load(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		tenant  string
+		node    string
+		address string
+		wantErr error
+	}{
+		{name: "allowed node", node: "node-a", address: "192.0.2.1:1234"},
+		{name: "unknown node", node: "node-c", address: "192.0.2.1:1234", wantErr: ErrNodeNotAllowed},
+		{name: "tenant without rule", tenant: "kms.staging.example.com", node: "node-c"},
+		{name: "allowed network", tenant: "kms.prod.example.com", node: "node-c", address: "10.1.2.3:1234"},
+		{name: "allowed address", tenant: "kms.prod.example.com", node: "node-d", address: "[2001:db8::1]:1234"},
+		{name: "mapped address", tenant: "kms.prod.example.com", node: "node-e", address: "[::ffff:10.0.0.1]:1234"},
+		{name: "other network", tenant: "kms.prod.example.com", node: "node-c", address: "192.0.2.1:1234", wantErr: ErrNetworkNotAllowed},
+		{name: "no address", tenant: "kms.prod.example.com", node: "node-c", wantErr: ErrNetworkNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			e := NewEnforcer(p)
+			if err := e.Check(tt.tenant, tt.node, tt.address); !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+
+	p, err := Load(writePolicy(t, testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEnforcer(p)
+
+	// the burst defaults to the rate limit
+	for i := range 2 {
+		if err := e.Check("kms.prod.example.com", "node-a", "10.0.0.1:1234"); err != nil {
+			t.Fatalf("request %d: %v", i+1, err)
+		}
+	}
+	if err := e.Check("kms.prod.example.com", "node-a", "10.0.0.1:1234"); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("got %v, want %v", err, ErrRateLimited)
+	}
+
+	// every node has its own limit
+	if err := e.Check("kms.prod.example.com", "node-b", "10.0.0.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new policy starts over
+	e.Set(p)
+	if err := e.Check("kms.prod.example.com", "node-a", "10.0.0.1:1234"); err != nil {
+		t.Fatal(err)
+	}
+
+	// without a policy all requests are allowed
+	e.Set(nil)
+	if err := e.Check("", "node-c", ""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{name: "empty", content: ""},
+		{name: "unknown field", content: "rules:\n  - nodez: [a]\n", wantErr: "field nodez not found"},
+		{name: "duplicate tenant", content: "rules:\n  - nodes: [a]\n  - tenant: \"\"\n", wantErr: `"rules[1].tenant"`},
+		{name: "invalid network", content: "rules:\n  - tenant: a\n  - networks: [10.0.0.0/33]\n", wantErr: `:3:5: field "rules[1].networks[0]"`},
+		{name: "negative rate", content: "rules:\n  - rate-limit: -1\n", wantErr: `"rules[0].rate-limit"`},
+		{name: "empty node", content: "rules:\n  - nodes: [\"\"]\n", wantErr: `"rules[0].nodes[0]"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			_, err := Load(writePolicy(t, tt.content))
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got %v, want an error containing %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+
+	ctx := context.Background()
+	path := writePolicy(t, "rules:\n  - allowlist-file: nodes.txt\n")
+	allowlist := filepath.Join(filepath.Dir(path), "nodes.txt")
+	if err := os.WriteFile(allowlist, []byte("# workers\nnode-a\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := NewEnforcer(p)
+	if err := e.Check("", "node-b", ""); !errors.Is(err, ErrNodeNotAllowed) {
+		t.Fatalf("got %v, want %v", err, ErrNodeNotAllowed)
+	}
+
+	// a new allowlist is picked up on reload
+	if err := os.WriteFile(allowlist, []byte("node-a\nnode-b\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Check("", "node-b", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// an invalid allowlist keeps the current policy
+	if err := os.WriteFile(allowlist, []byte("node a\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(ctx); err == nil || !strings.Contains(err.Error(), "nodes.txt:1") {
+		t.Fatalf("got %v, want an error pointing to the allowlist line", err)
+	}
+	if err := e.Check("", "node-b", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// an empty allowlist rejects all nodes
+	if err := os.WriteFile(allowlist, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Reload(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Check("", "node-a", ""); !errors.Is(err, ErrNodeNotAllowed) {
+		t.Fatalf("got %v, want %v", err, ErrNodeNotAllowed)
+	}
+}
@@ -0,0 +1,74 @@
+package reload
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// Reloader is implemented by services that re-read their files on SIGHUP
+type Reloader interface {
+	Reload(ctx context.Context) error
+	String() string
+}
+
+var (
+	logger = log.With().Str("service", "reload").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// Signal reloads all registered services when the process receives SIGHUP
+type Signal struct {
+	reloaders []Reloader
+}
+
+// New creates a new SIGHUP reload service
+func New(reloaders ...Reloader) *Signal {
+	return &Signal{reloaders: reloaders}
+}
+
+// Serve implements the suture service
+func (s *Signal) Serve(ctx context.Context) error {
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			s.reload(ctx)
+		}
+	}
+}
+
+// reload reloads every service and logs the results, a failing service
+// does not keep the others from reloading
+func (s *Signal) reload(ctx context.Context) {
+
+	logger.Info().Msg("received SIGHUP, reloading")
+
+	start := time.Now()
+	failed := 0
+	for _, r := range s.reloaders {
+		if err := r.Reload(ctx); err != nil {
+			failed++
+			logger.Error().Err(err).Msgf("reloading %s failed", r)
+			continue
+		}
+		logger.Info().Msgf("reloaded %s", r)
+	}
+
+	if failed > 0 {
+		logger.Warn().Msgf("reload finished with %d of %d failures in %s",
+			failed, len(s.reloaders), time.Since(start).Round(time.Millisecond))
+		return
+	}
+	logger.Info().Msgf("reload finished in %s", time.Since(start).Round(time.Millisecond))
+}
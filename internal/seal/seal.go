@@ -0,0 +1,67 @@
+package seal
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+)
+
+// blockType is the PEM block type used for sealed data
+const blockType = "TALOS KMS SEALED DATA"
+
+// ErrNoSealer is returned when sealed data is read without a sealer
+var ErrNoSealer = errors.New("data is sealed but no key backend is configured")
+
+// Sealer encrypts and decrypts small secrets with a key backend
+type Sealer interface {
+	Seal(ctx context.Context, plaintext []byte) ([]byte, error)
+	Unseal(ctx context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// Encode seals data with the sealer and wraps the ciphertext in a PEM block
+// if the sealer is nil the data is returned unchanged
+func Encode(ctx context.Context, s Sealer, data []byte) ([]byte, error) {
+
+	if s == nil {
+		return data, nil
+	}
+
+	ciphertext, err := s.Seal(ctx, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  blockType,
+		Bytes: ciphertext,
+	}), nil
+}
+
+// Decode unseals data created by Encode
+// plaintext data is returned unchanged, with sealed set to false, so that
+// callers can migrate existing unencrypted files
+func Decode(ctx context.Context, s Sealer, data []byte) (plaintext []byte, sealed bool, err error) {
+
+	if !IsSealed(data) {
+		return data, false, nil
+	}
+	if s == nil {
+		return nil, true, ErrNoSealer
+	}
+
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	plaintext, err = s.Unseal(ctx, block.Bytes)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return plaintext, true, nil
+}
+
+// IsSealed reports whether data was created by Encode
+func IsSealed(data []byte) bool {
+
+	block, _ := pem.Decode(bytes.TrimSpace(data))
+	return block != nil && block.Type == blockType
+}
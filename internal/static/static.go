@@ -0,0 +1,198 @@
+package static
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.openresearch.com/talos-kms-proxy/internal/certstore"
+)
+
+// debounce is the time to wait for further file events before reloading,
+// as tools like cert-manager update the certificate and key separately
+const debounce = time.Second
+
+// Static serves a user provided certificate and private key and reloads
+// them whenever the files change
+type Static struct {
+	certStore *certstore.Store
+	moved     chan struct{}
+
+	mu       sync.Mutex
+	certFile string
+	keyFile  string
+	current  *certstore.Bundle
+}
+
+var (
+	logger = log.With().Str("service", "static").Logger().Output(zerolog.ConsoleWriter{Out: os.Stdout})
+)
+
+// New creates a new static certificate service
+func New(certFile, keyFile string, certStore *certstore.Store) *Static {
+
+	return &Static{
+		certFile:  certFile,
+		keyFile:   keyFile,
+		certStore: certStore,
+		moved:     make(chan struct{}, 1),
+	}
+}
+
+// SetFiles changes the paths of the certificate and the private key, an
+// empty path keeps the current one. The files are loaded after the usual
+// debounce delay, so that both paths can be changed one after the other.
+func (s *Static) SetFiles(certFile, keyFile string) {
+
+	s.mu.Lock()
+	if certFile != "" {
+		s.certFile = certFile
+	}
+	if keyFile != "" {
+		s.keyFile = keyFile
+	}
+	s.mu.Unlock()
+
+	select {
+	case s.moved <- struct{}{}:
+	default:
+	}
+}
+
+// Serve implements the suture service
+// It loads the certificates and then watches the files for changes
+func (s *Static) Serve(ctx context.Context) error {
+
+	logger.Info().Msg("starting")
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// watch the directories instead of the files, so that atomic
+	// replacements and Kubernetes secret volume symlink swaps are seen
+	watched := map[string]bool{}
+	if err := s.watch(watcher, watched); err != nil {
+		return err
+	}
+
+	if err := s.reload(); err != nil {
+		return err
+	}
+
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			logger.Trace().Msgf("file event: %s", event)
+			timer.Reset(debounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Warn().Err(err).Msg("file watcher")
+		case <-s.moved:
+			if err := s.watch(watcher, watched); err != nil {
+				logger.Error().Err(err).Msg("could not watch the new certificate files")
+			}
+			timer.Reset(debounce)
+		case <-timer.C:
+			if err := s.reload(); err != nil {
+				logger.Error().Err(err).Msg("could not reload certificates, keeping current ones")
+			}
+		}
+	}
+}
+
+// watch updates the watched directories to those of the current files
+func (s *Static) watch(watcher *fsnotify.Watcher, watched map[string]bool) error {
+
+	s.mu.Lock()
+	dirs := map[string]bool{
+		filepath.Dir(s.certFile): true,
+		filepath.Dir(s.keyFile):  true,
+	}
+	s.mu.Unlock()
+
+	for dir := range watched {
+		if !dirs[dir] {
+			watcher.Remove(dir)
+			delete(watched, dir)
+		}
+	}
+	for dir := range dirs {
+		if watched[dir] {
+			continue
+		}
+		if err := watcher.Add(dir); err != nil {
+			return fmt.Errorf("could not watch %s: %w", dir, err)
+		}
+		watched[dir] = true
+	}
+
+	return nil
+}
+
+// reload reads the certificate and private key and passes them to the
+// kms service if they changed and form a valid key pair
+func (s *Static) reload() error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	crt, err := os.ReadFile(s.certFile)
+	if err != nil {
+		return err
+	}
+	pk, err := os.ReadFile(s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	if s.current != nil &&
+		bytes.Equal(s.current.CertPEM, crt) &&
+		bytes.Equal(s.current.KeyPEM, pk) {
+		return nil
+	}
+
+	bundle, err := certstore.NewBundle(crt, pk, "static")
+	if err != nil {
+		return fmt.Errorf("invalid certificate or private key: %w", err)
+	}
+	if err := certstore.Validate(bundle, certstore.ValidateOptions{SkipChain: true}); err != nil {
+		return err
+	}
+	s.certStore.Set(bundle)
+	s.current = bundle
+
+	logger.Info().Msgf("loaded certificate from %s", s.certFile)
+
+	return nil
+}
+
+// Reload re-reads the certificate and private key
+func (s *Static) Reload(ctx context.Context) error {
+	return s.reload()
+}
+
+func (s *Static) String() string {
+	return "static certificates"
+}
@@ -0,0 +1,165 @@
+package storage
+
+import (
+	"context"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.openresearch.com/talos-kms-proxy/internal/kube"
+)
+
+// maxConflictRetries bounds the retries of optimistic concurrency conflicts
+const maxConflictRetries = 5
+
+// encodedKeyPrefix marks secret keys holding a base32 encoded object name
+const encodedKeyPrefix = "b32."
+
+// keyEncoding encodes object names that are no valid secret keys
+var keyEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// secret is the subset of a Kubernetes Secret used by the storage
+type secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kube.ObjectMeta   `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data"`
+}
+
+// Kubernetes stores all objects as keys of a single Kubernetes Secret
+type Kubernetes struct {
+	client *kube.Client
+	name   string
+}
+
+// NewKubernetes creates a new Kubernetes Secret storage
+func NewKubernetes(client *kube.Client, name string) (*Kubernetes, error) {
+
+	if name == "" {
+		return nil, errors.New("kubernetes storage requires a secret name")
+	}
+
+	return &Kubernetes{client: client, name: name}, nil
+}
+
+// Get reads the key `name` from the secret
+func (k *Kubernetes) Get(ctx context.Context, name string) ([]byte, error) {
+
+	s, err := k.get(ctx)
+	if kube.IsNotFound(err) {
+		return nil, notExist(name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	data, ok := s.Data[secretKey(name)]
+	if !ok {
+		return nil, notExist(name)
+	}
+
+	return data, nil
+}
+
+// Put writes the key `name` to the secret, creating the secret if needed
+func (k *Kubernetes) Put(ctx context.Context, name string, data []byte) error {
+	return k.update(ctx, func(s *secret) {
+		s.Data[secretKey(name)] = data
+	})
+}
+
+// PutAll writes all keys to the secret with a single update
+func (k *Kubernetes) PutAll(ctx context.Context, objects ...Object) error {
+	return k.update(ctx, func(s *secret) {
+		for _, o := range objects {
+			s.Data[secretKey(o.Name)] = o.Data
+		}
+	})
+}
+
+// Delete removes the key `name` from the secret
+func (k *Kubernetes) Delete(ctx context.Context, name string) error {
+	return k.update(ctx, func(s *secret) {
+		delete(s.Data, secretKey(name))
+	})
+}
+
+func (k *Kubernetes) String() string {
+	return fmt.Sprintf("secret://%s/%s", k.client.Namespace(), k.name)
+}
+
+// update applies fn to the secret and writes it back
+// conflicting concurrent writes are retried with the latest version
+func (k *Kubernetes) update(ctx context.Context, fn func(*secret)) error {
+
+	for range maxConflictRetries {
+		s, err := k.get(ctx)
+		if kube.IsNotFound(err) {
+			s = &secret{
+				APIVersion: "v1",
+				Kind:       "Secret",
+				Metadata:   kube.ObjectMeta{Name: k.name, Namespace: k.client.Namespace()},
+				Type:       "Opaque",
+				Data:       map[string][]byte{},
+			}
+			fn(s)
+			err = k.client.Do(ctx, http.MethodPost, k.collection(), s, nil)
+		} else if err == nil {
+			if s.Data == nil {
+				s.Data = map[string][]byte{}
+			}
+			fn(s)
+			err = k.client.Do(ctx, http.MethodPut, k.path(), s, nil)
+		}
+
+		if kube.IsConflict(err) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not write secret %s: %w", k.name, err)
+		}
+		return nil
+	}
+
+	return fmt.Errorf("could not write secret %s: too many conflicts", k.name)
+}
+
+func (k *Kubernetes) get(ctx context.Context) (*secret, error) {
+
+	s := &secret{}
+	if err := k.client.Do(ctx, http.MethodGet, k.path(), nil, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (k *Kubernetes) collection() string {
+	return fmt.Sprintf("/api/v1/namespaces/%s/secrets", k.client.Namespace())
+}
+
+func (k *Kubernetes) path() string {
+	return fmt.Sprintf("%s/%s", k.collection(), k.name)
+}
+
+// secretKey maps an object name to a valid secret data key, which may
+// only contain [-._a-zA-Z0-9]
+// Names made of these characters and slashes keep the readable form of
+// earlier versions, with slashes replaced by underscores. All other names,
+// like the metadata of wildcard certificates, are base32 encoded behind a
+// prefix that no readable key starts with.
+func secretKey(name string) string {
+
+	if strings.HasPrefix(name, encodedKeyPrefix) || strings.IndexFunc(name, invalidKeyRune) >= 0 {
+		return encodedKeyPrefix + keyEncoding.EncodeToString([]byte(name))
+	}
+
+	return strings.ReplaceAll(name, "/", "_")
+}
+
+func invalidKeyRune(r rune) bool {
+	return !(r == '/' || r == '-' || r == '.' || r == '_' ||
+		(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9'))
+}
@@ -0,0 +1,259 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.openresearch.com/talos-kms-proxy/internal/kube"
+)
+
+// fakeSecrets is a minimal API server holding the secrets of one namespace
+// with optimistic concurrency on the resource version
+type fakeSecrets struct {
+	mu      sync.Mutex
+	secrets map[string]*secret
+	version int
+	// conflicts is the number of updates to reject with 409 Conflict
+	conflicts int
+	updates   int
+}
+
+func (f *fakeSecrets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	const collection = "/api/v1/namespaces/test/secrets"
+
+	name, named := "", false
+	if rest, ok := cutPath(r.URL.Path, collection+"/"); ok {
+		name, named = rest, true
+	} else if r.URL.Path != collection {
+		writeStatus(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodGet && named:
+		s, ok := f.secrets[name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "secret not found")
+			return
+		}
+		json.NewEncoder(w).Encode(s)
+
+	case r.Method == http.MethodPost && !named:
+		s := &secret{}
+		if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+			writeStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if _, ok := f.secrets[s.Metadata.Name]; ok {
+			writeStatus(w, http.StatusConflict, "already exists")
+			return
+		}
+		f.store(w, s)
+
+	case r.Method == http.MethodPut && named:
+		s := &secret{}
+		if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+			writeStatus(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		current, ok := f.secrets[name]
+		if !ok {
+			writeStatus(w, http.StatusNotFound, "secret not found")
+			return
+		}
+		if f.conflicts > 0 {
+			f.conflicts--
+			// another writer updated the secret in the meantime
+			f.version++
+			current.Metadata.ResourceVersion = strconv.Itoa(f.version)
+		}
+		if s.Metadata.ResourceVersion != current.Metadata.ResourceVersion {
+			writeStatus(w, http.StatusConflict, "the object has been modified")
+			return
+		}
+		f.store(w, s)
+
+	default:
+		writeStatus(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// store validates the data keys like the API server and saves the secret
+func (f *fakeSecrets) store(w http.ResponseWriter, s *secret) {
+
+	for key := range s.Data {
+		if key == "" || len(key) > 253 || invalidSecretKey(key) {
+			writeStatus(w, http.StatusUnprocessableEntity, "invalid data key "+strconv.Quote(key))
+			return
+		}
+	}
+
+	f.updates++
+	f.version++
+	s.Metadata.ResourceVersion = strconv.Itoa(f.version)
+	f.secrets[s.Metadata.Name] = s
+	json.NewEncoder(w).Encode(s)
+}
+
+func invalidSecretKey(key string) bool {
+
+	for _, r := range key {
+		if r == '/' || invalidKeyRune(r) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func cutPath(p, prefix string) (string, bool) {
+
+	if len(p) <= len(prefix) || p[:len(prefix)] != prefix {
+		return "", false
+	}
+
+	return p[len(prefix):], true
+}
+
+func writeStatus(w http.ResponseWriter, code int, message string) {
+
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"message": message})
+}
+
+func newFakeKubernetes(t *testing.T) (*Kubernetes, *fakeSecrets) {
+
+	t.Helper()
+
+	fake := &fakeSecrets{secrets: map[string]*secret{}}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+
+	client, err := kube.NewClient(kube.Config{
+		Host:      srv.URL,
+		TokenFile: filepath.Join(t.TempDir(), "token"),
+		Namespace: "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, err := NewKubernetes(client, "kms-proxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return k, fake
+}
+
+func TestKubernetes(t *testing.T) {
+
+	ctx := context.Background()
+	k, fake := newFakeKubernetes(t)
+
+	if _, err := k.Get(ctx, StateKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get without secret: got %v, want fs.ErrNotExist", err)
+	}
+
+	// the first write creates the secret
+	if err := k.Put(ctx, StateKey, []byte("state")); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	assertObject(t, k, StateKey, "state")
+
+	// wildcard metadata is written in the same update as the certificate
+	if err := PutAll(ctx, WithPrefix(k, "groups/a"),
+		Object{Name: KeyKey, Data: []byte("key")},
+		Object{Name: CertKey, Data: []byte("cert")},
+		Object{Name: MetadataKey("*.example.com"), Data: []byte("meta")},
+	); err != nil {
+		t.Fatalf("PutAll: %v", err)
+	}
+	if fake.updates != 2 {
+		t.Fatalf("got %d updates, want 2", fake.updates)
+	}
+	assertObject(t, k, "groups/a/"+KeyKey, "key")
+	assertObject(t, k, "groups/a/"+CertKey, "cert")
+	assertObject(t, k, "groups/a/"+MetadataKey("*.example.com"), "meta")
+
+	if err := k.Delete(ctx, StateKey); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := k.Get(ctx, StateKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Get of a deleted key: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestKubernetesConflicts(t *testing.T) {
+
+	ctx := context.Background()
+
+	tests := []struct {
+		name      string
+		conflicts int
+		wantErr   bool
+	}{
+		{name: "no conflict"},
+		{name: "retried conflicts", conflicts: maxConflictRetries - 1},
+		{name: "too many conflicts", conflicts: maxConflictRetries, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			k, fake := newFakeKubernetes(t)
+			if err := k.Put(ctx, StateKey, []byte("state")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+
+			fake.conflicts = tt.conflicts
+			err := k.Put(ctx, CertKey, []byte("cert"))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("Put succeeded despite conflicts")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			assertObject(t, k, StateKey, "state")
+			assertObject(t, k, CertKey, "cert")
+		})
+	}
+}
+
+func TestSecretKey(t *testing.T) {
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: StateKey, want: "state.json"},
+		{name: CertKey, want: "certs_cert.pem"},
+		{name: "groups/prod_eu/" + KeyKey, want: "groups_prod_eu_certs_key.pem"},
+		{name: MetadataKey("*.example.com"), want: "b32.MNSXE5DTF4VC4ZLYMFWXA3DFFZRW63I"},
+		{name: "b32.state", want: "b32.MIZTELTTORQXIZI"},
+	}
+
+	for _, tt := range tests {
+		got := secretKey(tt.name)
+		if got != tt.want {
+			t.Errorf("secretKey(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+		if invalidSecretKey(got) {
+			t.Errorf("secretKey(%q) = %q is no valid secret key", tt.name, got)
+		}
+	}
+}
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// journalName lists the renames of a batch write, a journal left by a
+// crash is completed before the directory is used again
+const journalName = ".journal.json"
+
+// staleTempAge is the age after which a temporary file no journal refers
+// to is left over from a crash, younger ones may belong to a write of
+// another replica sharing the directory
+const staleTempAge = 10 * time.Minute
+
+// LockName is the lock file that stops two processes sharing a directory
+const LockName = "instance.lock"
+
+// ErrLocked is returned by Lock if another process holds the lock
+var ErrLocked = errors.New("used by another process")
+
+// Local stores objects as files in a local directory
+// files are replaced atomically and synced to disk
+type Local struct {
+	dir string
+	mu  sync.Mutex
+
+	// replayMu guards replayed, a failed replay is retried on the next call
+	replayMu sync.Mutex
+	replayed bool
+}
+
+// rename is a journal entry
+type rename struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// NewLocal creates a new local directory storage
+func NewLocal(dir string) *Local {
+	return &Local{dir: dir}
+}
+
+// Get reads the file `name` from the directory
+func (l *Local) Get(ctx context.Context, name string) ([]byte, error) {
+
+	if err := l.replayJournal(); err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(l.path(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, notExist(name)
+	}
+
+	return data, err
+}
+
+// Put writes the file `name` to the directory
+func (l *Local) Put(ctx context.Context, name string, data []byte) error {
+
+	if err := l.replayJournal(); err != nil {
+		return err
+	}
+
+	return WriteFile(l.path(name), data)
+}
+
+// PutAll writes the files as one unit: all files are written to
+// temporary files first, then a journal of the renames is saved
+func (l *Local) PutAll(ctx context.Context, objects ...Object) error {
+
+	if err := l.replayJournal(); err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var renames []rename
+	cleanup := func() {
+		for _, r := range renames {
+			os.Remove(l.path(r.From))
+		}
+	}
+	for _, o := range objects {
+		tmp, err := writeTemp(l.path(o.Name), o.Data)
+		if err != nil {
+			cleanup()
+			return err
+		}
+		rel, err := filepath.Rel(l.dir, tmp)
+		if err != nil {
+			os.Remove(tmp)
+			cleanup()
+			return err
+		}
+		renames = append(renames, rename{From: filepath.ToSlash(rel), To: o.Name})
+	}
+
+	journal, err := json.Marshal(renames)
+	if err != nil {
+		cleanup()
+		return err
+	}
+	if err := WriteFile(filepath.Join(l.dir, journalName), journal); err != nil {
+		cleanup()
+		return err
+	}
+
+	return l.replay(renames)
+}
+
+// Delete removes the file `name` from the directory
+func (l *Local) Delete(ctx context.Context, name string) error {
+
+	if err := l.replayJournal(); err != nil {
+		return err
+	}
+
+	if err := os.Remove(l.path(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (l *Local) String() string {
+	return fmt.Sprintf("dir://%s", l.dir)
+}
+
+func (l *Local) path(name string) string {
+	return filepath.Join(l.dir, filepath.FromSlash(name))
+}
+
+// replayJournal completes a batch write interrupted by a crash and removes
+// the temporary files of interrupted writes, once it succeeded
+func (l *Local) replayJournal() error {
+
+	l.replayMu.Lock()
+	defer l.replayMu.Unlock()
+
+	if l.replayed {
+		return nil
+	}
+
+	var renames []rename
+	data, err := os.ReadFile(filepath.Join(l.dir, journalName))
+	if err == nil {
+		if err := json.Unmarshal(data, &renames); err != nil {
+			return fmt.Errorf("invalid journal in %s: %w", l.dir, err)
+		}
+		if err := l.replay(renames); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	l.removeTemps(renames)
+	l.replayed = true
+
+	return nil
+}
+
+// removeTemps removes the stale temporary files that no journal entry
+// refers to, errors are ignored as the files are only garbage
+func (l *Local) removeTemps(renames []rename) {
+
+	journaled := make(map[string]bool, len(renames))
+	for _, r := range renames {
+		journaled[l.path(r.From)] = true
+	}
+
+	filepath.WalkDir(l.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || journaled[name] {
+			return nil
+		}
+		base := d.Name()
+		if !strings.HasPrefix(base, ".") || !strings.Contains(base, ".tmp-") {
+			return nil
+		}
+		if info, err := d.Info(); err == nil && time.Since(info.ModTime()) > staleTempAge {
+			os.Remove(name)
+		}
+		return nil
+	})
+}
+
+// replay renames the temporary files of a batch write into place and
+// removes the journal, renames that already happened are skipped
+func (l *Local) replay(renames []rename) error {
+
+	for _, r := range renames {
+		if err := os.Rename(l.path(r.From), l.path(r.To)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := syncDir(filepath.Dir(l.path(r.To))); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Remove(filepath.Join(l.dir, journalName)); err != nil {
+		return err
+	}
+
+	return syncDir(l.dir)
+}
+
+// CheckPermissions returns an error if a private key or the account
+// state in the directory can be read by the group or other users
+func (l *Local) CheckPermissions() error {
+
+	var exposed []string
+	err := filepath.WalkDir(l.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() || !sensitive(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode().Perm()&0044 != 0 {
+			exposed = append(exposed, p)
+		}
+		return nil
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if len(exposed) > 0 {
+		sort.Strings(exposed)
+		return fmt.Errorf("readable by group or others, run chmod 600 on: %s", strings.Join(exposed, ", "))
+	}
+
+	return nil
+}
+
+// sensitive reports whether the file holds a private key or the account key
+func sensitive(name string) bool {
+
+	switch name {
+	case StateKey, path.Base(KeyKey), path.Base(PrevKeyKey), path.Base(CAKeyKey):
+		return true
+	}
+
+	return false
+}
+
+// WriteFile replaces the file atomically: the data is written to a
+// temporary file, synced and renamed over the file
+func WriteFile(name string, data []byte) error {
+
+	tmp, err := writeTemp(name, data)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return syncDir(filepath.Dir(name))
+}
+
+// writeTemp writes the data to a synced temporary file next to name
+func writeTemp(name string, data []byte) (string, error) {
+
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp(dir, "."+filepath.Base(name)+".tmp-")
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
@@ -0,0 +1,24 @@
+//go:build !unix
+
+package storage
+
+import (
+	"io"
+)
+
+// nopCloser is returned where locks are not supported
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Lock does nothing as file locks are not supported on this platform
+func (l *Local) Lock() (io.Closer, error) {
+	return nopCloser{}, nil
+}
+
+// syncDir does nothing as directories can not be synced on this platform
+func syncDir(dir string) error {
+	return nil
+}
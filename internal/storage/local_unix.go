@@ -0,0 +1,48 @@
+//go:build unix
+
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Lock takes an exclusive lock on the lock file of the directory, it
+// fails if another process holds the lock. Closing releases the lock.
+func (l *Local) Lock() (io.Closer, error) {
+
+	if err := os.MkdirAll(l.dir, 0750); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(l.dir, LockName)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		file.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, fmt.Errorf("%s is %w", l.dir, ErrLocked)
+		}
+		return nil, fmt.Errorf("could not lock %s: %w", path, err)
+	}
+
+	return file, nil
+}
+
+// syncDir flushes the directory entries, so that renames survive a crash
+func syncDir(dir string) error {
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"path"
+)
+
+// Prefixed stores all objects below a common prefix of another storage,
+// so that several certificate groups can share a backend
+type Prefixed struct {
+	storage Storage
+	prefix  string
+}
+
+// WithPrefix returns a storage that keeps all objects in the directory
+// prefix of the underlying storage
+func WithPrefix(s Storage, prefix string) *Prefixed {
+	return &Prefixed{storage: s, prefix: prefix}
+}
+
+// ForTenant returns the storage of the node registry and the audit log of
+// a tenant, the default key keeps them in s itself
+func ForTenant(s Storage, tenant string) Storage {
+
+	if tenant == "" {
+		return s
+	}
+
+	return WithPrefix(s, "tenants/"+tenant)
+}
+
+// Get reads the object from the underlying storage
+func (p *Prefixed) Get(ctx context.Context, name string) ([]byte, error) {
+	return p.storage.Get(ctx, path.Join(p.prefix, name))
+}
+
+// Put writes the object to the underlying storage
+func (p *Prefixed) Put(ctx context.Context, name string, data []byte) error {
+	return p.storage.Put(ctx, path.Join(p.prefix, name), data)
+}
+
+// PutAll writes the objects to the underlying storage as one unit if it
+// supports batches
+func (p *Prefixed) PutAll(ctx context.Context, objects ...Object) error {
+
+	prefixed := make([]Object, len(objects))
+	for i, o := range objects {
+		prefixed[i] = Object{Name: path.Join(p.prefix, o.Name), Data: o.Data}
+	}
+
+	return PutAll(ctx, p.storage, prefixed...)
+}
+
+// Delete removes the object from the underlying storage
+func (p *Prefixed) Delete(ctx context.Context, name string) error {
+	return p.storage.Delete(ctx, path.Join(p.prefix, name))
+}
+
+func (p *Prefixed) String() string {
+	return p.storage.String() + "/" + p.prefix
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// S3Config holds the settings of the S3 storage
+type S3Config struct {
+	Bucket string
+	Prefix string
+	Region string
+	// Endpoint overrides the AWS endpoint for S3 compatible object
+	// storage, e.g. MinIO. Path style addressing is used if it is set.
+	Endpoint string
+}
+
+// S3 stores objects in an S3 compatible bucket
+type S3 struct {
+	svc    *s3.S3
+	bucket string
+	prefix string
+}
+
+// NewS3 creates a new S3 storage, credentials are taken from environment
+func NewS3(cfg S3Config) (*S3, error) {
+
+	if cfg.Bucket == "" {
+		return nil, errors.New("s3 storage requires a bucket")
+	}
+
+	config := &aws.Config{Region: aws.String(cfg.Region)}
+	if cfg.Endpoint != "" {
+		config.Endpoint = aws.String(cfg.Endpoint)
+		config.S3ForcePathStyle = aws.Bool(true)
+	}
+
+	sess, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &S3{
+		svc:    s3.New(sess),
+		bucket: cfg.Bucket,
+		prefix: cfg.Prefix,
+	}, nil
+}
+
+// Get downloads the object `name` from the bucket
+func (s *S3) Get(ctx context.Context, name string) ([]byte, error) {
+
+	out, err := s.svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	})
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && (aerr.Code() == s3.ErrCodeNoSuchKey || aerr.Code() == "NotFound") {
+			return nil, notExist(name)
+		}
+		return nil, fmt.Errorf("could not get s3 object %s: %w", name, err)
+	}
+	defer out.Body.Close()
+
+	return io.ReadAll(out.Body)
+}
+
+// Put uploads the object `name` to the bucket
+func (s *S3) Put(ctx context.Context, name string, data []byte) error {
+
+	if _, err := s.svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+		Body:   bytes.NewReader(data),
+	}); err != nil {
+		return fmt.Errorf("could not put s3 object %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Delete removes the object `name` from the bucket
+func (s *S3) Delete(ctx context.Context, name string) error {
+
+	if _, err := s.svc.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(name)),
+	}); err != nil {
+		return fmt.Errorf("could not delete s3 object %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func (s *S3) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+func (s *S3) key(name string) string {
+	return path.Join(s.prefix, name)
+}
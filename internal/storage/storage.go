@@ -0,0 +1,76 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+)
+
+// Names of the objects kept in storage
+const (
+	StateKey = "state.json"
+	CertKey  = "certs/cert.pem"
+	KeyKey   = "certs/key.pem"
+
+	// the certificate replaced by the last issuance, kept as rollback target
+	PrevCertKey = "certs/cert.prev.pem"
+	PrevKeyKey  = "certs/key.prev.pem"
+
+	CACertKey = "ca/ca.pem"
+	CAKeyKey  = "ca/ca-key.pem"
+
+	// the known nodes and their approval status
+	NodesKey = "nodes.json"
+
+	// the most recent seal, unseal and admin calls
+	AuditKey = "audit.json"
+)
+
+// Storage persists the ACME account state and the certificates
+// Get returns an error wrapping fs.ErrNotExist if the object does not exist
+type Storage interface {
+	Get(ctx context.Context, name string) ([]byte, error)
+	Put(ctx context.Context, name string, data []byte) error
+	Delete(ctx context.Context, name string) error
+	String() string
+}
+
+// Object is a named object written by PutAll
+type Object struct {
+	Name string
+	Data []byte
+}
+
+// Batch is implemented by storages that can write several objects as
+// one unit, so that a crash never leaves a certificate next to the
+// private key of another certificate
+type Batch interface {
+	PutAll(ctx context.Context, objects ...Object) error
+}
+
+// PutAll writes the objects as one unit if the storage implements Batch,
+// otherwise they are written one after another in the given order
+func PutAll(ctx context.Context, s Storage, objects ...Object) error {
+
+	if b, ok := s.(Batch); ok {
+		return b.PutAll(ctx, objects...)
+	}
+
+	for _, o := range objects {
+		if err := s.Put(ctx, o.Name, o.Data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// MetadataKey returns the name of the lego certificate metadata object
+func MetadataKey(domain string) string {
+	return fmt.Sprintf("certs/%s", domain)
+}
+
+// notExist wraps fs.ErrNotExist with the object name
+func notExist(name string) error {
+	return fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+}
@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		// new returns the storage under test and the path of an object
+		// name in the directory backing it
+		new func(dir string) (Storage, func(name string) string)
+	}{
+		{
+			name: "local",
+			new: func(dir string) (Storage, func(string) string) {
+				return NewLocal(dir), func(name string) string {
+					return filepath.Join(dir, filepath.FromSlash(name))
+				}
+			},
+		},
+		{
+			name: "prefixed local",
+			new: func(dir string) (Storage, func(string) string) {
+				return WithPrefix(NewLocal(dir), "groups/a"), func(name string) string {
+					return filepath.Join(dir, "groups", "a", filepath.FromSlash(name))
+				}
+			},
+		},
+		{
+			name: "prefixed storage without batches",
+			new: func(dir string) (Storage, func(string) string) {
+				return WithPrefix(unbatched{NewLocal(dir)}, "groups/a"), func(name string) string {
+					return filepath.Join(dir, "groups", "a", filepath.FromSlash(name))
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+
+			s, file := tt.new(t.TempDir())
+
+			if _, err := s.Get(ctx, CertKey); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Get of a missing object: got %v, want fs.ErrNotExist", err)
+			}
+
+			if err := s.Put(ctx, StateKey, []byte("state")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			assertObject(t, s, StateKey, "state")
+
+			if err := PutAll(ctx, s,
+				Object{Name: KeyKey, Data: []byte("key")},
+				Object{Name: CertKey, Data: []byte("cert")},
+				Object{Name: MetadataKey("*.example.com"), Data: []byte("meta")},
+			); err != nil {
+				t.Fatalf("PutAll: %v", err)
+			}
+			assertObject(t, s, KeyKey, "key")
+			assertObject(t, s, CertKey, "cert")
+			assertObject(t, s, MetadataKey("*.example.com"), "meta")
+			if data, err := os.ReadFile(file(CertKey)); err != nil || string(data) != "cert" {
+				t.Fatalf("%s: got %q, %v", file(CertKey), data, err)
+			}
+
+			// replacing an object leaves no temporary files behind
+			if err := s.Put(ctx, CertKey, []byte("cert2")); err != nil {
+				t.Fatalf("Put: %v", err)
+			}
+			assertObject(t, s, CertKey, "cert2")
+			entries, err := os.ReadDir(filepath.Dir(file(CertKey)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 3 {
+				t.Fatalf("got %d files in %s, want 3", len(entries), filepath.Dir(file(CertKey)))
+			}
+
+			if err := s.Delete(ctx, CertKey); err != nil {
+				t.Fatalf("Delete: %v", err)
+			}
+			if _, err := s.Get(ctx, CertKey); !errors.Is(err, fs.ErrNotExist) {
+				t.Fatalf("Get of a deleted object: got %v, want fs.ErrNotExist", err)
+			}
+			if err := s.Delete(ctx, CertKey); err != nil {
+				t.Fatalf("Delete of a missing object: %v", err)
+			}
+		})
+	}
+}
+
+func TestLocalJournal(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// a crash after the journal was written left one rename undone
+	if err := os.MkdirAll(filepath.Join(dir, "certs"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range map[string]string{
+		"certs/key.pem":     "new key",
+		"certs/.cert.tmp-1": "new cert",
+		"certs/cert.pem":    "old cert",
+		journalName:         `[{"from":"certs/.key.tmp-1","to":"certs/key.pem"},{"from":"certs/.cert.tmp-1","to":"certs/cert.pem"}]`,
+	} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := NewLocal(dir)
+	assertObject(t, s, KeyKey, "new key")
+	assertObject(t, s, CertKey, "new cert")
+	if _, err := os.Stat(filepath.Join(dir, journalName)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("journal not removed: %v", err)
+	}
+}
+
+func TestLocalRecovery(t *testing.T) {
+
+	dir := t.TempDir()
+
+	// a crash before the journal was written left temporary files
+	stale := time.Now().Add(-2 * staleTempAge)
+	for name, mtime := range map[string]time.Time{
+		".cert.pem.tmp-1": stale,
+		".key.pem.tmp-2":  time.Now(),
+		".other":          stale,
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, journalName), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed replay is retried
+	s := NewLocal(dir)
+	if _, err := s.Get(context.Background(), CertKey); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want an invalid journal", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, journalName), []byte("[]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(context.Background(), CertKey); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("got %v, want %v", err, fs.ErrNotExist)
+	}
+
+	// only stale temporary files are removed
+	for name, want := range map[string]bool{
+		".cert.pem.tmp-1": false,
+		".key.pem.tmp-2":  true,
+		".other":          true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Fatalf("%s: got %v, want exists %t", name, err, want)
+		}
+	}
+}
+
+// unbatched hides the PutAll method of a storage
+type unbatched struct {
+	Storage
+}
+
+func assertObject(t *testing.T, s Storage, name, want string) {
+
+	t.Helper()
+
+	data, err := s.Get(context.Background(), name)
+	if err != nil {
+		t.Fatalf("Get %s: %v", name, err)
+	}
+	if !bytes.Equal(data, []byte(want)) {
+		t.Fatalf("Get %s: got %q, want %q", name, data, want)
+	}
+}